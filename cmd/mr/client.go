@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/je4/certloader/v2/pkg/loader"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"github.com/je4/miniresolver/v2/pkg/resolver"
+	"github.com/je4/miniresolver/v2/pkg/selector"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"github.com/rs/zerolog"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// stringList collects repeated flags
+type stringList []string
+
+func (sl *stringList) String() string { return strings.Join(*sl, ",") }
+func (sl *stringList) Set(value string) error {
+	*sl = append(*sl, value)
+	return nil
+}
+
+// command is a client subcommand of mr
+type command struct {
+	usage string
+	run   func(ctx context.Context, cl *commandLine, args []string) error
+}
+
+// commandLine holds the connection and flags common to all client subcommands
+type commandLine struct {
+	client    pb.MiniResolverClient
+	output    string
+	stdout    io.Writer
+	domains   stringList
+	selectors stringList
+	prefix    string
+	single    bool
+	version   string
+	zone      string
+	tags      stringList
+	metadata  stringList
+	weight    uint
+	priority  uint
+	ttl       time.Duration
+	after     uint64
+	limit     int
+}
+
+var commands = map[string]*command{
+	"list": {
+		usage: "list [-domain <domain>]... [-prefix <prefix>]",
+		run:   runList,
+	},
+	"resolve": {
+		usage: "resolve [-selector <expr>]... <name>",
+		run:   runResolve,
+	},
+	"register": {
+		usage: "register [-domain <domain>]... [-single] [-version <version>] [-zone <zone>] [-tag <tag>]... [-meta <key=value>]... [-weight <n>] [-priority <n>] [-ttl <duration>] <name> <host:port>",
+		run:   runRegister,
+	},
+	"deregister": {
+		usage: "deregister [-domain <domain>]... <name> <host:port>",
+		run:   runDeregister,
+	},
+	"drain": {
+		usage: "drain [-domain <domain>]... <name> <host:port>",
+		run:   runDrain,
+	},
+	"watch": {
+		usage: "watch [-selector <expr>]... <name>",
+		run:   runWatch,
+	},
+	"events": {
+		usage: "events [-after <sequence>] [-limit <n>] [<name>]",
+		run:   runEvents,
+	},
+}
+
+// commandUsage lists all client subcommands
+func commandUsage() string {
+	var usages []string
+	for _, cmd := range commands {
+		usages = append(usages, "  mr [-config <file>] "+cmd.usage)
+	}
+	sort.Strings(usages)
+	return strings.Join(usages, "\n")
+}
+
+// runCommand connects to the resolver and executes the subcommand in args[0]
+func runCommand(conf *MiniResolverConfig, args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return errors.Errorf("unknown command '%s'", args[0])
+	}
+	cl := &commandLine{stdout: os.Stdout}
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: mr [-config <file>] %s\n", cmd.usage)
+		fs.PrintDefaults()
+	}
+	addr := fs.String("addr", conf.LocalAddr, "address of the miniresolver")
+	fs.StringVar(&cl.output, "o", outputTable, "output format (table or json)")
+	fs.Var(&cl.selectors, "selector", "selector expression (i.e. \"zone=bs1\"), may be repeated")
+	fs.Var(&cl.domains, "domain", "domain of the service, may be repeated")
+	fs.StringVar(&cl.prefix, "prefix", "", "list only services starting with prefix")
+	fs.BoolVar(&cl.single, "single", false, "replace all other instances of the service")
+	fs.StringVar(&cl.version, "version", "", "version of the instance")
+	fs.StringVar(&cl.zone, "zone", "", "zone of the instance")
+	fs.Var(&cl.tags, "tag", "tag of the instance, may be repeated")
+	fs.Var(&cl.metadata, "meta", "metadata key=value of the instance, may be repeated")
+	fs.UintVar(&cl.weight, "weight", 0, "weight of the instance within its priority tier")
+	fs.UintVar(&cl.priority, "priority", 0, "priority tier of the instance (lower is preferred)")
+	fs.DurationVar(&cl.ttl, "ttl", 0, "requested lifetime of the registration (0 for the resolver default)")
+	fs.Uint64Var(&cl.after, "after", 0, "show only events after this sequence")
+	fs.IntVar(&cl.limit, "limit", 0, "maximum number of events (0 for all)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return errors.WithStack(err)
+	}
+	if cl.output != outputTable && cl.output != outputJSON {
+		return errors.Errorf("invalid output format '%s'", cl.output)
+	}
+
+	l := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).Level(zerolog.WarnLevel).With().Timestamp().Logger()
+	var logger zLogger.ZLogger = &l
+
+	// without explicit configuration the server certificate is used as client certificate
+	clientTLS := conf.ClientTLS
+	if clientTLS == nil {
+		clientTLS = &conf.TLS
+	}
+	tlsConfig, tlsLoader, err := loader.CreateClientLoader(clientTLS, logger)
+	if err != nil {
+		return errors.Wrap(err, "cannot create client loader")
+	}
+	defer tlsLoader.Close()
+	mr, err := resolver.NewMiniresolverClient(*addr, nil, tlsConfig, nil, 0, 0, logger)
+	if err != nil {
+		return errors.Wrapf(err, "cannot connect to miniresolver %s", *addr)
+	}
+	defer mr.Close()
+	cl.client = mr.MiniResolverClient
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	return cmd.run(ctx, cl, fs.Args())
+}
+
+func (cl *commandLine) query(name string) (*pb.ServiceQuery, error) {
+	query := &pb.ServiceQuery{Name: name}
+	for _, expr := range cl.selectors {
+		sel, err := selector.Parse(expr)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		query.Selectors = append(query.Selectors, sel)
+	}
+	return query, nil
+}
+
+// serviceData creates the registration data from "<host:port>" and the flags
+func (cl *commandLine) serviceData(name, addr string) (*pb.ServiceData, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid address '%s'", addr)
+	}
+	portInt, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid port in '%s'", addr)
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		host = fmt.Sprintf("[%s]", host)
+	}
+	data := &pb.ServiceData{
+		Service:  name,
+		Host:     &host,
+		Port:     uint32(portInt),
+		Domains:  cl.domains,
+		Single:   cl.single,
+		Version:  cl.version,
+		Zone:     cl.zone,
+		Tags:     cl.tags,
+		Weight:   uint32(cl.weight),
+		Priority: uint32(cl.priority),
+		Ttl:      int64(cl.ttl.Seconds()),
+	}
+	for _, kv := range cl.metadata {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, errors.Errorf("invalid metadata '%s', expected key=value", kv)
+		}
+		if data.Metadata == nil {
+			data.Metadata = map[string]string{}
+		}
+		data.Metadata[key] = value
+	}
+	return data, nil
+}
+
+// instanceRow is the output format of a service instance
+type instanceRow struct {
+	Service  string            `json:"service"`
+	Addr     string            `json:"addr"`
+	Version  string            `json:"version,omitempty"`
+	Zone     string            `json:"zone,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Weight   uint32            `json:"weight,omitempty"`
+	Priority uint32            `json:"priority,omitempty"`
+}
+
+func newInstanceRows(service string, resp *pb.ServicesResponse) []instanceRow {
+	var rows = []instanceRow{}
+	instances := resp.GetInstances()
+	if len(instances) == 0 {
+		// server without instance metadata
+		for _, addr := range resp.GetAddrs() {
+			instances = append(instances, &pb.ServiceInstance{Addr: addr})
+		}
+	}
+	for _, instance := range instances {
+		rows = append(rows, instanceRow{
+			Service:  service,
+			Addr:     instance.GetAddr(),
+			Version:  instance.GetVersion(),
+			Zone:     instance.GetZone(),
+			Tags:     instance.GetTags(),
+			Metadata: instance.GetMetadata(),
+			Weight:   instance.GetWeight(),
+			Priority: instance.GetPriority(),
+		})
+	}
+	return rows
+}
+
+// printInstances writes the instances as table or json
+func (cl *commandLine) printInstances(rows []instanceRow) error {
+	if cl.output == outputJSON {
+		return errors.WithStack(json.NewEncoder(cl.stdout).Encode(rows))
+	}
+	tw := tabwriter.NewWriter(cl.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVICE\tADDRESS\tVERSION\tZONE\tPRIORITY\tWEIGHT\tTAGS\tMETADATA")
+	for _, row := range rows {
+		var meta []string
+		for key, value := range row.Metadata {
+			meta = append(meta, key+"="+value)
+		}
+		sort.Strings(meta)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n", row.Service, row.Addr, row.Version, row.Zone, row.Priority, row.Weight, strings.Join(row.Tags, ","), strings.Join(meta, ","))
+	}
+	return errors.WithStack(tw.Flush())
+}
+
+// listRow is the output format of a registry entry
+type listRow struct {
+	instanceRow
+	Health      string    `json:"health"`
+	Refreshed   time.Time `json:"refreshed"`
+	Provisional bool      `json:"provisional,omitempty"`
+	Single      bool      `json:"single,omitempty"`
+}
+
+// printList writes the registry entries as table or json
+func (cl *commandLine) printList(rows []listRow) error {
+	if cl.output == outputJSON {
+		return errors.WithStack(json.NewEncoder(cl.stdout).Encode(rows))
+	}
+	tw := tabwriter.NewWriter(cl.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVICE\tADDRESS\tHEALTH\tREFRESHED\tFLAGS\tVERSION\tZONE\tPRIORITY\tWEIGHT\tTAGS")
+	for _, row := range rows {
+		var flags []string
+		if row.Single {
+			flags = append(flags, "single")
+		}
+		if row.Provisional {
+			flags = append(flags, "provisional")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n", row.Service, row.Addr, row.Health, row.Refreshed.Local().Format(time.DateTime), strings.Join(flags, ","), row.Version, row.Zone, row.Priority, row.Weight, strings.Join(row.Tags, ","))
+	}
+	return errors.WithStack(tw.Flush())
+}
+
+// eventRow is the output format of a registry event
+type eventRow struct {
+	Sequence   uint64    `json:"sequence"`
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	Service    string    `json:"service"`
+	Domain     string    `json:"domain,omitempty"`
+	Addr       string    `json:"addr"`
+	Reason     string    `json:"reason,omitempty"`
+	Identities []string  `json:"identities,omitempty"`
+	Replicated bool      `json:"replicated,omitempty"`
+}
+
+// printEvents writes the registry events as table or json
+func (cl *commandLine) printEvents(rows []eventRow) error {
+	if cl.output == outputJSON {
+		return errors.WithStack(json.NewEncoder(cl.stdout).Encode(rows))
+	}
+	tw := tabwriter.NewWriter(cl.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SEQ\tTIME\tTYPE\tSERVICE\tADDRESS\tIDENTITY\tREASON")
+	for _, row := range rows {
+		service := row.Service
+		if row.Domain != "" {
+			service = row.Domain + "." + service
+		}
+		identity := strings.Join(row.Identities, ",")
+		if row.Replicated {
+			identity += " (replicated)"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", row.Sequence, row.Time.Local().Format(time.DateTime), row.Type, service, row.Addr, identity, row.Reason)
+	}
+	return errors.WithStack(tw.Flush())
+}
+
+// printMessage writes a status message as text or json
+func (cl *commandLine) printMessage(status, message string) error {
+	if cl.output == outputJSON {
+		return errors.WithStack(json.NewEncoder(cl.stdout).Encode(map[string]string{"status": status, "message": message}))
+	}
+	_, err := fmt.Fprintf(cl.stdout, "%s: %s\n", status, message)
+	return errors.WithStack(err)
+}
+
+func runList(ctx context.Context, cl *commandLine, args []string) error {
+	if len(args) != 0 {
+		return errors.New("list does not take arguments")
+	}
+	domains := cl.domains
+	if len(domains) == 0 {
+		domains = []string{""}
+	}
+	var rows = []listRow{}
+	for _, domain := range domains {
+		req := &pb.ListServicesRequest{Domain: domain, Prefix: cl.prefix}
+		for {
+			resp, err := cl.client.ListServices(ctx, req)
+			if err != nil {
+				return errors.Wrap(err, "cannot list services")
+			}
+			for _, svc := range resp.GetServices() {
+				for _, listed := range svc.GetInstances() {
+					instance := listed.GetInstance()
+					rows = append(rows, listRow{
+						instanceRow: instanceRow{
+							Service:  svc.GetName(),
+							Addr:     instance.GetAddr(),
+							Version:  instance.GetVersion(),
+							Zone:     instance.GetZone(),
+							Tags:     instance.GetTags(),
+							Metadata: instance.GetMetadata(),
+							Weight:   instance.GetWeight(),
+							Priority: instance.GetPriority(),
+						},
+						Health:      listed.GetHealth(),
+						Refreshed:   listed.GetRefreshed().AsTime(),
+						Provisional: listed.GetProvisional(),
+						Single:      svc.GetSingle(),
+					})
+				}
+			}
+			if resp.GetNextPageToken() == "" {
+				break
+			}
+			req.PageToken = resp.GetNextPageToken()
+		}
+	}
+	return cl.printList(rows)
+}
+
+func runResolve(ctx context.Context, cl *commandLine, args []string) error {
+	if len(args) != 1 {
+		return errors.New("exactly one service name needed")
+	}
+	query, err := cl.query(args[0])
+	if err != nil {
+		return err
+	}
+	resp, err := cl.client.ResolveServices(ctx, query)
+	if err != nil {
+		return errors.Wrapf(err, "cannot resolve '%s'", args[0])
+	}
+	if len(resp.GetAddrs()) == 0 && len(resp.GetInstances()) == 0 {
+		return errors.Errorf("service '%s' not found", args[0])
+	}
+	return cl.printInstances(newInstanceRows(args[0], resp))
+}
+
+func runRegister(ctx context.Context, cl *commandLine, args []string) error {
+	if len(args) != 2 {
+		return errors.New("service name and address needed")
+	}
+	data, err := cl.serviceData(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	resp, err := cl.client.AddService(ctx, data)
+	if err != nil {
+		return errors.Wrapf(err, "cannot register '%s'", args[0])
+	}
+	return cl.printMessage(resp.GetResponse().GetStatus().String(), fmt.Sprintf("%s (lease %d expires in %v)", resp.GetResponse().GetMessage(), resp.GetLeaseID(), time.Duration(resp.GetTtl())*time.Second))
+}
+
+func runDeregister(ctx context.Context, cl *commandLine, args []string) error {
+	if len(args) != 2 {
+		return errors.New("service name and address needed")
+	}
+	data, err := cl.serviceData(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	resp, err := cl.client.RemoveService(ctx, data)
+	if err != nil {
+		return errors.Wrapf(err, "cannot deregister '%s'", args[0])
+	}
+	return cl.printMessage(resp.GetStatus().String(), resp.GetMessage())
+}
+
+func runDrain(ctx context.Context, cl *commandLine, args []string) error {
+	if len(args) != 2 {
+		return errors.New("service name and address needed")
+	}
+	data, err := cl.serviceData(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	resp, err := cl.client.DrainService(ctx, data)
+	if err != nil {
+		return errors.Wrapf(err, "cannot drain '%s'", args[0])
+	}
+	return cl.printMessage(resp.GetStatus().String(), resp.GetMessage())
+}
+
+func runWatch(ctx context.Context, cl *commandLine, args []string) error {
+	if len(args) != 1 {
+		return errors.New("exactly one service name needed")
+	}
+	query, err := cl.query(args[0])
+	if err != nil {
+		return err
+	}
+	stream, err := cl.client.WatchService(ctx, query)
+	if err != nil {
+		return errors.Wrapf(err, "cannot watch '%s'", args[0])
+	}
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrapf(err, "cannot receive instances of '%s'", args[0])
+		}
+		if cl.output == outputTable {
+			fmt.Fprintf(cl.stdout, "--- %s\n", time.Now().Format(time.RFC3339))
+		}
+		if err := cl.printInstances(newInstanceRows(args[0], resp)); err != nil {
+			return err
+		}
+	}
+}
+
+func runEvents(ctx context.Context, cl *commandLine, args []string) error {
+	if len(args) > 1 {
+		return errors.New("at most one service name allowed")
+	}
+	req := &pb.GetEventsRequest{
+		AfterSequence: cl.after,
+		Limit:         int32(cl.limit),
+	}
+	if len(args) == 1 {
+		req.Service = args[0]
+	}
+	resp, err := cl.client.GetEvents(ctx, req)
+	if err != nil {
+		return errors.Wrap(err, "cannot get events")
+	}
+	if cl.after != 0 && resp.GetFirstSequence() > cl.after+1 {
+		fmt.Fprintf(os.Stderr, "events %d to %d are not buffered anymore\n", cl.after+1, resp.GetFirstSequence()-1)
+	}
+	var rows = []eventRow{}
+	for _, event := range resp.GetEvents() {
+		rows = append(rows, eventRow{
+			Sequence:   event.GetSequence(),
+			Time:       event.GetTime().AsTime(),
+			Type:       strings.TrimPrefix(event.GetType().String(), "EVENT_"),
+			Service:    event.GetService(),
+			Domain:     event.GetDomain(),
+			Addr:       event.GetAddr(),
+			Reason:     event.GetReason(),
+			Identities: event.GetIdentities(),
+			Replicated: event.GetReplicated(),
+		})
+	}
+	return cl.printEvents(rows)
+}
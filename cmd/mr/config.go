@@ -10,17 +10,117 @@ import (
 	"os"
 )
 
+type ClusterConfig struct {
+	Peers []string       `toml:"peers" yaml:"peers"`
+	TLS   *loader.Config `toml:"tls" yaml:"tls"`
+}
+
+type HealthCheckServiceConfig struct {
+	Protocol         string          `toml:"protocol" yaml:"protocol"`
+	Interval         config.Duration `toml:"interval" yaml:"interval"`
+	Timeout          config.Duration `toml:"timeout" yaml:"timeout"`
+	FailureThreshold int             `toml:"failurethreshold" yaml:"failurethreshold"`
+}
+
+type HealthCheckConfig struct {
+	Enabled bool           `toml:"enabled" yaml:"enabled"`
+	TLS     *loader.Config `toml:"tls" yaml:"tls"`
+	HealthCheckServiceConfig
+	Services map[string]HealthCheckServiceConfig `toml:"services" yaml:"services"`
+}
+
+type AdminConfig struct {
+	Addr    string         `toml:"addr" yaml:"addr"`
+	ExtAddr string         `toml:"extaddr" yaml:"extaddr"`
+	TLS     *loader.Config `toml:"tls" yaml:"tls"`
+}
+
+type DNSConfig struct {
+	Addr string `toml:"addr" yaml:"addr"`
+	Zone string `toml:"zone" yaml:"zone"`
+}
+
+type ReverseProxyConfig struct {
+	Addr        string `toml:"addr" yaml:"addr"`
+	UpstreamTLS bool   `toml:"upstreamtls" yaml:"upstreamtls"`
+}
+
+type SNIProxyConfig struct {
+	Addr string `toml:"addr" yaml:"addr"`
+	Zone string `toml:"zone" yaml:"zone"`
+}
+
+type ProxyUserConfig struct {
+	Name     string `toml:"name" yaml:"name"`
+	Password string `toml:"password" yaml:"password"` // bcrypt hash
+}
+
+type ProxyRuleConfig struct {
+	Identity string   `toml:"identity" yaml:"identity"`
+	Services []string `toml:"services" yaml:"services"`
+	Domains  []string `toml:"domains" yaml:"domains"`
+}
+
+type ProxyAuthConfig struct {
+	Enabled bool              `toml:"enabled" yaml:"enabled"`
+	Users   []ProxyUserConfig `toml:"users" yaml:"users"`
+	Rules   []ProxyRuleConfig `toml:"rules" yaml:"rules"`
+}
+
+type ProxyLimitsConfig struct {
+	MaxConnsPerClient int             `toml:"maxconnsperclient" yaml:"maxconnsperclient"`
+	MaxConnsPerTarget int             `toml:"maxconnspertarget" yaml:"maxconnspertarget"`
+	Rate              float64         `toml:"rate" yaml:"rate"`
+	Burst             int             `toml:"burst" yaml:"burst"`
+	IdleTimeout       config.Duration `toml:"idletimeout" yaml:"idletimeout"`
+	MaxDuration       config.Duration `toml:"maxduration" yaml:"maxduration"`
+}
+
+type EventsConfig struct {
+	Size      int    `toml:"size" yaml:"size"`
+	AuditFile string `toml:"auditfile" yaml:"auditfile"`
+}
+
+type PolicyRuleConfig struct {
+	Identity  string   `toml:"identity" yaml:"identity"`
+	Services  []string `toml:"services" yaml:"services"`
+	Domains   []string `toml:"domains" yaml:"domains"`
+	Replicate bool     `toml:"replicate" yaml:"replicate"`
+}
+
+type AuthorizationConfig struct {
+	Enabled bool               `toml:"enabled" yaml:"enabled"`
+	Rules   []PolicyRuleConfig `toml:"rules" yaml:"rules"`
+}
+
 type MiniResolverConfig struct {
-	LocalAddr          string             `toml:"localaddr" yaml:"localaddr"`
-	ProxyAddr          string             `toml:"proxyaddr" yaml:"proxyaddr"`
-	ProxyExternalAddr  string             `toml:"proxyexternaladdr" yaml:"proxyexternaladdr"`
-	TLS                loader.Config      `toml:"tls" yaml:"tls"`
-	LogFile            string             `toml:"logfile" yaml:"logfile"`
-	LogLevel           string             `toml:"loglevel" yaml:"loglevel"`
-	ServiceExpiration  config.Duration    `toml:"serviceExpiration" yaml:"serviceExpiration"`
-	NotFoundExpiration config.Duration    `toml:"notFoundExpiration" yaml:"notFoundExpiration"`
-	BufferSize         int                `toml:"bufferSize" yaml:"bufferSize"`
-	Log                stashconfig.Config `toml:"log" yaml:"log"`
+	LocalAddr          string              `toml:"localaddr" yaml:"localaddr"`
+	ProxyAddr          string              `toml:"proxyaddr" yaml:"proxyaddr"`
+	ProxyExternalAddr  string              `toml:"proxyexternaladdr" yaml:"proxyexternaladdr"`
+	ProxyTLS           *loader.Config      `toml:"proxytls" yaml:"proxytls"`
+	MetricsAddr        string              `toml:"metricsaddr" yaml:"metricsaddr"`
+	TLS                loader.Config       `toml:"tls" yaml:"tls"`
+	ClientTLS          *loader.Config      `toml:"clienttls" yaml:"clienttls"`
+	LogFile            string              `toml:"logfile" yaml:"logfile"`
+	LogLevel           string              `toml:"loglevel" yaml:"loglevel"`
+	ServiceExpiration  config.Duration     `toml:"serviceExpiration" yaml:"serviceExpiration"`
+	MinLeaseTTL        config.Duration     `toml:"minLeaseTTL" yaml:"minLeaseTTL"`
+	MaxLeaseTTL        config.Duration     `toml:"maxLeaseTTL" yaml:"maxLeaseTTL"`
+	NotFoundExpiration config.Duration     `toml:"notFoundExpiration" yaml:"notFoundExpiration"`
+	BufferSize         int                 `toml:"bufferSize" yaml:"bufferSize"`
+	SnapshotFile       string              `toml:"snapshotfile" yaml:"snapshotfile"`
+	SnapshotInterval   config.Duration     `toml:"snapshotinterval" yaml:"snapshotinterval"`
+	Cluster            ClusterConfig       `toml:"cluster" yaml:"cluster"`
+	HealthCheck        HealthCheckConfig   `toml:"healthcheck" yaml:"healthcheck"`
+	Admin              AdminConfig         `toml:"admin" yaml:"admin"`
+	DNS                DNSConfig           `toml:"dns" yaml:"dns"`
+	Authorization      AuthorizationConfig `toml:"authorization" yaml:"authorization"`
+	Events             EventsConfig        `toml:"events" yaml:"events"`
+	ReverseProxy       ReverseProxyConfig  `toml:"reverseproxy" yaml:"reverseproxy"`
+	SNIProxy           SNIProxyConfig      `toml:"sniproxy" yaml:"sniproxy"`
+	ProxyLimits        ProxyLimitsConfig   `toml:"proxylimits" yaml:"proxylimits"`
+	ProxyAuth          ProxyAuthConfig     `toml:"proxyauth" yaml:"proxyauth"`
+	Log                stashconfig.Config  `toml:"log" yaml:"log"`
 }
 
 func LoadMiniResolverConfig(fSys fs.FS, fp string, conf *MiniResolverConfig) error {
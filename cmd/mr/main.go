@@ -2,22 +2,30 @@ package main
 
 import (
 	"crypto/tls"
+	"emperror.dev/errors"
 	"flag"
 	"fmt"
 	"github.com/je4/certloader/v2/pkg/loader"
 	"github.com/je4/miniresolver/v2/configs"
 	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"github.com/je4/miniresolver/v2/pkg/rest"
 	"github.com/je4/miniresolver/v2/pkg/service"
 	"github.com/je4/trustutil/v2/pkg/grpchelper"
 	"github.com/je4/utils/v2/pkg/config"
 	"github.com/je4/utils/v2/pkg/zLogger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	ublogger "gitlab.switch.ch/ub-unibas/go-ublogger"
+	"google.golang.org/grpc"
 	"io"
 	"io/fs"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -25,6 +33,10 @@ import (
 var cfg = flag.String("config", "", "location of toml configuration file")
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage:\n  mr [-config <file>]\n%s\n", commandUsage())
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 	var cfgFS fs.FS
 	var cfgFile string
@@ -41,11 +53,21 @@ func main() {
 		BufferSize:         1024,
 		ServiceExpiration:  config.Duration(5 * time.Minute),
 		NotFoundExpiration: config.Duration(4 * time.Second),
+		SnapshotInterval:   config.Duration(time.Minute),
 	}
 	if err := LoadMiniResolverConfig(cfgFS, cfgFile, conf); err != nil {
 		log.Fatalf("cannot load toml from [%v] %s: %v", cfgFS, cfgFile, err)
 	}
 
+	// client subcommands connect to a running miniresolver
+	if flag.NArg() > 0 {
+		if err := runCommand(conf, flag.Args()); err != nil {
+			fmt.Fprintf(os.Stderr, "mr %s: %v\n", flag.Arg(0), err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// create logger instance
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -78,7 +100,135 @@ func main() {
 	l2 := _logger.With().Timestamp().Str("host", hostname).Str("addr", conf.LocalAddr).Logger() //.Output(output)
 	var logger zLogger.ZLogger = &l2
 
-	srv := service.NewMiniResolver(conf.BufferSize, time.Duration(conf.ServiceExpiration), conf.ProxyAddr, logger)
+	var srvOpts []service.Option
+	if conf.SnapshotFile != "" {
+		srvOpts = append(srvOpts, service.WithSnapshot(conf.SnapshotFile, time.Duration(conf.SnapshotInterval)))
+	}
+	if len(conf.Cluster.Peers) > 0 {
+		// without explicit configuration the server certificate is used for the peers
+		clusterTLS := conf.Cluster.TLS
+		if clusterTLS == nil {
+			clusterTLS = &conf.TLS
+		}
+		clusterTLSConfig, clusterLoader, err := loader.CreateClientLoader(clusterTLS, logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("cannot create cluster client loader")
+		}
+		defer clusterLoader.Close()
+		srvOpts = append(srvOpts, service.WithCluster(conf.Cluster.Peers, clusterTLSConfig))
+	}
+	if conf.HealthCheck.Enabled {
+		// without explicit configuration the server certificate is used for the health checks
+		healthTLS := conf.HealthCheck.TLS
+		if healthTLS == nil {
+			healthTLS = &conf.TLS
+		}
+		healthTLSConfig, healthLoader, err := loader.CreateClientLoader(healthTLS, logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("cannot create health check client loader")
+		}
+		defer healthLoader.Close()
+		defaultConfig := healthCheckConfig(service.DefaultHealthCheckConfig, conf.HealthCheck.HealthCheckServiceConfig)
+		serviceConfigs := map[string]service.HealthCheckConfig{}
+		for name, c := range conf.HealthCheck.Services {
+			serviceConfigs[name] = healthCheckConfig(defaultConfig, c)
+		}
+		srvOpts = append(srvOpts, service.WithHealthCheck(healthTLSConfig, defaultConfig, serviceConfigs))
+	}
+	if conf.MinLeaseTTL != 0 || conf.MaxLeaseTTL != 0 {
+		minTTL, maxTTL := time.Duration(conf.MinLeaseTTL), time.Duration(conf.MaxLeaseTTL)
+		if minTTL == 0 {
+			minTTL = service.DefaultMinLeaseTTL
+		}
+		if maxTTL == 0 {
+			maxTTL = time.Duration(conf.ServiceExpiration)
+		}
+		srvOpts = append(srvOpts, service.WithLeaseTTL(minTTL, maxTTL))
+	}
+	if conf.DNS.Addr != "" {
+		zone := conf.DNS.Zone
+		if zone == "" {
+			zone = "miniresolver."
+		}
+		srvOpts = append(srvOpts, service.WithDNS(conf.DNS.Addr, zone))
+	}
+	if conf.Authorization.Enabled {
+		var rules []service.PolicyRule
+		for _, r := range conf.Authorization.Rules {
+			rules = append(rules, service.PolicyRule{
+				Identity:  r.Identity,
+				Services:  r.Services,
+				Domains:   r.Domains,
+				Replicate: r.Replicate,
+			})
+		}
+		srvOpts = append(srvOpts, service.WithPolicy(rules))
+	}
+	if conf.ReverseProxy.Addr != "" {
+		var upstreamTLSConfig *tls.Config
+		if conf.ReverseProxy.UpstreamTLS {
+			// the instances are called with the client certificate of the resolver
+			upstreamTLS := conf.ClientTLS
+			if upstreamTLS == nil {
+				upstreamTLS = &conf.TLS
+			}
+			var upstreamLoader io.Closer
+			upstreamTLSConfig, upstreamLoader, err = loader.CreateClientLoader(upstreamTLS, logger)
+			if err != nil {
+				logger.Fatal().Err(err).Msg("cannot create reverse proxy client loader")
+			}
+			defer upstreamLoader.Close()
+		}
+		srvOpts = append(srvOpts, service.WithReverseProxy(conf.ReverseProxy.Addr, upstreamTLSConfig))
+	}
+	if conf.SNIProxy.Addr != "" {
+		zone := conf.SNIProxy.Zone
+		if zone == "" {
+			zone = "miniresolver"
+		}
+		srvOpts = append(srvOpts, service.WithSNIProxy(conf.SNIProxy.Addr, zone))
+	}
+	srvOpts = append(srvOpts, service.WithProxyLimits(service.ProxyLimits{
+		MaxConnsPerClient: conf.ProxyLimits.MaxConnsPerClient,
+		MaxConnsPerTarget: conf.ProxyLimits.MaxConnsPerTarget,
+		Rate:              conf.ProxyLimits.Rate,
+		Burst:             conf.ProxyLimits.Burst,
+		IdleTimeout:       time.Duration(conf.ProxyLimits.IdleTimeout),
+		MaxDuration:       time.Duration(conf.ProxyLimits.MaxDuration),
+	}))
+	if conf.ProxyTLS != nil {
+		proxyTLSConfig, proxyLoader, err := loader.CreateServerLoader(false, conf.ProxyTLS, nil, logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("cannot create proxy server loader")
+		}
+		defer proxyLoader.Close()
+		srvOpts = append(srvOpts, service.WithProxyTLS(proxyTLSConfig))
+	}
+	if conf.ProxyAuth.Enabled {
+		users := map[string]string{}
+		for _, u := range conf.ProxyAuth.Users {
+			users[u.Name] = u.Password
+		}
+		var rules []service.ProxyRule
+		for _, r := range conf.ProxyAuth.Rules {
+			rules = append(rules, service.ProxyRule{
+				Identity: r.Identity,
+				Services: r.Services,
+				Domains:  r.Domains,
+			})
+		}
+		srvOpts = append(srvOpts, service.WithProxyAuth(users, rules))
+	}
+	if conf.Events.Size != 0 || conf.Events.AuditFile != "" {
+		srvOpts = append(srvOpts, service.WithEventLog(conf.Events.Size, conf.Events.AuditFile))
+	}
+	var metricsRegistry *prometheus.Registry
+	if conf.MetricsAddr != "" {
+		metricsRegistry = prometheus.NewRegistry()
+		metricsRegistry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+		srvOpts = append(srvOpts, service.WithMetrics(metricsRegistry))
+	}
+	srv := service.NewMiniResolver(conf.BufferSize, time.Duration(conf.ServiceExpiration), conf.ProxyAddr, logger, srvOpts...)
 	defer srv.Close()
 
 	tlsConfig, l, err := loader.CreateServerLoader(true, &conf.TLS, nil, logger)
@@ -87,7 +237,7 @@ func main() {
 	}
 	defer l.Close()
 
-	grpcServer, err := grpchelper.NewServer(conf.LocalAddr, tlsConfig, nil, logger)
+	grpcServer, err := grpchelper.NewServer(conf.LocalAddr, tlsConfig, nil, logger, grpc.ChainUnaryInterceptor(srv.UnaryServerInterceptor()))
 	if err != nil {
 		logger.Fatal().Err(err).Msg("cannot create server")
 	}
@@ -98,6 +248,40 @@ func main() {
 	pb.RegisterMiniResolverServer(grpcServer, srv)
 
 	grpcServer.Startup()
+	if metricsRegistry != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+		metricsServer := &http.Server{
+			Addr:    conf.MetricsAddr,
+			Handler: mux,
+		}
+		go func() {
+			logger.Info().Msgf("starting metrics server at http://%s/metrics", conf.MetricsAddr)
+			if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error().Err(err).Msgf("metrics server on '%s' ended", conf.MetricsAddr)
+			}
+		}()
+		defer metricsServer.Close()
+	}
+	if conf.Admin.Addr != "" {
+		var adminTLSConfig *tls.Config
+		if conf.Admin.TLS != nil {
+			var adminLoader io.Closer
+			adminTLSConfig, adminLoader, err = loader.CreateServerLoader(true, conf.Admin.TLS, nil, logger)
+			if err != nil {
+				logger.Fatal().Err(err).Msg("cannot create admin server loader")
+			}
+			defer adminLoader.Close()
+		}
+		adminCtrl, err := rest.NewMainController(conf.Admin.Addr, conf.Admin.ExtAddr, adminTLSConfig, srv, logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("cannot create admin server")
+		}
+		var wg sync.WaitGroup
+		adminCtrl.Start(&wg)
+		defer wg.Wait()
+		defer adminCtrl.Stop()
+	}
 	if conf.ProxyAddr != "" {
 		if err := srv.StartProxy(); err != nil {
 			logger.Error().Err(err).Msg("cannot start proxy")
@@ -119,3 +303,20 @@ func main() {
 		}()
 	}
 }
+
+// healthCheckConfig overrides all values of base, which are set in conf
+func healthCheckConfig(base service.HealthCheckConfig, conf HealthCheckServiceConfig) service.HealthCheckConfig {
+	if conf.Protocol != "" {
+		base.Protocol = conf.Protocol
+	}
+	if conf.Interval != 0 {
+		base.Interval = time.Duration(conf.Interval)
+	}
+	if conf.Timeout != 0 {
+		base.Timeout = time.Duration(conf.Timeout)
+	}
+	if conf.FailureThreshold != 0 {
+		base.FailureThreshold = conf.FailureThreshold
+	}
+	return base
+}
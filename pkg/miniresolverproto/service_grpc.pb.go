@@ -13,7 +13,6 @@ import (
 	codes "google.golang.org/grpc/codes"
 	status "google.golang.org/grpc/status"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
-	wrapperspb "google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 // This is a compile-time assertion to ensure that this generated file
@@ -25,8 +24,14 @@ const (
 	MiniResolver_Ping_FullMethodName            = "/miniresolverproto.MiniResolver/Ping"
 	MiniResolver_AddService_FullMethodName      = "/miniresolverproto.MiniResolver/AddService"
 	MiniResolver_RemoveService_FullMethodName   = "/miniresolverproto.MiniResolver/RemoveService"
+	MiniResolver_DrainService_FullMethodName    = "/miniresolverproto.MiniResolver/DrainService"
 	MiniResolver_ResolveService_FullMethodName  = "/miniresolverproto.MiniResolver/ResolveService"
 	MiniResolver_ResolveServices_FullMethodName = "/miniresolverproto.MiniResolver/ResolveServices"
+	MiniResolver_WatchService_FullMethodName    = "/miniresolverproto.MiniResolver/WatchService"
+	MiniResolver_Replicate_FullMethodName       = "/miniresolverproto.MiniResolver/Replicate"
+	MiniResolver_ListServices_FullMethodName    = "/miniresolverproto.MiniResolver/ListServices"
+	MiniResolver_KeepAlive_FullMethodName       = "/miniresolverproto.MiniResolver/KeepAlive"
+	MiniResolver_GetEvents_FullMethodName       = "/miniresolverproto.MiniResolver/GetEvents"
 )
 
 // MiniResolverClient is the client API for MiniResolver service.
@@ -36,8 +41,15 @@ type MiniResolverClient interface {
 	Ping(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*proto.DefaultResponse, error)
 	AddService(ctx context.Context, in *ServiceData, opts ...grpc.CallOption) (*ResolverDefaultResponse, error)
 	RemoveService(ctx context.Context, in *ServiceData, opts ...grpc.CallOption) (*proto.DefaultResponse, error)
-	ResolveService(ctx context.Context, in *wrapperspb.StringValue, opts ...grpc.CallOption) (*ServiceResponse, error)
-	ResolveServices(ctx context.Context, in *wrapperspb.StringValue, opts ...grpc.CallOption) (*ServicesResponse, error)
+	// withdraws the instance from resolution until it is removed
+	DrainService(ctx context.Context, in *ServiceData, opts ...grpc.CallOption) (*proto.DefaultResponse, error)
+	ResolveService(ctx context.Context, in *ServiceQuery, opts ...grpc.CallOption) (*ServiceResponse, error)
+	ResolveServices(ctx context.Context, in *ServiceQuery, opts ...grpc.CallOption) (*ServicesResponse, error)
+	WatchService(ctx context.Context, in *ServiceQuery, opts ...grpc.CallOption) (MiniResolver_WatchServiceClient, error)
+	Replicate(ctx context.Context, in *ReplicationBatch, opts ...grpc.CallOption) (*proto.DefaultResponse, error)
+	ListServices(ctx context.Context, in *ListServicesRequest, opts ...grpc.CallOption) (*ListServicesResponse, error)
+	KeepAlive(ctx context.Context, opts ...grpc.CallOption) (MiniResolver_KeepAliveClient, error)
+	GetEvents(ctx context.Context, in *GetEventsRequest, opts ...grpc.CallOption) (*GetEventsResponse, error)
 }
 
 type miniResolverClient struct {
@@ -75,7 +87,16 @@ func (c *miniResolverClient) RemoveService(ctx context.Context, in *ServiceData,
 	return out, nil
 }
 
-func (c *miniResolverClient) ResolveService(ctx context.Context, in *wrapperspb.StringValue, opts ...grpc.CallOption) (*ServiceResponse, error) {
+func (c *miniResolverClient) DrainService(ctx context.Context, in *ServiceData, opts ...grpc.CallOption) (*proto.DefaultResponse, error) {
+	out := new(proto.DefaultResponse)
+	err := c.cc.Invoke(ctx, MiniResolver_DrainService_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *miniResolverClient) ResolveService(ctx context.Context, in *ServiceQuery, opts ...grpc.CallOption) (*ServiceResponse, error) {
 	out := new(ServiceResponse)
 	err := c.cc.Invoke(ctx, MiniResolver_ResolveService_FullMethodName, in, out, opts...)
 	if err != nil {
@@ -84,7 +105,7 @@ func (c *miniResolverClient) ResolveService(ctx context.Context, in *wrapperspb.
 	return out, nil
 }
 
-func (c *miniResolverClient) ResolveServices(ctx context.Context, in *wrapperspb.StringValue, opts ...grpc.CallOption) (*ServicesResponse, error) {
+func (c *miniResolverClient) ResolveServices(ctx context.Context, in *ServiceQuery, opts ...grpc.CallOption) (*ServicesResponse, error) {
 	out := new(ServicesResponse)
 	err := c.cc.Invoke(ctx, MiniResolver_ResolveServices_FullMethodName, in, out, opts...)
 	if err != nil {
@@ -93,6 +114,96 @@ func (c *miniResolverClient) ResolveServices(ctx context.Context, in *wrapperspb
 	return out, nil
 }
 
+func (c *miniResolverClient) WatchService(ctx context.Context, in *ServiceQuery, opts ...grpc.CallOption) (MiniResolver_WatchServiceClient, error) {
+	stream, err := c.cc.NewStream(ctx, &MiniResolver_ServiceDesc.Streams[0], MiniResolver_WatchService_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &miniResolverWatchServiceClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type MiniResolver_WatchServiceClient interface {
+	Recv() (*ServicesResponse, error)
+	grpc.ClientStream
+}
+
+type miniResolverWatchServiceClient struct {
+	grpc.ClientStream
+}
+
+func (x *miniResolverWatchServiceClient) Recv() (*ServicesResponse, error) {
+	m := new(ServicesResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *miniResolverClient) Replicate(ctx context.Context, in *ReplicationBatch, opts ...grpc.CallOption) (*proto.DefaultResponse, error) {
+	out := new(proto.DefaultResponse)
+	err := c.cc.Invoke(ctx, MiniResolver_Replicate_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *miniResolverClient) ListServices(ctx context.Context, in *ListServicesRequest, opts ...grpc.CallOption) (*ListServicesResponse, error) {
+	out := new(ListServicesResponse)
+	err := c.cc.Invoke(ctx, MiniResolver_ListServices_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *miniResolverClient) KeepAlive(ctx context.Context, opts ...grpc.CallOption) (MiniResolver_KeepAliveClient, error) {
+	stream, err := c.cc.NewStream(ctx, &MiniResolver_ServiceDesc.Streams[1], MiniResolver_KeepAlive_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &miniResolverKeepAliveClient{stream}
+	return x, nil
+}
+
+type MiniResolver_KeepAliveClient interface {
+	Send(*KeepAliveRequest) error
+	Recv() (*KeepAliveResponse, error)
+	grpc.ClientStream
+}
+
+type miniResolverKeepAliveClient struct {
+	grpc.ClientStream
+}
+
+func (x *miniResolverKeepAliveClient) Send(m *KeepAliveRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *miniResolverKeepAliveClient) Recv() (*KeepAliveResponse, error) {
+	m := new(KeepAliveResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *miniResolverClient) GetEvents(ctx context.Context, in *GetEventsRequest, opts ...grpc.CallOption) (*GetEventsResponse, error) {
+	out := new(GetEventsResponse)
+	err := c.cc.Invoke(ctx, MiniResolver_GetEvents_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // MiniResolverServer is the server API for MiniResolver service.
 // All implementations must embed UnimplementedMiniResolverServer
 // for forward compatibility
@@ -100,8 +211,15 @@ type MiniResolverServer interface {
 	Ping(context.Context, *emptypb.Empty) (*proto.DefaultResponse, error)
 	AddService(context.Context, *ServiceData) (*ResolverDefaultResponse, error)
 	RemoveService(context.Context, *ServiceData) (*proto.DefaultResponse, error)
-	ResolveService(context.Context, *wrapperspb.StringValue) (*ServiceResponse, error)
-	ResolveServices(context.Context, *wrapperspb.StringValue) (*ServicesResponse, error)
+	// withdraws the instance from resolution until it is removed
+	DrainService(context.Context, *ServiceData) (*proto.DefaultResponse, error)
+	ResolveService(context.Context, *ServiceQuery) (*ServiceResponse, error)
+	ResolveServices(context.Context, *ServiceQuery) (*ServicesResponse, error)
+	WatchService(*ServiceQuery, MiniResolver_WatchServiceServer) error
+	Replicate(context.Context, *ReplicationBatch) (*proto.DefaultResponse, error)
+	ListServices(context.Context, *ListServicesRequest) (*ListServicesResponse, error)
+	KeepAlive(MiniResolver_KeepAliveServer) error
+	GetEvents(context.Context, *GetEventsRequest) (*GetEventsResponse, error)
 	mustEmbedUnimplementedMiniResolverServer()
 }
 
@@ -118,12 +236,30 @@ func (UnimplementedMiniResolverServer) AddService(context.Context, *ServiceData)
 func (UnimplementedMiniResolverServer) RemoveService(context.Context, *ServiceData) (*proto.DefaultResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method RemoveService not implemented")
 }
-func (UnimplementedMiniResolverServer) ResolveService(context.Context, *wrapperspb.StringValue) (*ServiceResponse, error) {
+func (UnimplementedMiniResolverServer) DrainService(context.Context, *ServiceData) (*proto.DefaultResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DrainService not implemented")
+}
+func (UnimplementedMiniResolverServer) ResolveService(context.Context, *ServiceQuery) (*ServiceResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ResolveService not implemented")
 }
-func (UnimplementedMiniResolverServer) ResolveServices(context.Context, *wrapperspb.StringValue) (*ServicesResponse, error) {
+func (UnimplementedMiniResolverServer) ResolveServices(context.Context, *ServiceQuery) (*ServicesResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ResolveServices not implemented")
 }
+func (UnimplementedMiniResolverServer) WatchService(*ServiceQuery, MiniResolver_WatchServiceServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchService not implemented")
+}
+func (UnimplementedMiniResolverServer) Replicate(context.Context, *ReplicationBatch) (*proto.DefaultResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Replicate not implemented")
+}
+func (UnimplementedMiniResolverServer) ListServices(context.Context, *ListServicesRequest) (*ListServicesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListServices not implemented")
+}
+func (UnimplementedMiniResolverServer) KeepAlive(MiniResolver_KeepAliveServer) error {
+	return status.Errorf(codes.Unimplemented, "method KeepAlive not implemented")
+}
+func (UnimplementedMiniResolverServer) GetEvents(context.Context, *GetEventsRequest) (*GetEventsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetEvents not implemented")
+}
 func (UnimplementedMiniResolverServer) mustEmbedUnimplementedMiniResolverServer() {}
 
 // UnsafeMiniResolverServer may be embedded to opt out of forward compatibility for this service.
@@ -191,8 +327,26 @@ func _MiniResolver_RemoveService_Handler(srv interface{}, ctx context.Context, d
 	return interceptor(ctx, in, info, handler)
 }
 
+func _MiniResolver_DrainService_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ServiceData)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MiniResolverServer).DrainService(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MiniResolver_DrainService_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MiniResolverServer).DrainService(ctx, req.(*ServiceData))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _MiniResolver_ResolveService_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(wrapperspb.StringValue)
+	in := new(ServiceQuery)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
@@ -204,13 +358,13 @@ func _MiniResolver_ResolveService_Handler(srv interface{}, ctx context.Context,
 		FullMethod: MiniResolver_ResolveService_FullMethodName,
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(MiniResolverServer).ResolveService(ctx, req.(*wrapperspb.StringValue))
+		return srv.(MiniResolverServer).ResolveService(ctx, req.(*ServiceQuery))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
 func _MiniResolver_ResolveServices_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(wrapperspb.StringValue)
+	in := new(ServiceQuery)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
@@ -222,7 +376,108 @@ func _MiniResolver_ResolveServices_Handler(srv interface{}, ctx context.Context,
 		FullMethod: MiniResolver_ResolveServices_FullMethodName,
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(MiniResolverServer).ResolveServices(ctx, req.(*wrapperspb.StringValue))
+		return srv.(MiniResolverServer).ResolveServices(ctx, req.(*ServiceQuery))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MiniResolver_WatchService_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ServiceQuery)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MiniResolverServer).WatchService(m, &miniResolverWatchServiceServer{stream})
+}
+
+type MiniResolver_WatchServiceServer interface {
+	Send(*ServicesResponse) error
+	grpc.ServerStream
+}
+
+type miniResolverWatchServiceServer struct {
+	grpc.ServerStream
+}
+
+func (x *miniResolverWatchServiceServer) Send(m *ServicesResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _MiniResolver_Replicate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReplicationBatch)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MiniResolverServer).Replicate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MiniResolver_Replicate_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MiniResolverServer).Replicate(ctx, req.(*ReplicationBatch))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MiniResolver_ListServices_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListServicesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MiniResolverServer).ListServices(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MiniResolver_ListServices_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MiniResolverServer).ListServices(ctx, req.(*ListServicesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MiniResolver_KeepAlive_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(MiniResolverServer).KeepAlive(&miniResolverKeepAliveServer{stream})
+}
+
+type MiniResolver_KeepAliveServer interface {
+	Send(*KeepAliveResponse) error
+	Recv() (*KeepAliveRequest, error)
+	grpc.ServerStream
+}
+
+type miniResolverKeepAliveServer struct {
+	grpc.ServerStream
+}
+
+func (x *miniResolverKeepAliveServer) Send(m *KeepAliveResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *miniResolverKeepAliveServer) Recv() (*KeepAliveRequest, error) {
+	m := new(KeepAliveRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _MiniResolver_GetEvents_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetEventsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MiniResolverServer).GetEvents(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MiniResolver_GetEvents_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MiniResolverServer).GetEvents(ctx, req.(*GetEventsRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
@@ -246,6 +501,10 @@ var MiniResolver_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "RemoveService",
 			Handler:    _MiniResolver_RemoveService_Handler,
 		},
+		{
+			MethodName: "DrainService",
+			Handler:    _MiniResolver_DrainService_Handler,
+		},
 		{
 			MethodName: "ResolveService",
 			Handler:    _MiniResolver_ResolveService_Handler,
@@ -254,7 +513,31 @@ var MiniResolver_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "ResolveServices",
 			Handler:    _MiniResolver_ResolveServices_Handler,
 		},
+		{
+			MethodName: "Replicate",
+			Handler:    _MiniResolver_Replicate_Handler,
+		},
+		{
+			MethodName: "ListServices",
+			Handler:    _MiniResolver_ListServices_Handler,
+		},
+		{
+			MethodName: "GetEvents",
+			Handler:    _MiniResolver_GetEvents_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchService",
+			Handler:       _MiniResolver_WatchService_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "KeepAlive",
+			Handler:       _MiniResolver_KeepAlive_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "service.proto",
 }
@@ -0,0 +1,152 @@
+package miniresolvertest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"emperror.dev/errors"
+	"math/big"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// certValidity is the lifetime of all ephemeral certificates
+const certValidity = 24 * time.Hour
+
+// newCA creates an ephemeral certificate authority, which issues the certificates of all
+// servers and clients of a test resolver
+func newCA() (*certAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot generate ca key")
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "miniresolvertest ca"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(certValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create ca certificate")
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse ca certificate")
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &certAuthority{
+		cert:   cert,
+		key:    key,
+		pool:   pool,
+		serial: 1,
+		server: map[string]*tls.Certificate{},
+	}, nil
+}
+
+type certAuthority struct {
+	sync.Mutex
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	pool   *x509.CertPool
+	serial int64
+	server map[string]*tls.Certificate // server certificates by server name
+}
+
+// issue creates a certificate for the dns names or ip addresses in hosts and the uris
+func (ca *certAuthority) issue(commonName string, hosts []string, uris []string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot generate key")
+	}
+	ca.Lock()
+	ca.serial++
+	serial := ca.serial
+	ca.Unlock()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid uri '%s'", uri)
+		}
+		template.URIs = append(template.URIs, u)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot create certificate for '%s'", commonName)
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
+
+// getServerCertificate issues a certificate for the requested server name. clients of
+// miniresolver targets use the service name as server name, connections to an ip address send none
+func (ca *certAuthority) getServerCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := hello.ServerName
+	ca.Lock()
+	cert, ok := ca.server[name]
+	ca.Unlock()
+	if ok {
+		return cert, nil
+	}
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if name != "" {
+		hosts = append(hosts, name)
+	}
+	cert, err := ca.issue(name, hosts, []string{"*"})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	ca.Lock()
+	ca.server[name] = cert
+	ca.Unlock()
+	return cert, nil
+}
+
+// serverTLSConfig requires client certificates of the ca
+func (ca *certAuthority) serverTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: ca.getServerCertificate,
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+		ClientCAs:      ca.pool,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// clientTLSConfig uses a client certificate with the uris
+func (ca *certAuthority) clientTLSConfig(uris ...string) (*tls.Config, error) {
+	cert, err := ca.issue("miniresolvertest client", nil, uris)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		RootCAs:      ca.pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
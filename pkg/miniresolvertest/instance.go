@@ -0,0 +1,233 @@
+package miniresolvertest
+
+import (
+	"context"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type InstanceOption func(*pb.ServiceData)
+
+func WithVersion(version string) InstanceOption {
+	return func(data *pb.ServiceData) {
+		data.Version = version
+	}
+}
+
+func WithZone(zone string) InstanceOption {
+	return func(data *pb.ServiceData) {
+		data.Zone = zone
+	}
+}
+
+func WithTags(tags ...string) InstanceOption {
+	return func(data *pb.ServiceData) {
+		data.Tags = append(data.Tags, tags...)
+	}
+}
+
+func WithMetadata(key, value string) InstanceOption {
+	return func(data *pb.ServiceData) {
+		if data.Metadata == nil {
+			data.Metadata = map[string]string{}
+		}
+		data.Metadata[key] = value
+	}
+}
+
+func WithWeight(weight uint32) InstanceOption {
+	return func(data *pb.ServiceData) {
+		data.Weight = weight
+	}
+}
+
+func WithPriority(priority uint32) InstanceOption {
+	return func(data *pb.ServiceData) {
+		data.Priority = priority
+	}
+}
+
+// WithSingle replaces all other instances of the service
+func WithSingle() InstanceOption {
+	return func(data *pb.ServiceData) {
+		data.Single = true
+	}
+}
+
+// Instance is a fake service instance registered with a lease, which is renewed until the instance is killed or stopped
+type Instance struct {
+	// Addr is the registered address
+	Addr string
+	// Server serves the services of the instance. nil for instances registered without server
+	Server        *grpc.Server
+	resolver      *Resolver
+	registrations []*pb.ServiceData
+	cancel        context.CancelFunc
+	done          chan struct{}
+	once          sync.Once
+}
+
+/*
+StartInstance starts a grpc server on loopback with the services added by register and registers
+all of them in domain (empty for services without domain). the server uses a certificate of the test ca
+and serves grpc.health.v1 like servers of resolver.MiniResolver.NewServer
+*/
+func (r *Resolver) StartInstance(domain string, register func(s grpc.ServiceRegistrar), opts ...InstanceOption) *Instance {
+	r.tb.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		r.tb.Fatalf("cannot listen on loopback: %v", err)
+	}
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(r.ca.serverTLSConfig())))
+	register(server)
+	healthServer := health.NewServer()
+	var services []string
+	for name := range server.GetServiceInfo() {
+		services = append(services, name)
+		healthServer.SetServingStatus(name, healthpb.HealthCheckResponse_SERVING)
+	}
+	healthpb.RegisterHealthServer(server, healthServer)
+	go server.Serve(lis)
+	instance := r.newInstance(lis.Addr().String(), services, domain, opts)
+	instance.Server = server
+	return instance
+}
+
+// RegisterInstance registers a fake instance of service at addr without server, i.e. to test unreachable instances
+func (r *Resolver) RegisterInstance(service, domain, addr string, opts ...InstanceOption) *Instance {
+	r.tb.Helper()
+	return r.newInstance(addr, []string{service}, domain, opts)
+}
+
+func (r *Resolver) newInstance(addr string, services []string, domain string, opts []InstanceOption) *Instance {
+	r.tb.Helper()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		r.tb.Fatalf("invalid address '%s': %v", addr, err)
+	}
+	portInt, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		r.tb.Fatalf("invalid port in '%s': %v", addr, err)
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		host = "[" + host + "]"
+	}
+	var domains []string
+	if domain != "" {
+		domains = []string{domain}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	instance := &Instance{
+		Addr:     addr,
+		resolver: r,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	var leaseID uint64
+	var ttl time.Duration
+	for _, service := range services {
+		data := &pb.ServiceData{
+			Service: service,
+			Host:    &host,
+			Port:    uint32(portInt),
+			Domains: domains,
+			Ttl:     max(int64(r.options.instanceTTL.Seconds()), 1),
+		}
+		for _, opt := range opts {
+			opt(data)
+		}
+		data.LeaseID = leaseID
+		resp, err := r.MiniResolverClient.AddService(ctx, data)
+		if err != nil {
+			cancel()
+			r.tb.Fatalf("cannot register '%v.%s' at %s: %v", domains, service, addr, err)
+		}
+		leaseID, ttl = resp.GetLeaseID(), time.Duration(resp.GetTtl())*time.Second
+		instance.registrations = append(instance.registrations, data)
+	}
+	go instance.keepAlive(ctx, leaseID, ttl)
+	r.instanceLock.Lock()
+	r.instances = append(r.instances, instance)
+	r.instanceLock.Unlock()
+	return instance
+}
+
+// keepAlive renews the lease every third of its ttl until ctx is done
+func (i *Instance) keepAlive(ctx context.Context, leaseID uint64, ttl time.Duration) {
+	defer close(i.done)
+	if ttl <= 0 {
+		return
+	}
+	stream, err := i.resolver.MiniResolverClient.KeepAlive(ctx)
+	if err != nil {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ttl / 3):
+		}
+		if err := stream.Send(&pb.KeepAliveRequest{LeaseID: leaseID}); err != nil {
+			return
+		}
+		resp, err := stream.Recv()
+		if err != nil || resp.GetTtl() <= 0 {
+			return
+		}
+	}
+}
+
+// end stops the lease renewal and the server
+func (i *Instance) end(graceful bool) {
+	i.once.Do(func() {
+		i.cancel()
+		<-i.done
+		if i.Server != nil {
+			if graceful {
+				i.Server.GracefulStop()
+			} else {
+				i.Server.Stop()
+			}
+		}
+		r := i.resolver
+		r.instanceLock.Lock()
+		r.instances = slices.DeleteFunc(r.instances, func(instance *Instance) bool { return instance == i })
+		r.instanceLock.Unlock()
+	})
+}
+
+// Kill simulates a crash. the server stops without unregistering, so the instance stays
+// registered until its lease expires (WithInstanceTTL)
+func (i *Instance) Kill() {
+	i.end(false)
+}
+
+// Stop unregisters all services of the instance and stops the server gracefully
+func (i *Instance) Stop() {
+	i.resolver.tb.Helper()
+	for _, data := range i.registrations {
+		if _, err := i.resolver.MiniResolverClient.RemoveService(context.Background(), data); err != nil {
+			i.resolver.tb.Errorf("cannot unregister '%v.%s' at %s: %v", data.GetDomains(), data.GetService(), i.Addr, err)
+		}
+	}
+	i.end(true)
+}
+
+// Drain withdraws all services of the instance from resolution, the instance keeps running
+func (i *Instance) Drain() {
+	i.resolver.tb.Helper()
+	for _, data := range i.registrations {
+		if _, err := i.resolver.MiniResolverClient.DrainService(context.Background(), data); err != nil {
+			i.resolver.tb.Errorf("cannot drain '%v.%s' at %s: %v", data.GetDomains(), data.GetService(), i.Addr, err)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// Package miniresolvertest starts an in-process miniresolver on loopback with an ephemeral
+// certificate authority, so services built on the resolver package can be tested without mr and minivault.
+package miniresolvertest
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"github.com/je4/miniresolver/v2/pkg/resolver"
+	"github.com/je4/miniresolver/v2/pkg/service"
+	"github.com/je4/trustutil/v2/pkg/grpchelper"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	// DefaultServiceExpiration is the service expiration of the test resolver
+	DefaultServiceExpiration = time.Minute
+	// DefaultInstanceTTL is the lease ttl of fake instances. a killed instance vanishes after this time
+	DefaultInstanceTTL = time.Second
+	// DefaultTimeout is the time the assertions wait for the expected resolution
+	DefaultTimeout = 5 * time.Second
+)
+
+type options struct {
+	logger            zLogger.ZLogger
+	serviceExpiration time.Duration
+	instanceTTL       time.Duration
+	timeout           time.Duration
+	serviceOpts       []service.Option
+}
+
+type Option func(*options)
+
+// WithLogger sets the logger of resolver and clients. the default discards all messages
+func WithLogger(logger zLogger.ZLogger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithServiceExpiration sets the expiration of registrations without lease
+func WithServiceExpiration(expiration time.Duration) Option {
+	return func(o *options) {
+		o.serviceExpiration = expiration
+	}
+}
+
+// WithInstanceTTL sets the lease ttl of fake instances
+func WithInstanceTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.instanceTTL = ttl
+	}
+}
+
+// WithTimeout sets the time the assertions wait for the expected resolution
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.timeout = timeout
+	}
+}
+
+// WithServiceOptions passes options (i.e. service.WithPolicy) to the resolver service
+func WithServiceOptions(opts ...service.Option) Option {
+	return func(o *options) {
+		o.serviceOpts = append(o.serviceOpts, opts...)
+	}
+}
+
+/*
+New starts a miniresolver on a loopback port and returns the test resolver with a connected
+client. everything is stopped on cleanup of tb.
+grpc resolvers are registered globally, so tests using different test resolvers must not run in parallel
+*/
+func New(tb testing.TB, opts ...Option) *Resolver {
+	tb.Helper()
+	nop := zerolog.Nop()
+	o := &options{
+		logger:            &nop,
+		serviceExpiration: DefaultServiceExpiration,
+		instanceTTL:       DefaultInstanceTTL,
+		timeout:           DefaultTimeout,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	ca, err := newCA()
+	if err != nil {
+		tb.Fatalf("cannot create ca: %v", err)
+	}
+	clientTLSConfig, err := ca.clientTLSConfig("*")
+	if err != nil {
+		tb.Fatalf("cannot create client certificate: %v", err)
+	}
+	r := &Resolver{
+		tb:      tb,
+		ca:      ca,
+		options: o,
+	}
+	serviceOpts := append([]service.Option{service.WithLeaseTTL(min(o.instanceTTL, service.DefaultMinLeaseTTL), o.serviceExpiration)}, o.serviceOpts...)
+	r.service = service.NewMiniResolver(0, o.serviceExpiration, "", o.logger, serviceOpts...)
+	r.server, err = grpchelper.NewServer("127.0.0.1:0", ca.serverTLSConfig(), nil, o.logger, grpc.ChainUnaryInterceptor(r.service.UnaryServerInterceptor()))
+	if err != nil {
+		r.service.Close()
+		tb.Fatalf("cannot create miniresolver server: %v", err)
+	}
+	miniresolverproto.RegisterMiniResolverServer(r.server, r.service)
+	r.server.Startup()
+	r.Addr = r.server.GetAddr()
+	r.MiniResolver, err = resolver.NewMiniresolverClient(r.Addr, nil, clientTLSConfig, ca.serverTLSConfig(), time.Second, time.Second, o.logger)
+	if err != nil {
+		r.server.Shutdown()
+		r.service.Close()
+		tb.Fatalf("cannot create miniresolver client: %v", err)
+	}
+	tb.Cleanup(r.Close)
+	return r
+}
+
+// Resolver is a running miniresolver for tests
+type Resolver struct {
+	// Addr is the address of the miniresolver
+	Addr string
+	// MiniResolver is connected to the test resolver. it creates clients and servers with certificates of the test ca
+	*resolver.MiniResolver
+	tb      testing.TB
+	ca      *certAuthority
+	options *options
+	service interface {
+		miniresolverproto.MiniResolverServer
+		UnaryServerInterceptor() grpc.UnaryServerInterceptor
+		Close()
+	}
+	server       *grpchelper.Server
+	instances    []*Instance
+	instanceLock sync.Mutex
+}
+
+// Close stops all instances, the client and the resolver
+func (r *Resolver) Close() {
+	r.instanceLock.Lock()
+	instances := slices.Clone(r.instances)
+	r.instanceLock.Unlock()
+	for _, instance := range instances {
+		instance.Kill()
+	}
+	if err := r.MiniResolver.Close(); err != nil {
+		r.tb.Logf("cannot close miniresolver client: %v", err)
+	}
+	r.server.Server.Stop()
+	r.service.Close()
+}
+
+// ClientTLSConfig returns a client configuration of the test ca with a certificate for the uris
+// (i.e. "grpc:ubbasel.mediaserverproto.Database") to test authorization
+func (r *Resolver) ClientTLSConfig(uris ...string) *tls.Config {
+	r.tb.Helper()
+	tlsConfig, err := r.ca.clientTLSConfig(uris...)
+	if err != nil {
+		r.tb.Fatalf("cannot create client certificate: %v", err)
+	}
+	return tlsConfig
+}
+
+// ServerTLSConfig returns a server configuration of the test ca, which requires client certificates
+func (r *Resolver) ServerTLSConfig() *tls.Config {
+	return r.ca.serverTLSConfig()
+}
+
+// Resolve returns the sorted addresses of all available instances of the qualified service name (domain.service)
+func (r *Resolver) Resolve(name string) []string {
+	r.tb.Helper()
+	resp, err := r.MiniResolverClient.ResolveServices(context.Background(), &miniresolverproto.ServiceQuery{Name: name})
+	if err != nil {
+		r.tb.Fatalf("cannot resolve '%s': %v", name, err)
+	}
+	addrs := slices.Clone(resp.GetAddrs())
+	slices.Sort(addrs)
+	return addrs
+}
+
+// AssertResolves waits until the qualified service name resolves to exactly addrs (in any order).
+// without addrs it waits until the service is not available anymore
+func (r *Resolver) AssertResolves(name string, addrs ...string) bool {
+	r.tb.Helper()
+	want := slices.Clone(addrs)
+	slices.Sort(want)
+	deadline := time.Now().Add(r.options.timeout)
+	for {
+		got := r.Resolve(name)
+		if slices.Equal(got, want) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			r.tb.Errorf("'%s' resolves to %v after %v, want %v", name, got, r.options.timeout, want)
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// AssertNotResolves waits until the qualified service name has no available instances
+func (r *Resolver) AssertNotResolves(name string) bool {
+	r.tb.Helper()
+	return r.AssertResolves(name)
+}
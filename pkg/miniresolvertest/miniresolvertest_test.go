@@ -0,0 +1,123 @@
+package miniresolvertest
+
+import (
+	"context"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"github.com/je4/miniresolver/v2/pkg/resolver"
+	"github.com/je4/miniresolver/v2/pkg/selector"
+	"google.golang.org/grpc"
+	"slices"
+	"testing"
+	"time"
+)
+
+const testService = "miniresolverproto.MiniResolver"
+
+// echoServer answers ResolveService with the address of the instance
+type echoServer struct {
+	pb.UnimplementedMiniResolverServer
+	addr string
+}
+
+func (s *echoServer) ResolveService(context.Context, *pb.ServiceQuery) (*pb.ServiceResponse, error) {
+	return &pb.ServiceResponse{Addr: s.addr}, nil
+}
+
+func startEcho(r *Resolver, domain string, opts ...InstanceOption) *Instance {
+	srv := &echoServer{}
+	instance := r.StartInstance(domain, func(s grpc.ServiceRegistrar) { pb.RegisterMiniResolverServer(s, srv) }, opts...)
+	srv.addr = instance.Addr
+	return instance
+}
+
+func TestInstanceLifecycle(t *testing.T) {
+	r := New(t, WithInstanceTTL(time.Second))
+	name := "test." + testService
+	first := startEcho(r, "test")
+	second := startEcho(r, "test")
+	r.AssertResolves(name, first.Addr, second.Addr)
+
+	client, err := resolver.NewClient(r.MiniResolver, pb.NewMiniResolverClient, testService, "test")
+	if err != nil {
+		t.Fatalf("cannot create client: %v", err)
+	}
+	resp, err := client.ResolveService(context.Background(), &pb.ServiceQuery{})
+	if err != nil {
+		t.Fatalf("cannot call instance: %v", err)
+	}
+	if resp.GetAddr() != first.Addr && resp.GetAddr() != second.Addr {
+		t.Errorf("answer of %s, want one of the instances", resp.GetAddr())
+	}
+
+	first.Drain()
+	r.AssertResolves(name, second.Addr)
+	second.Kill()
+	r.AssertNotResolves(name)
+	first.Stop()
+}
+
+func TestRegisterInstance(t *testing.T) {
+	r := New(t)
+	tests := []struct {
+		name      string
+		domain    string
+		opts      []InstanceOption
+		selectors []string
+		want      []string
+	}{
+		{
+			name: "without domain",
+			want: []string{"127.0.0.1:1"},
+		},
+		{
+			name:   "labels",
+			domain: "dom",
+			opts:   []InstanceOption{WithVersion("2.1"), WithZone("bs1"), WithTags("canary"), WithMetadata("owner", "ub"), WithWeight(3), WithPriority(1)},
+			want:   []string{"127.0.0.1:1"},
+		},
+		{
+			name:      "selected",
+			domain:    "dom",
+			opts:      []InstanceOption{WithZone("bs1")},
+			selectors: []string{"zone=bs2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := r.RegisterInstance("svc", tt.domain, "127.0.0.1:1", tt.opts...)
+			name := "svc"
+			if tt.domain != "" {
+				name = tt.domain + ".svc"
+			}
+			query := &pb.ServiceQuery{Name: name}
+			for _, expr := range tt.selectors {
+				sel, err := selector.Parse(expr)
+				if err != nil {
+					t.Fatalf("cannot parse '%s': %v", expr, err)
+				}
+				query.Selectors = append(query.Selectors, sel)
+			}
+			resp, err := r.MiniResolverClient.ResolveServices(context.Background(), query)
+			if err != nil {
+				t.Fatalf("cannot resolve: %v", err)
+			}
+			if got := resp.GetAddrs(); !slices.Equal(got, tt.want) {
+				t.Errorf("resolves to %v, want %v", got, tt.want)
+			}
+			for _, got := range resp.GetInstances() {
+				want := &pb.ServiceData{}
+				for _, opt := range tt.opts {
+					opt(want)
+				}
+				if got.GetVersion() != want.GetVersion() || got.GetZone() != want.GetZone() || got.GetWeight() != want.GetWeight() || got.GetPriority() != want.GetPriority() ||
+					!slices.Equal(got.GetTags(), want.GetTags()) || got.GetMetadata()["owner"] != want.GetMetadata()["owner"] {
+					t.Errorf("instance %v, want labels of %v", got, want)
+				}
+			}
+			instance.Stop()
+			if got := r.Resolve(name); len(got) != 0 {
+				t.Errorf("stopped instance resolves to %v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package resolver
+
+import (
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"golang.org/x/exp/maps"
+	"google.golang.org/grpc/resolver"
+	"slices"
+)
+
+type instanceKey struct{}
+
+// Instance is the metadata of a service instance, attached to resolver.Address.Attributes
+type Instance struct {
+	Version  string
+	Zone     string
+	Tags     []string
+	Metadata map[string]string
+	Weight   uint32
+	Priority uint32
+}
+
+// Equal is needed by grpc to compare address attributes
+func (i *Instance) Equal(o any) bool {
+	oi, ok := o.(*Instance)
+	if !ok {
+		return false
+	}
+	if i == nil || oi == nil {
+		return i == oi
+	}
+	return i.Version == oi.Version &&
+		i.Zone == oi.Zone &&
+		slices.Equal(i.Tags, oi.Tags) &&
+		maps.Equal(i.Metadata, oi.Metadata) &&
+		i.Weight == oi.Weight &&
+		i.Priority == oi.Priority
+}
+
+// GetInstance returns the instance metadata of a resolved address or nil
+func GetInstance(addr resolver.Address) *Instance {
+	instance, _ := addr.Attributes.Value(instanceKey{}).(*Instance)
+	return instance
+}
+
+func newAddress(instance *pb.ServiceInstance) resolver.Address {
+	addr := resolver.Address{Addr: instance.GetAddr()}
+	addr.Attributes = addr.Attributes.WithValue(instanceKey{}, &Instance{
+		Version:  instance.GetVersion(),
+		Zone:     instance.GetZone(),
+		Tags:     instance.GetTags(),
+		Metadata: instance.GetMetadata(),
+		Weight:   instance.GetWeight(),
+		Priority: instance.GetPriority(),
+	})
+	return addr
+}
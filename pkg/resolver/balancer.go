@@ -0,0 +1,65 @@
+package resolver
+
+import (
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// weightedRoundRobinName is the balancer, which distributes the calls by the registered weights of the instances.
+// grpc's weighted_round_robin uses the load reports (ORCA) of the servers instead
+const weightedRoundRobinName = "miniresolver_weighted_round_robin"
+
+func init() {
+	balancer.Register(base.NewBalancerBuilder(weightedRoundRobinName, &weightedPickerBuilder{}, base.Config{HealthCheck: true}))
+}
+
+type weightedPickerBuilder struct{}
+
+func (*weightedPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	p := &weightedPicker{}
+	for sc, scInfo := range info.ReadySCs {
+		weight := int64(1)
+		if instance := GetInstance(scInfo.Address); instance != nil && instance.Weight > 0 {
+			weight = int64(instance.Weight)
+		}
+		p.subConns = append(p.subConns, &weightedSubConn{subConn: sc, addr: scInfo.Address.Addr, weight: weight})
+		p.total += weight
+	}
+	// same order for every picker, so the sequence of picks does not depend on map iteration
+	slices.SortFunc(p.subConns, func(a, b *weightedSubConn) int { return strings.Compare(a.addr, b.addr) })
+	return p
+}
+
+type weightedSubConn struct {
+	subConn balancer.SubConn
+	addr    string
+	weight  int64
+	current int64
+}
+
+// weightedPicker selects the subconns by smooth weighted round-robin like the miniresolver server
+type weightedPicker struct {
+	sync.Mutex
+	subConns []*weightedSubConn
+	total    int64
+}
+
+func (p *weightedPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	p.Lock()
+	defer p.Unlock()
+	var best *weightedSubConn
+	for _, sc := range p.subConns {
+		sc.current += sc.weight
+		if best == nil || sc.current > best.current {
+			best = sc
+		}
+	}
+	best.current -= p.total
+	return balancer.PickResult{SubConn: best.subConn}, nil
+}
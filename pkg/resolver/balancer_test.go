@@ -0,0 +1,69 @@
+package resolver
+
+import (
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"maps"
+	"testing"
+)
+
+type fakeSubConn struct {
+	balancer.SubConn
+	addr string
+}
+
+func TestWeightedPicker(t *testing.T) {
+	tests := []struct {
+		name      string
+		instances []*pb.ServiceInstance
+		picks     int
+		want      map[string]int
+	}{
+		{
+			name:      "weights",
+			instances: []*pb.ServiceInstance{{Addr: "a:1", Weight: 5}, {Addr: "b:2", Weight: 1}, {Addr: "c:3", Weight: 2}},
+			picks:     80,
+			want:      map[string]int{"a:1": 50, "b:2": 10, "c:3": 20},
+		},
+		{
+			name:      "no weight counts as 1",
+			instances: []*pb.ServiceInstance{{Addr: "a:1"}, {Addr: "b:2", Weight: 3}},
+			picks:     8,
+			want:      map[string]int{"a:1": 2, "b:2": 6},
+		},
+		{
+			name:      "single instance",
+			instances: []*pb.ServiceInstance{{Addr: "a:1", Weight: 7}},
+			picks:     3,
+			want:      map[string]int{"a:1": 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := base.PickerBuildInfo{ReadySCs: map[balancer.SubConn]base.SubConnInfo{}}
+			for _, instance := range tt.instances {
+				info.ReadySCs[&fakeSubConn{addr: instance.GetAddr()}] = base.SubConnInfo{Address: newAddress(instance)}
+			}
+			picker := (&weightedPickerBuilder{}).Build(info)
+			got := map[string]int{}
+			for i := 0; i < tt.picks; i++ {
+				result, err := picker.Pick(balancer.PickInfo{})
+				if err != nil {
+					t.Fatalf("pick: %v", err)
+				}
+				got[result.SubConn.(*fakeSubConn).addr]++
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("picks %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWeightedPickerNoSubConn(t *testing.T) {
+	picker := (&weightedPickerBuilder{}).Build(base.PickerBuildInfo{})
+	if _, err := picker.Pick(balancer.PickInfo{}); err != balancer.ErrNoSubConnAvailable {
+		t.Errorf("error %v, want %v", err, balancer.ErrNoSubConnAvailable)
+	}
+}
@@ -5,9 +5,12 @@ import (
 	"emperror.dev/errors"
 	"fmt"
 	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"github.com/je4/miniresolver/v2/pkg/selector"
 	"github.com/je4/utils/v2/pkg/zLogger"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/resolver"
-	"google.golang.org/protobuf/types/known/wrapperspb"
+	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
 	"time"
 )
 
@@ -36,31 +39,45 @@ type miniResolverResolverBuilder struct {
 }
 
 func (mrrb *miniResolverResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	// selectors are given as query of the target (i.e. "miniresolver:service?zone=bs1")
+	selectors, err := selector.ParseQuery(target.URL.RawQuery)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid selectors in target %s", target.URL.String())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	tstr := target.URL.String()
 	r := &miniResolverResolver{
 		target:             target,
+		cacheKey:           tstr,
+		resolutions:        mrrb.miniResolverclient.resolutions,
+		clientMap:          mrrb.miniResolverclient.lookupClientMap,
+		query:              &pb.ServiceQuery{Name: target.Endpoint(), Selectors: selectors},
 		cc:                 cc,
-		miniResolverclient: mrrb.miniResolverclient,
+		miniResolverclient: mrrb.miniResolverclient.MiniResolverClient,
 		logger:             mrrb.logger,
-		done:               make(chan bool),
+		ctx:                ctx,
+		cancel:             cancel,
+		refreshTarget:      make(chan bool),
 		checkTimeout:       mrrb.checkTimeout,
 		notFoundTimeout:    mrrb.notFoundTimeout,
 	}
 
+	serviceConfig := fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, mrrb.miniResolverclient.getLoadBalancingPolicy(tstr))
+	r.serviceConfig = cc.ParseServiceConfig(serviceConfig)
+	if r.serviceConfig.Err != nil {
+		cancel()
+		return nil, errors.Wrapf(r.serviceConfig.Err, "cannot parse service config '%s'", serviceConfig)
+	}
+	mrrb.miniResolverclient.WatchService(tstr, r.refreshTarget)
 	go func() {
-		refreshTarget := make(chan bool)
-		defer close(refreshTarget)
-		tstr := fmt.Sprintf("%s:%s", target.URL.Scheme, target.Endpoint())
-		mrrb.miniResolverclient.WatchService(tstr, refreshTarget)
 		defer mrrb.miniResolverclient.UnwatchService(tstr)
-		for {
-			timeout := r.doIt()
-			select {
-			case <-refreshTarget:
-				mrrb.logger.Debug().Msgf("refresh target %s", target.Endpoint())
-			case <-r.done:
-				return
-			case <-time.After(timeout):
-			}
+		if r.miniResolverclient == nil {
+			r.clientMapOnly()
+			return
+		}
+		if err := r.watch(); err != nil {
+			r.logger.Info().Err(err).Msgf("cannot watch %s, falling back to polling", target.Endpoint())
+			r.poll()
 		}
 	}()
 	return r, nil
@@ -71,47 +88,220 @@ func (*miniResolverResolverBuilder) Scheme() string { return RESOLVERSCHEMA }
 // Resolver(https://godoc.org/google.golang.org/grpc/resolver#Resolver).
 type miniResolverResolver struct {
 	target             resolver.Target
+	cacheKey           string
+	resolutions        *resolutionCache
+	clientMap          func(serviceName string) (string, bool, bool)
+	query              *pb.ServiceQuery
 	cc                 resolver.ClientConn
 	miniResolverclient pb.MiniResolverClient
 	logger             zLogger.ZLogger
-	done               chan bool
+	ctx                context.Context
+	cancel             context.CancelFunc
+	refreshTarget      chan bool
+	serviceConfig      *serviceconfig.ParseResult
 	checkTimeout       time.Duration
 	notFoundTimeout    time.Duration
 }
 
+// watch receives address updates from the WatchService stream until the resolver is closed.
+// it returns an error only if the miniresolver server does not support WatchService
+func (r *miniResolverResolver) watch() error {
+	addr := r.target.Endpoint()
+	for {
+		if r.usePinned() {
+			select {
+			case <-r.refreshTarget:
+				r.logger.Debug().Msgf("refresh target %s", addr)
+				continue
+			case <-r.ctx.Done():
+				return nil
+			}
+		}
+		err := r.watchStream()
+		if r.ctx.Err() != nil {
+			return nil
+		}
+		if status.Code(err) == codes.Unimplemented {
+			return err
+		}
+		if err != nil {
+			r.logger.Error().Err(err).Msgf("cannot watch %s", addr)
+			r.reportError(errors.Wrapf(err, "cannot watch %s", addr))
+			select {
+			case <-r.refreshTarget:
+				r.logger.Debug().Msgf("refresh target %s", addr)
+			case <-r.ctx.Done():
+				return nil
+			case <-time.After(10 * time.Second):
+			}
+		}
+	}
+}
+
+// watchStream handles a single WatchService stream.
+// a refresh of the target restarts the stream, which delivers the current address set again
+func (r *miniResolverResolver) watchStream() error {
+	addr := r.target.Endpoint()
+	ctx, cancel := context.WithCancel(r.ctx)
+	defer cancel()
+	stream, err := r.miniResolverclient.WatchService(ctx, r.query)
+	if err != nil {
+		return errors.Wrapf(err, "cannot start watching %s", addr)
+	}
+	go func() {
+		select {
+		case <-r.refreshTarget:
+			r.logger.Debug().Msgf("refresh target %s", addr)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	var received bool
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			// the addresses were valid until the stream broke.
+			// a stream without response does not confirm them, otherwise maxStaleness would never apply
+			if received {
+				r.resolutions.touch(r.cacheKey)
+			}
+			return errors.Wrapf(err, "cannot receive addresses of %s", addr)
+		}
+		received = true
+		r.logger.Debug().Msgf("watch %s: %v", addr, resp.GetAddrs())
+		r.updateState(resp)
+	}
+}
+
+// updateState hands all addresses to the load balancer of the client connection
+func (r *miniResolverResolver) updateState(resp *pb.ServicesResponse) bool {
+	target := r.target.Endpoint()
+	instances := resp.GetInstances()
+	if len(instances) == 0 {
+		// server without instance metadata
+		for _, a := range resp.GetAddrs() {
+			instances = append(instances, &pb.ServiceInstance{Addr: a})
+		}
+	}
+	r.resolutions.put(r.cacheKey, instances)
+	if len(instances) == 0 {
+		r.logger.Debug().Msgf("no service found for %s", target)
+		r.cc.ReportError(errors.Errorf("service %s not found", target))
+		return false
+	}
+	return r.setInstances(instances)
+}
+
+// usePinned hands the address of the client map to the load balancer, if the service is mapped
+func (r *miniResolverResolver) usePinned() bool {
+	addr, ok, _ := r.clientMap(r.target.Endpoint())
+	if !ok {
+		return false
+	}
+	r.logger.Debug().Msgf("%s pinned to '%s' by client map", r.target.Endpoint(), addr)
+	r.setInstances([]*pb.ServiceInstance{{Addr: addr}})
+	return true
+}
+
+// clientMapOnly resolves the target by the client map only, since there is no miniresolver server
+func (r *miniResolverResolver) clientMapOnly() {
+	for {
+		if !r.usePinned() {
+			r.cc.ReportError(errors.Errorf("service %s not in client map", r.target.Endpoint()))
+		}
+		select {
+		case <-r.refreshTarget:
+			r.logger.Debug().Msgf("refresh target %s", r.target.Endpoint())
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// reportError uses the cached addresses of the target, if they are not too old.
+// otherwise the error is reported to the client connection
+func (r *miniResolverResolver) reportError(err error) {
+	if instances, age, ok := r.resolutions.get(r.cacheKey); ok {
+		r.logger.Warn().Err(err).Msgf("using %d cached addresses of %s (%v old)", len(instances), r.target.Endpoint(), age.Round(time.Second))
+		if r.setInstances(instances) {
+			return
+		}
+	}
+	r.cc.ReportError(err)
+}
+
+// setInstances hands the addresses of the preferred priority tier to the load balancer
+func (r *miniResolverResolver) setInstances(instances []*pb.ServiceInstance) bool {
+	target := r.target.Endpoint()
+	instances = preferredInstances(instances)
+	state := resolver.State{
+		Addresses:     make([]resolver.Address, len(instances)),
+		ServiceConfig: r.serviceConfig,
+	}
+	for i, instance := range instances {
+		r.logger.Debug().Msgf("resolved %s to '%s'", target, instance.GetAddr())
+		state.Addresses[i] = newAddress(instance)
+	}
+	if err := r.cc.UpdateState(state); err != nil {
+		r.logger.Error().Err(err).Msgf("cannot update state for %s", target)
+		return false
+	}
+	return true
+}
+
+// preferredInstances returns the instances of the preferred (lowest) priority tier.
+// lower tiers are only used by the load balancer if the preferred tier is empty
+func preferredInstances(instances []*pb.ServiceInstance) []*pb.ServiceInstance {
+	var result []*pb.ServiceInstance
+	for _, instance := range instances {
+		if len(result) > 0 && instance.GetPriority() > result[0].GetPriority() {
+			continue
+		}
+		if len(result) > 0 && instance.GetPriority() < result[0].GetPriority() {
+			result = result[:0]
+		}
+		result = append(result, instance)
+	}
+	return result
+}
+
+func (r *miniResolverResolver) poll() {
+	for {
+		timeout := r.doIt()
+		select {
+		case <-r.refreshTarget:
+			r.logger.Debug().Msgf("refresh target %s", r.target.Endpoint())
+		case <-r.ctx.Done():
+			return
+		case <-time.After(timeout):
+		}
+	}
+}
+
 func (r *miniResolverResolver) doIt() (timeout time.Duration) {
 	addr := r.target.Endpoint()
+	if r.usePinned() {
+		return r.checkTimeout
+	}
 	r.logger.Debug().Msgf("start resolver for %s", addr)
-	resp, err := r.miniResolverclient.ResolveService(context.Background(), &wrapperspb.StringValue{Value: addr})
-	//resp, err := r.miniResolverclient.ResolveServices(context.Background(), &wrapperspb.StringValue{Value: addr})
+	resp, err := r.miniResolverclient.ResolveServices(context.Background(), r.query)
 	if err != nil {
 		r.logger.Error().Err(err).Msgf("cannot resolve %s", addr)
-		r.cc.ReportError(errors.Wrapf(err, "cannot resolve %s", addr))
+		r.reportError(errors.Wrapf(err, "cannot resolve %s", addr))
 		return 10 * time.Second
 	}
-	if resp.String() == "" {
-		r.logger.Debug().Msgf("no service found for %s", addr)
-	}
-	timeout = time.Duration(resp.GetNextCallWait()) * time.Second
-	/*
-		for _, a := range resp.Addr {
-			r.logger.Debug().Msgf("resolved %s to '%s'", addr, a)
-		}
-		addrs := make([]resolver.Address, len(resp.Addr))
-		for i, s := range resp.Addr {
-			addrs[i] = resolver.Address{Addr: s}
-		}
-	*/
-	if err := r.cc.UpdateState(resolver.State{Addresses: []resolver.Address{{Addr: resp.GetAddr()}}}); err != nil {
-		r.logger.Error().Err(err).Msgf("cannot update state for %s", addr)
-		return
+	if !r.updateState(resp) {
+		return r.notFoundTimeout
 	}
-	return
+	return time.Duration(resp.GetNextCallWait()) * time.Second
 }
 func (r *miniResolverResolver) ResolveNow(resolver.ResolveNowOptions) {
 	//r.logger.Debug().Msgf("resolve now")
 }
 func (r *miniResolverResolver) Close() {
 	r.logger.Debug().Msgf("close %s", r.target.Endpoint())
-	r.done <- true
+	r.cancel()
 }
@@ -0,0 +1,316 @@
+package resolver
+
+import (
+	"context"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
+	"io"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fakeMiniResolverClient answers WatchService with the responses of the watches channel and
+// ResolveServices with resolve. all other calls panic
+type fakeMiniResolverClient struct {
+	pb.MiniResolverClient
+	watches chan *fakeWatchStream
+	resolve func() (*pb.ServicesResponse, error)
+}
+
+func (f *fakeMiniResolverClient) WatchService(ctx context.Context, _ *pb.ServiceQuery, _ ...grpc.CallOption) (pb.MiniResolver_WatchServiceClient, error) {
+	select {
+	case stream := <-f.watches:
+		if stream.err != nil {
+			return nil, stream.err
+		}
+		stream.ctx = ctx
+		return stream, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (f *fakeMiniResolverClient) ResolveServices(context.Context, *pb.ServiceQuery, ...grpc.CallOption) (*pb.ServicesResponse, error) {
+	return f.resolve()
+}
+
+// fakeWatchStream delivers responses, then ends with end (or blocks until the stream is canceled, if end is nil)
+type fakeWatchStream struct {
+	grpc.ClientStream
+	ctx       context.Context
+	responses []*pb.ServicesResponse
+	end       error
+	err       error // error of WatchService
+}
+
+func (s *fakeWatchStream) Recv() (*pb.ServicesResponse, error) {
+	if len(s.responses) > 0 {
+		resp := s.responses[0]
+		s.responses = s.responses[1:]
+		return resp, nil
+	}
+	if s.end != nil {
+		return nil, s.end
+	}
+	<-s.ctx.Done()
+	return nil, s.ctx.Err()
+}
+
+// fakeClientConn records the addresses of all state updates
+type fakeClientConn struct {
+	resolver.ClientConn
+	states    chan []string
+	addresses chan []resolver.Address
+	errors    chan error
+}
+
+func newFakeClientConn() *fakeClientConn {
+	return &fakeClientConn{states: make(chan []string, 10), addresses: make(chan []resolver.Address, 10), errors: make(chan error, 10)}
+}
+
+func (cc *fakeClientConn) UpdateState(state resolver.State) error {
+	var addrs []string
+	for _, a := range state.Addresses {
+		addrs = append(addrs, a.Addr)
+	}
+	cc.states <- addrs
+	cc.addresses <- state.Addresses
+	return nil
+}
+
+func (cc *fakeClientConn) ReportError(err error) {
+	cc.errors <- err
+}
+
+func (cc *fakeClientConn) ParseServiceConfig(string) *serviceconfig.ParseResult {
+	return &serviceconfig.ParseResult{}
+}
+
+func (cc *fakeClientConn) nextState(t *testing.T) []string {
+	t.Helper()
+	select {
+	case addrs := <-cc.states:
+		return addrs
+	case <-time.After(5 * time.Second):
+		t.Fatal("no state update")
+		return nil
+	}
+}
+
+func response(addrs ...string) *pb.ServicesResponse {
+	return &pb.ServicesResponse{Addrs: addrs, NextCallWait: 1}
+}
+
+func buildTestResolver(t *testing.T, client pb.MiniResolverClient, cc resolver.ClientConn) resolver.Resolver {
+	t.Helper()
+	nop := zerolog.Nop()
+	mr, err := NewMiniresolverClient("", nil, nil, nil, time.Minute, time.Second, &nop)
+	if err != nil {
+		t.Fatalf("cannot create client: %v", err)
+	}
+	mr.MiniResolverClient = client
+	target, _ := url.Parse("miniresolver:dom.svc")
+	r, err := NewMiniResolverResolverBuilder(mr, time.Minute, time.Second, &nop).Build(resolver.Target{URL: *target}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("cannot build resolver: %v", err)
+	}
+	t.Cleanup(r.Close)
+	return r
+}
+
+func TestResolverWatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		streams []*fakeWatchStream
+		resolve func() (*pb.ServicesResponse, error)
+		want    [][]string
+	}{
+		{
+			name:    "updates of the stream",
+			streams: []*fakeWatchStream{{responses: []*pb.ServicesResponse{response("a:1"), response("a:1", "b:2"), response("b:2")}}},
+			want:    [][]string{{"a:1"}, {"a:1", "b:2"}, {"b:2"}},
+		},
+		{
+			name: "fallback to polling without WatchService",
+			streams: []*fakeWatchStream{
+				{err: status.Error(codes.Unimplemented, "unknown method WatchService")},
+			},
+			resolve: func() (*pb.ServicesResponse, error) { return response("c:3"), nil },
+			want:    [][]string{{"c:3"}, {"c:3"}},
+		},
+		{
+			name: "fallback to polling if the stream is not implemented",
+			streams: []*fakeWatchStream{
+				{end: status.Error(codes.Unimplemented, "unknown method WatchService")},
+			},
+			resolve: func() (*pb.ServicesResponse, error) { return response("d:4"), nil },
+			want:    [][]string{{"d:4"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeMiniResolverClient{watches: make(chan *fakeWatchStream, len(tt.streams)), resolve: tt.resolve}
+			for _, stream := range tt.streams {
+				client.watches <- stream
+			}
+			cc := newFakeClientConn()
+			buildTestResolver(t, client, cc)
+			for _, want := range tt.want {
+				if got := cc.nextState(t); !slices.Equal(got, want) {
+					t.Errorf("addresses %v, want %v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestResolverWatchNotFound(t *testing.T) {
+	client := &fakeMiniResolverClient{watches: make(chan *fakeWatchStream, 1)}
+	client.watches <- &fakeWatchStream{responses: []*pb.ServicesResponse{response()}, end: io.EOF}
+	cc := newFakeClientConn()
+	buildTestResolver(t, client, cc)
+	select {
+	case err := <-cc.errors:
+		if err == nil {
+			t.Error("nil error reported")
+		}
+	case addrs := <-cc.states:
+		t.Errorf("state %v for service without instances", addrs)
+	case <-time.After(5 * time.Second):
+		t.Error("service without instances not reported")
+	}
+}
+
+func TestResolverStaleCache(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream *fakeWatchStream
+		want   [][]string
+		err    bool
+	}{
+		{
+			name:   "broken stream without response",
+			stream: &fakeWatchStream{end: status.Error(codes.Unavailable, "unavailable")},
+			err:    true,
+		},
+		{
+			name:   "broken stream after response",
+			stream: &fakeWatchStream{responses: []*pb.ServicesResponse{response("b:2")}, end: status.Error(codes.Unavailable, "unavailable")},
+			want:   [][]string{{"b:2"}, {"b:2"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nop := zerolog.Nop()
+			mr, err := NewMiniresolverClient("", nil, nil, nil, time.Minute, time.Second, &nop)
+			if err != nil {
+				t.Fatalf("cannot create client: %v", err)
+			}
+			client := &fakeMiniResolverClient{watches: make(chan *fakeWatchStream, 1)}
+			client.watches <- tt.stream
+			mr.MiniResolverClient = client
+			mr.resolutions = newResolutionCache("", time.Minute, &nop)
+			mr.resolutions.entries["miniresolver:dom.svc"] = &cachedResolution{
+				Updated:   time.Now().Add(-2 * time.Minute),
+				Instances: []*pb.ServiceInstance{{Addr: "a:1"}},
+			}
+			target, _ := url.Parse("miniresolver:dom.svc")
+			cc := newFakeClientConn()
+			r, err := NewMiniResolverResolverBuilder(mr, time.Minute, time.Second, &nop).Build(resolver.Target{URL: *target}, cc, resolver.BuildOptions{})
+			if err != nil {
+				t.Fatalf("cannot build resolver: %v", err)
+			}
+			defer r.Close()
+			for _, want := range tt.want {
+				if got := cc.nextState(t); !slices.Equal(got, want) {
+					t.Errorf("addresses %v, want %v", got, want)
+				}
+			}
+			if tt.err {
+				select {
+				case <-cc.errors:
+				case addrs := <-cc.states:
+					t.Errorf("stale addresses %v used", addrs)
+				case <-time.After(5 * time.Second):
+					t.Error("broken stream not reported")
+				}
+			}
+		})
+	}
+}
+
+func TestResolverAddressAttributes(t *testing.T) {
+	instances := []*pb.ServiceInstance{
+		{Addr: "a:1", Version: "2.1", Zone: "bs1", Tags: []string{"canary"}, Metadata: map[string]string{"owner": "ub"}, Weight: 5},
+		{Addr: "b:2", Zone: "bs2"},
+		{Addr: "c:3", Priority: 1},
+	}
+	client := &fakeMiniResolverClient{watches: make(chan *fakeWatchStream, 1)}
+	client.watches <- &fakeWatchStream{responses: []*pb.ServicesResponse{{Instances: instances, NextCallWait: 1}}}
+	cc := newFakeClientConn()
+	buildTestResolver(t, client, cc)
+	cc.nextState(t)
+	addrs := <-cc.addresses
+	want := map[string]*Instance{
+		"a:1": {Version: "2.1", Zone: "bs1", Tags: []string{"canary"}, Metadata: map[string]string{"owner": "ub"}, Weight: 5},
+		"b:2": {Zone: "bs2"},
+	}
+	if len(addrs) != len(want) {
+		t.Fatalf("%d addresses, want %d of the preferred priority tier", len(addrs), len(want))
+	}
+	for _, addr := range addrs {
+		if got := GetInstance(addr); !got.Equal(want[addr.Addr]) {
+			t.Errorf("%s: instance %+v, want %+v", addr.Addr, got, want[addr.Addr])
+		}
+	}
+	if GetInstance(resolver.Address{Addr: "d:4"}) != nil {
+		t.Error("instance of address without attributes")
+	}
+}
+
+func TestInstanceEqual(t *testing.T) {
+	base := func() *Instance {
+		return &Instance{Version: "2.1", Zone: "bs1", Tags: []string{"canary"}, Metadata: map[string]string{"owner": "ub"}, Weight: 5, Priority: 1}
+	}
+	tests := []struct {
+		name   string
+		change func(i *Instance)
+		want   bool
+	}{
+		{name: "equal", change: func(*Instance) {}, want: true},
+		{name: "version", change: func(i *Instance) { i.Version = "2.2" }},
+		{name: "zone", change: func(i *Instance) { i.Zone = "bs2" }},
+		{name: "tags", change: func(i *Instance) { i.Tags = append(i.Tags, "beta") }},
+		{name: "metadata", change: func(i *Instance) { i.Metadata["owner"] = "dh" }},
+		{name: "weight", change: func(i *Instance) { i.Weight = 1 }},
+		{name: "priority", change: func(i *Instance) { i.Priority = 0 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			other := base()
+			tt.change(other)
+			if got := base().Equal(other); got != tt.want {
+				t.Errorf("Equal = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	// grpc compares the attributes of the addresses, so changed metadata is an update
+	a := newAddress(&pb.ServiceInstance{Addr: "a:1", Version: "2.1"})
+	if !a.Equal(newAddress(&pb.ServiceInstance{Addr: "a:1", Version: "2.1"})) {
+		t.Error("addresses of the same instance differ")
+	}
+	if a.Equal(newAddress(&pb.ServiceInstance{Addr: "a:1", Version: "2.2"})) {
+		t.Error("addresses of changed instance equal")
+	}
+	var nilInstance *Instance
+	if !nilInstance.Equal(nilInstance) || nilInstance.Equal(base()) || base().Equal(nilInstance) || base().Equal("other type") {
+		t.Error("Equal of nil or other type")
+	}
+}
@@ -0,0 +1,128 @@
+package resolver
+
+import (
+	"emperror.dev/errors"
+	"encoding/json"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultMaxStaleness is the maximum age of cached addresses, which are used while the miniresolver is not reachable
+const DefaultMaxStaleness = 10 * time.Minute
+
+type cachedResolution struct {
+	Updated   time.Time             `json:"updated"`
+	Instances []*pb.ServiceInstance `json:"instances"`
+}
+
+// newResolutionCache keeps the last good resolution of every target.
+// with filename the cache is persisted, so it survives a restart of the client
+func newResolutionCache(filename string, maxStaleness time.Duration, logger zLogger.ZLogger) *resolutionCache {
+	return &resolutionCache{
+		filename:     filename,
+		maxStaleness: maxStaleness,
+		entries:      map[string]*cachedResolution{},
+		logger:       logger,
+	}
+}
+
+type resolutionCache struct {
+	sync.Mutex
+	filename     string
+	maxStaleness time.Duration
+	entries      map[string]*cachedResolution
+	logger       zLogger.ZLogger
+}
+
+// load reads the persisted resolutions. a missing file is not an error
+func (rc *resolutionCache) load() error {
+	if rc.filename == "" {
+		return nil
+	}
+	data, err := os.ReadFile(rc.filename)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return errors.Wrapf(err, "cannot read resolution cache '%s'", rc.filename)
+	}
+	entries := map[string]*cachedResolution{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return errors.Wrapf(err, "cannot unmarshal resolution cache '%s'", rc.filename)
+	}
+	rc.Lock()
+	defer rc.Unlock()
+	rc.entries = entries
+	rc.logger.Debug().Msgf("%d resolutions loaded from '%s'", len(entries), rc.filename)
+	return nil
+}
+
+// save persists all resolutions. the file is replaced atomically
+// lock must be held by caller
+func (rc *resolutionCache) save() {
+	if rc.filename == "" {
+		return
+	}
+	data, err := json.Marshal(rc.entries)
+	if err != nil {
+		rc.logger.Error().Err(err).Msg("cannot marshal resolution cache")
+		return
+	}
+	tmpName := rc.filename + ".tmp"
+	if err := os.WriteFile(tmpName, data, 0600); err != nil {
+		rc.logger.Error().Err(err).Msgf("cannot write resolution cache to '%s'", tmpName)
+		return
+	}
+	if err := os.Rename(tmpName, rc.filename); err != nil {
+		rc.logger.Error().Err(err).Msgf("cannot rename '%s' to '%s'", tmpName, rc.filename)
+	}
+}
+
+// put stores the instances of target. an empty resolution removes the target,
+// since the service is known to be gone
+func (rc *resolutionCache) put(target string, instances []*pb.ServiceInstance) {
+	rc.Lock()
+	defer rc.Unlock()
+	if len(instances) == 0 {
+		if _, ok := rc.entries[target]; !ok {
+			return
+		}
+		delete(rc.entries, target)
+	} else {
+		rc.entries[target] = &cachedResolution{
+			Updated:   time.Now(),
+			Instances: instances,
+		}
+	}
+	rc.save()
+}
+
+// touch marks the cached resolution of target as valid until now.
+// used when a watch stream breaks, which delivered no change since the last update
+func (rc *resolutionCache) touch(target string) {
+	rc.Lock()
+	defer rc.Unlock()
+	if entry, ok := rc.entries[target]; ok {
+		entry.Updated = time.Now()
+		rc.save()
+	}
+}
+
+// get returns the cached instances of target, if they are not older than maxStaleness
+func (rc *resolutionCache) get(target string) ([]*pb.ServiceInstance, time.Duration, bool) {
+	rc.Lock()
+	defer rc.Unlock()
+	entry, ok := rc.entries[target]
+	if !ok {
+		return nil, 0, false
+	}
+	age := time.Since(entry.Updated)
+	if age > rc.maxStaleness {
+		return nil, age, false
+	}
+	return entry.Instances, age, true
+}
@@ -0,0 +1,125 @@
+package resolver
+
+import (
+	"emperror.dev/errors"
+	"encoding/json"
+	"github.com/BurntSushi/toml"
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// clientMapReloadDelay collects all events of a write, so a truncated file is never loaded
+const clientMapReloadDelay = 200 * time.Millisecond
+
+// LoadClientMap loads service name to address mappings from a toml, yaml or json file (by extension)
+// and reloads it on every change. the entries override the client map of NewMiniresolverClient.
+// all clients created afterward are resolved through the resolver builder, so changes of the file
+// apply to existing connections
+func (c *MiniResolver) LoadClientMap(filename string) error {
+	filename, err := filepath.Abs(filename)
+	if err != nil {
+		return errors.Wrapf(err, "cannot get absolute path of '%s'", filename)
+	}
+	if err := c.reloadClientMap(filename); err != nil {
+		return errors.WithStack(err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "cannot create file watcher")
+	}
+	// editors replace files instead of writing them, so the directory is watched
+	if err := watcher.Add(filepath.Dir(filename)); err != nil {
+		watcher.Close()
+		return errors.Wrapf(err, "cannot watch '%s'", filepath.Dir(filename))
+	}
+	c.clientCloser = append(c.clientCloser, watcher)
+	if c.MiniResolverClient == nil {
+		// client map only, no resolver registered yet
+		RegisterResolver(c, 0, 0, c.logger)
+	}
+	go func() {
+		var reload <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Name != filename || !(event.Has(fsnotify.Write) || event.Has(fsnotify.Create)) {
+					continue
+				}
+				reload = time.After(clientMapReloadDelay)
+			case <-reload:
+				reload = nil
+				if err := c.reloadClientMap(filename); err != nil {
+					c.logger.Error().Err(err).Msgf("cannot reload client map, keeping the previous one")
+					continue
+				}
+				c.refreshAll()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				c.logger.Error().Err(err).Msgf("error watching client map '%s'", filename)
+			}
+		}
+	}()
+	return nil
+}
+
+// reloadClientMap replaces the entries of the file with the current content
+func (c *MiniResolver) reloadClientMap(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return errors.Wrapf(err, "cannot read client map '%s'", filename)
+	}
+	var entries = map[string]string{}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".toml":
+		err = toml.Unmarshal(data, &entries)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &entries)
+	case ".json":
+		err = json.Unmarshal(data, &entries)
+	default:
+		return errors.Errorf("unknown format of client map '%s'", filename)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "cannot unmarshal client map '%s'", filename)
+	}
+	clientMap := maps.Clone(c.staticClientMap)
+	maps.Copy(clientMap, entries)
+	c.clientMapLock.Lock()
+	c.clientMap = clientMap
+	c.clientMapFile = filename
+	c.clientMapLock.Unlock()
+	c.logger.Info().Msgf("client map with %d entries loaded from '%s'", len(entries), filename)
+	return nil
+}
+
+// lookupClientMap returns the mapped address of the service name.
+// reloadable is true, if the client map is loaded from a watched file
+func (c *MiniResolver) lookupClientMap(serviceName string) (addr string, ok bool, reloadable bool) {
+	c.clientMapLock.RLock()
+	defer c.clientMapLock.RUnlock()
+	addr, ok = c.clientMap[serviceName]
+	return addr, ok, c.clientMapFile != ""
+}
+
+// refreshAll lets all resolvers reevaluate their targets
+func (c *MiniResolver) refreshAll() {
+	c.watchLock.Lock()
+	targets := make([]string, 0, len(c.watchServices))
+	for target := range c.watchServices {
+		targets = append(targets, target)
+	}
+	c.watchLock.Unlock()
+	for _, target := range targets {
+		go c.RefreshResolver(target)
+	}
+}
@@ -0,0 +1,116 @@
+package resolver
+
+import (
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/resolver"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestClientMapFormats(t *testing.T) {
+	tests := []struct {
+		file    string
+		content string
+		invalid bool
+	}{
+		{file: "clients.toml", content: "\"dom.svc\" = \"a:1\"\n"},
+		{file: "clients.yaml", content: "dom.svc: a:1\n"},
+		{file: "clients.YML", content: "dom.svc: a:1\n"},
+		{file: "clients.json", content: `{"dom.svc": "a:1"}`},
+		{file: "clients.json", content: `{"dom.svc": `, invalid: true},
+		{file: "clients.ini", content: "dom.svc=a:1\n", invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			nop := zerolog.Nop()
+			mr, err := NewMiniresolverClient("", map[string]string{"dom.svc": "static:1", "dom.other": "static:2"}, nil, nil, time.Minute, time.Second, &nop)
+			if err != nil {
+				t.Fatalf("cannot create client: %v", err)
+			}
+			filename := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(filename, []byte(tt.content), 0600); err != nil {
+				t.Fatalf("cannot write client map: %v", err)
+			}
+			err = mr.reloadClientMap(filename)
+			if tt.invalid {
+				if err == nil {
+					t.Fatal("no error for invalid client map")
+				}
+				if addr, _, reloadable := mr.lookupClientMap("dom.svc"); addr != "static:1" || reloadable {
+					t.Errorf("client map changed by invalid file: '%s' (reloadable %v)", addr, reloadable)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("cannot load client map: %v", err)
+			}
+			// the file overrides the static entries
+			for name, want := range map[string]string{"dom.svc": "a:1", "dom.other": "static:2"} {
+				if addr, ok, reloadable := mr.lookupClientMap(name); !ok || addr != want || !reloadable {
+					t.Errorf("%s: '%s' (%v, reloadable %v), want '%s'", name, addr, ok, reloadable, want)
+				}
+			}
+		})
+	}
+}
+
+func TestClientMapReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "clients.toml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatalf("cannot write client map: %v", err)
+		}
+	}
+	write("\"dom.svc\" = \"a:1\"\n")
+
+	nop := zerolog.Nop()
+	mr, err := NewMiniresolverClient("", nil, nil, nil, time.Minute, time.Second, &nop)
+	if err != nil {
+		t.Fatalf("cannot create client: %v", err)
+	}
+	// resolved by the server after unpinning
+	client := &fakeMiniResolverClient{watches: make(chan *fakeWatchStream, 1)}
+	client.watches <- &fakeWatchStream{responses: []*pb.ServicesResponse{response("c:3")}}
+	mr.MiniResolverClient = client
+	if err := mr.LoadClientMap(filename); err != nil {
+		t.Fatalf("cannot load client map: %v", err)
+	}
+	defer mr.Close()
+	target, _ := url.Parse("miniresolver:dom.svc")
+	cc := newFakeClientConn()
+	r, err := NewMiniResolverResolverBuilder(mr, time.Minute, time.Second, &nop).Build(resolver.Target{URL: *target}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("cannot build resolver: %v", err)
+	}
+	defer r.Close()
+	if got := cc.nextState(t); !slices.Equal(got, []string{"a:1"}) {
+		t.Fatalf("pinned addresses %v, want [a:1]", got)
+	}
+
+	write("\"dom.svc\" = \"b:2\"\n")
+	if got := cc.nextState(t); !slices.Equal(got, []string{"b:2"}) {
+		t.Fatalf("addresses after rewrite %v, want [b:2]", got)
+	}
+
+	// a broken file keeps the previous entries
+	write("\"dom.svc\" = \n")
+	select {
+	case addrs := <-cc.states:
+		t.Fatalf("addresses %v after invalid client map", addrs)
+	case <-time.After(3 * clientMapReloadDelay):
+	}
+	if addr, _, _ := mr.lookupClientMap("dom.svc"); addr != "b:2" {
+		t.Fatalf("entry '%s' after invalid client map, want 'b:2'", addr)
+	}
+
+	write("\"dom.other\" = \"d:4\"\n")
+	if got := cc.nextState(t); !slices.Equal(got, []string{"c:3"}) {
+		t.Fatalf("addresses after unpinning %v, want [c:3]", got)
+	}
+}
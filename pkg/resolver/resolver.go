@@ -6,21 +6,62 @@ import (
 	"emperror.dev/errors"
 	"fmt"
 	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"github.com/je4/miniresolver/v2/pkg/selector"
 	"github.com/je4/utils/v2/pkg/zLogger"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer/pickfirst"
+	"google.golang.org/grpc/balancer/roundrobin"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
 	"google.golang.org/grpc/status"
 	"io"
+	"net"
 	"os"
 	"regexp"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 )
 
+const (
+	LBRoundRobin = roundrobin.Name
+	LBPickFirst  = pickfirst.Name
+	// LBWeightedRoundRobin distributes the calls by the registered weights of the instances
+	LBWeightedRoundRobin = weightedRoundRobinName
+)
+
+// DefaultLoadBalancingPolicy is used for all miniresolver targets without explicit policy
+const DefaultLoadBalancingPolicy = LBRoundRobin
+
+type clientOptions struct {
+	loadBalancingPolicy string
+	selectors           []string
+}
+
+type ClientOption func(*clientOptions)
+
+// WithLoadBalancingPolicy sets the grpc load balancing policy (i.e. LBRoundRobin) for the client
+func WithLoadBalancingPolicy(policy string) ClientOption {
+	return func(o *clientOptions) {
+		o.loadBalancingPolicy = policy
+	}
+}
+
+// WithSelectors restricts the resolved instances to the ones matching all selectors (i.e. "zone=bs1", "version>=2.1")
+func WithSelectors(selectors ...string) ClientOption {
+	return func(o *clientOptions) {
+		o.selectors = append(o.selectors, selectors...)
+	}
+}
+
 func newClient[V any](newClientFunc func(conn grpc.ClientConnInterface) V, serverAddr string, tlsConfig *tls.Config, opts ...grpc.DialOption) (V, io.Closer, error) {
 
 	if tlsConfig != nil {
@@ -38,9 +79,12 @@ func newClient[V any](newClientFunc func(conn grpc.ClientConnInterface) V, serve
 	return client, conn, nil
 }
 
+// clusterScheme is used for the connection to multiple miniresolver servers
+const clusterScheme = "miniresolvercluster"
+
 /*
 NewMiniresolverClient creates a new miniresolver client
-serverAddr: network address of the miniresolver server can be empty for clientMap only
+serverAddr: network address of the miniresolver server can be empty for clientMap only, comma separated list for a miniresolver cluster
 clientMap: map of service names to network addresses can be nil
 clientTLSConfig: tls configuration for the client can be nil for server only or insecure
 serverTLSConfig: tls configuration for the server can be nil for client only or insecure
@@ -60,11 +104,14 @@ func NewMiniresolverClient(serverAddr string, clientMap map[string]string, clien
 	res := &MiniResolver{
 		watchServices:   map[string]chan<- bool{},
 		watchLock:       sync.Mutex{},
+		lbPolicies:      map[string]string{},
 		clientMap:       clientMap,
+		staticClientMap: clientMap,
 		clientTLSConfig: clientTLSConfig,
 		serverTLSConfig: serverTLSConfig,
 		dialOpts:        dialOpts,
 		serverOpts:      []grpc.ServerOption{},
+		resolutions:     newResolutionCache("", DefaultMaxStaleness, logger),
 		logger:          logger,
 	}
 	//res.SetServerOpts(grpc.ChainUnaryInterceptor(res.unaryServerInterceptor), grpc.ChainStreamInterceptor(res.streamServerInterceptor))
@@ -73,7 +120,12 @@ func NewMiniresolverClient(serverAddr string, clientMap map[string]string, clien
 		grpc.WithStreamInterceptor(res.getStreamClientInterceptor()),
 	)
 	if serverAddr != "" {
-		res.MiniResolverClient, res.conn, err = newClient[pb.MiniResolverClient](pb.NewMiniResolverClient, serverAddr, clientTLSConfig, res.dialOpts...)
+		var target = serverAddr
+		var opts = res.dialOpts
+		if addrs := strings.Split(serverAddr, ","); len(addrs) > 1 {
+			target, opts = clusterTarget(addrs, opts)
+		}
+		res.MiniResolverClient, res.conn, err = newClient[pb.MiniResolverClient](pb.NewMiniResolverClient, target, clientTLSConfig, opts...)
 		if err != nil {
 			return nil, errors.Wrapf(err, "cannot create client for %s", serverAddr)
 		}
@@ -83,18 +135,43 @@ func NewMiniresolverClient(serverAddr string, clientMap map[string]string, clien
 	return res, nil
 }
 
+// clusterTarget creates a target for all addresses. pick_first uses the first reachable server
+// and switches to the next one, if the connection breaks
+func clusterTarget(addrs []string, opts []grpc.DialOption) (string, []grpc.DialOption) {
+	r := manual.NewBuilderWithScheme(clusterScheme)
+	state := resolver.State{Addresses: make([]resolver.Address, 0, len(addrs))}
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		// authority of the target is not a hostname, so server name is needed for tls
+		state.Addresses = append(state.Addresses, resolver.Address{Addr: addr, ServerName: host})
+	}
+	r.InitialState(state)
+	return r.Scheme() + ":///cluster", append(slices.Clone(opts), grpc.WithResolvers(r))
+}
+
 type MiniResolver struct {
 	pb.MiniResolverClient
 	conn            io.Closer
 	watchLock       sync.Mutex
 	watchServices   map[string]chan<- bool
+	lbPolicies      map[string]string
 	clientCloser    []io.Closer
 	clientTLSConfig *tls.Config
 	dialOpts        []grpc.DialOption
 	serverOpts      []grpc.ServerOption
 	serverTLSConfig *tls.Config
 	clientMap       map[string]string
+	staticClientMap map[string]string
+	clientMapFile   string
+	clientMapLock   sync.RWMutex
+	resolutions     *resolutionCache
 	logger          zLogger.ZLogger
+	tracer          trace.Tracer
+	propagator      propagation.TextMapPropagator
 }
 
 func (c *MiniResolver) SetDialOpts(options ...grpc.DialOption) {
@@ -105,6 +182,17 @@ func (c *MiniResolver) SetServerOpts(options ...grpc.ServerOption) {
 	c.serverOpts = append(c.serverOpts, options...)
 }
 
+// SetResolutionCache persists the last good resolution of every target to filename (memory only if empty).
+// while the miniresolver is not reachable, cached addresses up to maxStaleness old are used.
+// a maxStaleness of 0 disables the fallback. Must be called before the clients are created
+func (c *MiniResolver) SetResolutionCache(filename string, maxStaleness time.Duration) error {
+	c.resolutions = newResolutionCache(filename, maxStaleness, c.logger)
+	if err := c.resolutions.load(); err != nil {
+		return errors.Wrap(err, "cannot load resolution cache")
+	}
+	return nil
+}
+
 var domainRegexp = regexp.MustCompile(`^miniresolver:([a-zA-Z0-9-]+)\.([a-zA-Z0-9-]+)\.([a-zA-Z0-9-]+)`)
 
 func (c *MiniResolver) getStreamClientInterceptor() grpc.StreamClientInterceptor {
@@ -124,12 +212,14 @@ func (c *MiniResolver) getStreamClientInterceptor() grpc.StreamClientInterceptor
 		} else {
 			domain = d[0]
 		}
+		ctx, span := c.startClientSpan(ctx, md, method, target, domain)
 		ctx = metadata.NewOutgoingContext(ctx, md)
 		start := time.Now()
 		clientStream, err := streamer(ctx, desc, cc, method, opts...)
 		end := time.Now()
 		c.logger.Debug().Str("domain", domain).Str("target", target).Str("method", method).Dur("duration", end.Sub(start)).Err(err)
 		if err != nil {
+			endSpan(span, err)
 			if stat, ok := status.FromError(err); ok {
 				if stat.Code() == codes.Unavailable {
 					c.RefreshResolver(cc.Target())
@@ -137,6 +227,9 @@ func (c *MiniResolver) getStreamClientInterceptor() grpc.StreamClientInterceptor
 			}
 			return nil, errors.Wrapf(err, "RPC: %s %s :: %s", target, method, domain)
 		}
+		if span != nil {
+			return &tracedClientStream{ClientStream: clientStream, span: span}, nil
+		}
 		return clientStream, nil
 	}
 }
@@ -159,8 +252,15 @@ func (c *MiniResolver) getUnaryClientInterceptor() grpc.UnaryClientInterceptor {
 		} else {
 			domain = d[0]
 		}
+		ctx, span := c.startClientSpan(ctx, md, method, target, domain)
 		ctx = metadata.NewOutgoingContext(ctx, md)
+		var p peer.Peer
+		if span != nil {
+			opts = append(opts, grpc.Peer(&p))
+		}
 		err := invoker(ctx, method, req, reply, cc, opts...)
+		setPeer(span, &p)
+		endSpan(span, err)
 		end := time.Now()
 		c.logger.Debug().Str("domain", domain).Str("target", target).Str("method", method).Dur("duration", end.Sub(start)).Err(err)
 		if err != nil {
@@ -175,10 +275,10 @@ func (c *MiniResolver) getUnaryClientInterceptor() grpc.UnaryClientInterceptor {
 	}
 }
 
-func NewClients[V any](c *MiniResolver, newClientFunc func(conn grpc.ClientConnInterface) V, serviceName string, domains []string) (map[string]V, error) {
+func NewClients[V any](c *MiniResolver, newClientFunc func(conn grpc.ClientConnInterface) V, serviceName string, domains []string, opts ...ClientOption) (map[string]V, error) {
 	var result = map[string]V{}
 	for _, domain := range domains {
-		client, err := NewClient[V](c, newClientFunc, serviceName, domain)
+		client, err := NewClient[V](c, newClientFunc, serviceName, domain, opts...)
 		if err != nil {
 			return nil, errors.Wrapf(err, "cannot create client for %s.%s", domain, serviceName)
 		}
@@ -187,8 +287,8 @@ func NewClients[V any](c *MiniResolver, newClientFunc func(conn grpc.ClientConnI
 	return result, nil
 }
 
-func NewClient[V any](c *MiniResolver, newClientFunc func(conn grpc.ClientConnInterface) V, serviceName, domain string) (V, error) {
-	client, closer, err := NewClientCloser(c, newClientFunc, serviceName, domain)
+func NewClient[V any](c *MiniResolver, newClientFunc func(conn grpc.ClientConnInterface) V, serviceName, domain string, opts ...ClientOption) (V, error) {
+	client, closer, err := NewClientCloser(c, newClientFunc, serviceName, domain, opts...)
 	if err != nil {
 		return client, errors.Wrapf(err, "cannot create client for %s.%s", domain, serviceName)
 	}
@@ -196,22 +296,34 @@ func NewClient[V any](c *MiniResolver, newClientFunc func(conn grpc.ClientConnIn
 	return client, nil
 }
 
-func NewClientCloser[V any](c *MiniResolver, newClientFunc func(conn grpc.ClientConnInterface) V, serviceName, domain string) (V, io.Closer, error) {
+func NewClientCloser[V any](c *MiniResolver, newClientFunc func(conn grpc.ClientConnInterface) V, serviceName, domain string, opts ...ClientOption) (V, io.Closer, error) {
 	var n V
 	var clientAddr string
+	var options = &clientOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
 
 	if domain != "" {
 		serviceName = domain + "." + serviceName
 	}
 
-	if _, ok := c.clientMap[serviceName]; ok {
-		clientAddr = c.clientMap[serviceName]
+	// entries of a reloadable client map are resolved by the resolver builder
+	addr, mapped, reloadable := c.lookupClientMap(serviceName)
+	if mapped && !reloadable {
+		clientAddr = addr
 	} else {
-		if os.Getenv("HTTPS_PROXY") != "" {
+		if os.Getenv("HTTPS_PROXY") != "" && !mapped {
 			clientAddr = "passthrough:///" + serviceName
 		} else {
-			if c.MiniResolverClient != nil && !strings.Contains(serviceName, ":") {
+			if (c.MiniResolverClient != nil || reloadable) && !strings.Contains(serviceName, ":") {
 				clientAddr = fmt.Sprintf("miniresolver:%s", serviceName)
+				if len(options.selectors) > 0 {
+					clientAddr += "?" + selector.Query(options.selectors...)
+				}
+				if options.loadBalancingPolicy != "" {
+					c.setLoadBalancingPolicy(clientAddr, options.loadBalancingPolicy)
+				}
 			}
 		}
 	}
@@ -244,7 +356,11 @@ func (c *MiniResolver) NewServer(addr string, domains []string, single bool) (*S
 	if c.MiniResolverClient == nil {
 		return nil, errors.Errorf("no miniresolver client")
 	}
-	server, err := newServer(addr, domains, c.serverTLSConfig, c.MiniResolverClient, single, c.logger, c.serverOpts...)
+	serverOpts := append([]grpc.ServerOption{}, c.serverOpts...)
+	if c.tracer != nil {
+		serverOpts = append(serverOpts, grpc.ChainUnaryInterceptor(c.getUnaryServerInterceptor()), grpc.ChainStreamInterceptor(c.getStreamServerInterceptor()))
+	}
+	server, err := newServer(addr, domains, c.serverTLSConfig, c.MiniResolverClient, single, c.logger, serverOpts...)
 	if err != nil {
 		return nil, errors.Wrapf(err, "cannot create server for %s", addr)
 	}
@@ -265,6 +381,21 @@ func (c *MiniResolver) UnwatchService(target string) {
 	delete(c.watchServices, target)
 }
 
+func (c *MiniResolver) setLoadBalancingPolicy(target, policy string) {
+	c.watchLock.Lock()
+	defer c.watchLock.Unlock()
+	c.lbPolicies[target] = policy
+}
+
+func (c *MiniResolver) getLoadBalancingPolicy(target string) string {
+	c.watchLock.Lock()
+	defer c.watchLock.Unlock()
+	if policy, ok := c.lbPolicies[target]; ok {
+		return policy
+	}
+	return DefaultLoadBalancingPolicy
+}
+
 func (c *MiniResolver) RefreshResolver(target string) {
 	c.watchLock.Lock()
 	ch, ok := c.watchServices[target]
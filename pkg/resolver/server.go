@@ -9,8 +9,11 @@ import (
 	"github.com/je4/utils/v2/pkg/zLogger"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -33,8 +36,10 @@ func newServer(addr string, domains []string, tlsConfig *tls.Config, resolver pb
 	logger = &l2
 	interceptor := trusthelper.NewInterceptor(domains, logger)
 
-	opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)), grpc.UnaryInterceptor(interceptor.ServerInterceptor))
+	opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)), grpc.UnaryInterceptor(healthInterceptor(interceptor.ServerInterceptor)))
 	grpcServer := grpc.NewServer(opts...)
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
 	server := &Server{
 		addr:         addr,
 		Server:       grpcServer,
@@ -45,26 +50,86 @@ func newServer(addr string, domains []string, tlsConfig *tls.Config, resolver pb
 		waitShutdown: sync.WaitGroup{},
 		domains:      domains,
 		single:       single,
+		health:       healthServer,
 	}
 	return server, nil
 }
 
+// healthInterceptor lets health checks pass without checking the client certificate uris.
+// the client certificate itself is still verified by tls
+func healthInterceptor(next grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if strings.HasPrefix(info.FullMethod, "/"+healthpb.Health_ServiceDesc.ServiceName+"/") {
+			return handler(ctx, req)
+		}
+		return next(ctx, req, info, handler)
+	}
+}
+
 type Server struct {
 	*grpc.Server
 	listener     net.Listener
 	logger       zLogger.ZLogger
 	done         chan bool
+	stopOnce     sync.Once
 	waitShutdown sync.WaitGroup
 	resolver     pb.MiniResolverClient
 	addr         string
 	domains      []string
 	single       bool
+	health       *health.Server
+	version      string
+	zone         string
+	tags         []string
+	metadata     map[string]string
+	weight       uint32
+	priority     uint32
+	ttl          time.Duration
 }
 
 func (s *Server) GetAddr() string {
 	return s.addr
 }
 
+// SetVersion sets the version, which is registered with all services. Must be called before Startup
+func (s *Server) SetVersion(version string) {
+	s.version = version
+}
+
+// SetZone sets the zone (i.e. data center), which is registered with all services. Must be called before Startup
+func (s *Server) SetZone(zone string) {
+	s.zone = zone
+}
+
+// SetTags sets the tags, which are registered with all services. Must be called before Startup
+func (s *Server) SetTags(tags ...string) {
+	s.tags = tags
+}
+
+// SetMetadata sets a free-form metadata value, which is registered with all services. Must be called before Startup
+func (s *Server) SetMetadata(key, value string) {
+	if s.metadata == nil {
+		s.metadata = map[string]string{}
+	}
+	s.metadata[key] = value
+}
+
+// SetWeight sets the relative share of traffic within the priority tier. Must be called before Startup
+func (s *Server) SetWeight(weight uint32) {
+	s.weight = weight
+}
+
+// SetPriority sets the priority tier, lower values are preferred. Must be called before Startup
+func (s *Server) SetPriority(priority uint32) {
+	s.priority = priority
+}
+
+// SetTTL requests the lifetime of the lease, which is renewed by a keepalive stream.
+// the resolver limits the ttl to its bounds. Must be called before Startup
+func (s *Server) SetTTL(ttl time.Duration) {
+	s.ttl = ttl
+}
+
 func (s *Server) Startup() {
 	s.waitShutdown.Add(2)
 	go func() {
@@ -80,46 +145,31 @@ func (s *Server) Startup() {
 	go func() {
 		defer s.waitShutdown.Done()
 		si := s.Server.GetServiceInfo()
+		// health service is not registered in the resolver
+		delete(si, healthpb.Health_ServiceDesc.ServiceName)
+		for name := range si {
+			s.health.SetServingStatus(name, healthpb.HealthCheckResponse_SERVING)
+		}
 		singlestr := ""
 		if s.single {
 			singlestr = "single "
 		}
 		var endLoop = false
 		for endLoop == false {
-			var waitSeconds int64 = 10
-			for name, _ := range si {
-				s.logger.Info().Msgf("registering %sservice %v.%s at %s ", singlestr, s.domains, name, s.addr)
-				_, port, err := net.SplitHostPort(s.addr)
-				if err != nil {
-					s.logger.Error().Err(err).Msgf("cannot split host port of '%s'", s.addr)
-					continue
-				}
-				portInt, err := strconv.Atoi(port)
-				if err != nil {
-					s.logger.Error().Err(err).Msgf("cannot convert port '%s' to int", port)
-					continue
+			waitSeconds, leaseID, ttl := s.register(si, singlestr)
+			if leaseID != 0 {
+				if s.keepAlive(leaseID, ttl) {
+					s.logger.Info().Msg("ending resolver keepalive loop")
+					break
 				}
-				if resp, err := s.resolver.AddService(context.Background(), &pb.ServiceData{
-					Service: name,
-					Port:    uint32(portInt),
-					Domains: s.domains,
-					Single:  s.single,
-				}); err != nil {
-					s.logger.Error().Err(err).Msg("cannot register service")
-				} else {
-					waitSeconds = resp.GetNextCallWait()
-					s.logger.Info().Msgf("%sservice registered: %v", singlestr, resp.GetResponse().GetMessage())
-				}
-			}
-			if waitSeconds == 0 {
-				waitSeconds = 5 * 60
+				// lease lost, register again after a short pause
+				waitSeconds = 1
 			}
 			s.logger.Debug().Msgf("waiting %d seconds for refreshing service", waitSeconds)
 			select {
 			case <-s.done:
 				endLoop = true
 				s.logger.Info().Msg("ending resolver refresh loop")
-				break
 			case <-time.After(time.Duration(waitSeconds) * time.Second):
 			}
 		}
@@ -148,9 +198,138 @@ func (s *Server) Startup() {
 	}()
 }
 
-func (s *Server) Shutdown() error {
-	s.done <- true
-	s.Server.GracefulStop()
+// register adds all services to the resolver. the services share one lease, if the resolver supports leases
+func (s *Server) register(si map[string]grpc.ServiceInfo, singlestr string) (waitSeconds int64, leaseID uint64, ttl time.Duration) {
+	waitSeconds = 10
+	for name := range si {
+		s.logger.Info().Msgf("registering %sservice %v.%s at %s ", singlestr, s.domains, name, s.addr)
+		_, port, err := net.SplitHostPort(s.addr)
+		if err != nil {
+			s.logger.Error().Err(err).Msgf("cannot split host port of '%s'", s.addr)
+			continue
+		}
+		portInt, err := strconv.Atoi(port)
+		if err != nil {
+			s.logger.Error().Err(err).Msgf("cannot convert port '%s' to int", port)
+			continue
+		}
+		if resp, err := s.resolver.AddService(context.Background(), &pb.ServiceData{
+			Service:  name,
+			Port:     uint32(portInt),
+			Domains:  s.domains,
+			Single:   s.single,
+			Version:  s.version,
+			Zone:     s.zone,
+			Tags:     s.tags,
+			Metadata: s.metadata,
+			Weight:   s.weight,
+			Priority: s.priority,
+			Ttl:      int64(s.ttl.Seconds()),
+			LeaseID:  leaseID,
+		}); err != nil {
+			s.logger.Error().Err(err).Msg("cannot register service")
+			// all services have to be registered with the lease
+			return 10, 0, 0
+		} else {
+			waitSeconds = resp.GetNextCallWait()
+			leaseID = resp.GetLeaseID()
+			ttl = time.Duration(resp.GetTtl()) * time.Second
+			s.logger.Info().Msgf("%sservice registered: %v (lease %d)", singlestr, resp.GetResponse().GetMessage(), leaseID)
+		}
+	}
+	if waitSeconds == 0 {
+		waitSeconds = 5 * 60
+	}
+	if ttl <= 0 {
+		// resolver without leases
+		leaseID = 0
+	}
+	return waitSeconds, leaseID, ttl
+}
+
+// keepAlive renews the lease every third of its ttl. it returns true on shutdown and false,
+// if the lease has expired or the resolver is not reachable, so the services have to be registered again
+func (s *Server) keepAlive(leaseID uint64, ttl time.Duration) bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := s.resolver.KeepAlive(ctx)
+	if err != nil {
+		s.logger.Error().Err(err).Msgf("cannot start keepalive of lease %d", leaseID)
+		return false
+	}
+	for {
+		s.logger.Debug().Msgf("renewing lease %d in %v", leaseID, ttl/3)
+		select {
+		case <-s.done:
+			return true
+		case <-time.After(ttl / 3):
+		}
+		if err := stream.Send(&pb.KeepAliveRequest{LeaseID: leaseID}); err != nil {
+			s.logger.Error().Err(err).Msgf("cannot renew lease %d", leaseID)
+			return false
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			s.logger.Error().Err(err).Msgf("cannot renew lease %d", leaseID)
+			return false
+		}
+		if resp.GetTtl() <= 0 {
+			s.logger.Info().Msgf("lease %d expired", leaseID)
+			return false
+		}
+		ttl = time.Duration(resp.GetTtl()) * time.Second
+	}
+}
+
+// Drain withdraws all services from resolution, so watching clients stop picking this server,
+// and waits for running calls until ctx is done. afterward the services are unregistered and the server is stopped
+func (s *Server) Drain(ctx context.Context) error {
+	s.health.Shutdown()
+	si := s.Server.GetServiceInfo()
+	delete(si, healthpb.Health_ServiceDesc.ServiceName)
+	for name := range si {
+		s.logger.Info().Msgf("draining service %v.%s at %s", s.domains, name, s.addr)
+		_, port, err := net.SplitHostPort(s.addr)
+		if err != nil {
+			s.logger.Error().Err(err).Msgf("cannot split host port of '%s'", s.addr)
+			continue
+		}
+		portInt, err := strconv.Atoi(port)
+		if err != nil {
+			s.logger.Error().Err(err).Msgf("cannot convert port '%s' to int", port)
+			continue
+		}
+		if _, err := s.resolver.DrainService(ctx, &pb.ServiceData{
+			Service: name,
+			Port:    uint32(portInt),
+			Domains: s.domains,
+		}); err != nil {
+			// resolvers without drain support remove the service on unregistering
+			s.logger.Error().Err(err).Msgf("cannot drain service %v.%s", s.domains, name)
+		}
+	}
+	stopped := make(chan struct{})
+	go func() {
+		s.Server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.logger.Warn().Msg("drain timeout, cancelling running calls")
+		s.Server.Stop()
+		<-stopped
+	}
+	// ends the registration loop, if the server was started
+	s.stopOnce.Do(func() { close(s.done) })
 	s.waitShutdown.Wait()
-	return errors.Wrap(s.listener.Close(), "cannot close listener")
+	// the listener is usually closed by the grpc server already
+	if err := s.listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return errors.Wrap(err, "cannot close listener")
+	}
+	return nil
+}
+
+func (s *Server) Shutdown() error {
+	return s.Drain(context.Background())
 }
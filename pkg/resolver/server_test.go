@@ -0,0 +1,166 @@
+package resolver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	pbgeneric "github.com/je4/genericproto/v2/pkg/generic/proto"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"math/big"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRegistry accepts all registrations without lease and records the calls
+type fakeRegistry struct {
+	pb.MiniResolverClient
+	sync.Mutex
+	calls []string
+}
+
+func (f *fakeRegistry) record(call string, data *pb.ServiceData) {
+	f.Lock()
+	defer f.Unlock()
+	f.calls = append(f.calls, call+" "+data.GetService())
+}
+
+func (f *fakeRegistry) getCalls() []string {
+	f.Lock()
+	defer f.Unlock()
+	return slices.Clone(f.calls)
+}
+
+func (f *fakeRegistry) AddService(_ context.Context, data *pb.ServiceData, _ ...grpc.CallOption) (*pb.ResolverDefaultResponse, error) {
+	f.record("add", data)
+	return &pb.ResolverDefaultResponse{Response: &pbgeneric.DefaultResponse{Status: pbgeneric.ResultStatus_OK}, NextCallWait: 300}, nil
+}
+
+func (f *fakeRegistry) DrainService(_ context.Context, data *pb.ServiceData, _ ...grpc.CallOption) (*pbgeneric.DefaultResponse, error) {
+	f.record("drain", data)
+	return &pbgeneric.DefaultResponse{Status: pbgeneric.ResultStatus_OK}, nil
+}
+
+func (f *fakeRegistry) RemoveService(_ context.Context, data *pb.ServiceData, _ ...grpc.CallOption) (*pbgeneric.DefaultResponse, error) {
+	f.record("remove", data)
+	return &pbgeneric.DefaultResponse{Status: pbgeneric.ResultStatus_OK}, nil
+}
+
+// blockerDesc is a streaming service, whose calls run until they are canceled
+var blockerDesc = grpc.ServiceDesc{
+	ServiceName: "test.Blocker",
+	HandlerType: (*any)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Block",
+		ServerStreams: true,
+		Handler: func(srv any, stream grpc.ServerStream) error {
+			close(srv.(chan struct{}))
+			<-stream.Context().Done()
+			return stream.Context().Err()
+		},
+	}},
+}
+
+func testServerTLS(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func newTestServer(t *testing.T, registry pb.MiniResolverClient) *Server {
+	t.Helper()
+	nop := zerolog.Nop()
+	s, err := newServer("127.0.0.1:0", []string{"dom"}, testServerTLS(t), registry, false, &nop)
+	if err != nil {
+		t.Fatalf("cannot create server: %v", err)
+	}
+	return s
+}
+
+// returnsWithin fails, if f does not return within timeout
+func returnsWithin(t *testing.T, timeout time.Duration, name string, f func() error) {
+	t.Helper()
+	result := make(chan error, 1)
+	go func() { result <- f() }()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	case <-time.After(timeout):
+		t.Fatalf("%s blocks", name)
+	}
+}
+
+func TestServerShutdownBeforeStartup(t *testing.T) {
+	registry := &fakeRegistry{}
+	s := newTestServer(t, registry)
+	returnsWithin(t, 5*time.Second, "shutdown", s.Shutdown)
+	returnsWithin(t, 5*time.Second, "second shutdown", s.Shutdown)
+	if calls := registry.getCalls(); len(calls) != 0 {
+		t.Errorf("resolver calls %v of server without services", calls)
+	}
+}
+
+func TestServerDrainTimeout(t *testing.T) {
+	registry := &fakeRegistry{}
+	s := newTestServer(t, registry)
+	started := make(chan struct{})
+	s.RegisterService(&blockerDesc, started)
+	s.Startup()
+
+	conn, err := grpc.NewClient(s.GetAddr(), grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})))
+	if err != nil {
+		t.Fatalf("cannot connect: %v", err)
+	}
+	defer conn.Close()
+	stream, err := conn.NewStream(context.Background(), &blockerDesc.Streams[0], "/test.Blocker/Block")
+	if err != nil {
+		t.Fatalf("cannot call: %v", err)
+	}
+	if err := stream.SendMsg(&emptypb.Empty{}); err != nil {
+		t.Fatalf("cannot send: %v", err)
+	}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("call not started")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	returnsWithin(t, 5*time.Second, "drain", func() error { return s.Drain(ctx) })
+	if d := time.Since(begin); d < 200*time.Millisecond {
+		t.Errorf("drain returned after %v without waiting for the running call", d)
+	}
+	if err := stream.RecvMsg(&emptypb.Empty{}); err == nil {
+		t.Error("running call not canceled")
+	}
+	want := []string{"add test.Blocker", "drain test.Blocker", "remove test.Blocker"}
+	if calls := registry.getCalls(); !slices.Equal(calls, want) {
+		t.Errorf("resolver calls %v, want %v", calls, want)
+	}
+}
@@ -0,0 +1,169 @@
+package resolver
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"io"
+	"path"
+	"strings"
+	"sync"
+)
+
+const tracerName = "github.com/je4/miniresolver/v2/pkg/resolver"
+
+const (
+	attrTarget = attribute.Key("miniresolver.target")
+	attrDomain = attribute.Key("miniresolver.domain")
+	attrPeer   = attribute.Key("miniresolver.peer")
+)
+
+// metadataCarrier adapts grpc metadata for the propagation of the trace context
+type metadataCarrier metadata.MD
+
+func (mc metadataCarrier) Get(key string) string {
+	values := metadata.MD(mc).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (mc metadataCarrier) Set(key, value string) {
+	metadata.MD(mc).Set(key, value)
+}
+
+func (mc metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(mc))
+	for key := range mc {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// SetTracing enables OpenTelemetry spans in the client interceptors and in servers created by NewServer.
+// without propagator the W3C trace context is used. Must be called before NewServer
+func (c *MiniResolver) SetTracing(tp trace.TracerProvider, propagator propagation.TextMapPropagator) {
+	if propagator == nil {
+		propagator = propagation.TraceContext{}
+	}
+	c.tracer = tp.Tracer(tracerName)
+	c.propagator = propagator
+}
+
+func rpcAttributes(method string) []attribute.KeyValue {
+	service, rpcMethod := path.Split(method)
+	return []attribute.KeyValue{
+		attribute.String("rpc.system", "grpc"),
+		attribute.String("rpc.service", strings.Trim(service, "/")),
+		attribute.String("rpc.method", rpcMethod),
+	}
+}
+
+// startClientSpan starts a span for the outgoing call and injects the trace context into md
+func (c *MiniResolver) startClientSpan(ctx context.Context, md metadata.MD, method, target, domain string) (context.Context, trace.Span) {
+	if c.tracer == nil {
+		return ctx, nil
+	}
+	ctx, span := c.tracer.Start(ctx, strings.TrimPrefix(method, "/"),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(rpcAttributes(method)...),
+		trace.WithAttributes(attrTarget.String(target), attrDomain.String(domain)),
+	)
+	c.propagator.Inject(ctx, metadataCarrier(md))
+	return ctx, span
+}
+
+// setPeer records the address, the target was resolved to
+func setPeer(span trace.Span, p *peer.Peer) {
+	if span == nil || p.Addr == nil {
+		return
+	}
+	span.SetAttributes(attrPeer.String(p.Addr.String()))
+}
+
+// endSpan records the result of the call and ends the span
+func endSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	span.SetAttributes(attribute.String("rpc.grpc.status_code", status.Code(err).String()))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedClientStream ends the span, when the stream is finished
+type tracedClientStream struct {
+	grpc.ClientStream
+	span trace.Span
+	once sync.Once
+}
+
+func (s *tracedClientStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.once.Do(func() {
+			if err == io.EOF {
+				endSpan(s.span, nil)
+			} else {
+				endSpan(s.span, err)
+			}
+		})
+	}
+	return err
+}
+
+// startServerSpan extracts the trace context of the incoming call and starts a span
+func (c *MiniResolver) startServerSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		md = metadata.New(nil)
+	}
+	ctx = c.propagator.Extract(ctx, metadataCarrier(md))
+	var domain string
+	if d := md.Get("domain"); len(d) > 0 {
+		domain = d[0]
+	}
+	return c.tracer.Start(ctx, strings.TrimPrefix(method, "/"),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(rpcAttributes(method)...),
+		trace.WithAttributes(attrDomain.String(domain)),
+	)
+}
+
+func (c *MiniResolver) getUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, span := c.startServerSpan(ctx, info.FullMethod)
+		resp, err := handler(ctx, req)
+		endSpan(span, err)
+		return resp, err
+	}
+}
+
+// tracedServerStream replaces the context of the stream with the context of the span
+type tracedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracedServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (c *MiniResolver) getStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, span := c.startServerSpan(ss.Context(), info.FullMethod)
+		err := handler(srv, &tracedServerStream{ServerStream: ss, ctx: ctx})
+		endSpan(span, err)
+		return err
+	}
+}
@@ -0,0 +1,157 @@
+package resolver
+
+import (
+	"context"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"github.com/rs/zerolog"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"net"
+	"testing"
+	"time"
+)
+
+// tracedServer records the trace context of the incoming calls
+type tracedServer struct {
+	pb.UnimplementedMiniResolverServer
+	calls chan tracedCall
+}
+
+type tracedCall struct {
+	traceparent []string
+	span        trace.SpanContext
+}
+
+func (s *tracedServer) record(ctx context.Context) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.calls <- tracedCall{traceparent: md.Get("traceparent"), span: trace.SpanContextFromContext(ctx)}
+}
+
+func (s *tracedServer) ResolveService(ctx context.Context, _ *pb.ServiceQuery) (*pb.ServiceResponse, error) {
+	s.record(ctx)
+	return &pb.ServiceResponse{Addr: "127.0.0.1:1"}, nil
+}
+
+func (s *tracedServer) WatchService(_ *pb.ServiceQuery, stream pb.MiniResolver_WatchServiceServer) error {
+	s.record(stream.Context())
+	return stream.Send(response("127.0.0.1:1"))
+}
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer tp.Shutdown(context.Background())
+
+	nop := zerolog.Nop()
+	mr, err := NewMiniresolverClient("", nil, nil, nil, time.Minute, time.Second, &nop)
+	if err != nil {
+		t.Fatalf("cannot create miniresolver client: %v", err)
+	}
+	mr.SetTracing(tp, nil)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	srv := &tracedServer{calls: make(chan tracedCall, 1)}
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(mr.getUnaryServerInterceptor()), grpc.ChainStreamInterceptor(mr.getStreamServerInterceptor()))
+	pb.RegisterMiniResolverServer(server, srv)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient(lis.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(mr.getUnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(mr.getStreamClientInterceptor()),
+	)
+	if err != nil {
+		t.Fatalf("cannot connect: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewMiniResolverClient(conn)
+
+	tests := []struct {
+		name   string
+		method string
+		call   func(ctx context.Context) error
+	}{
+		{
+			name:   "unary",
+			method: "miniresolverproto.MiniResolver/ResolveService",
+			call: func(ctx context.Context) error {
+				_, err := client.ResolveService(ctx, &pb.ServiceQuery{Name: "dom.svc"})
+				return err
+			},
+		},
+		{
+			name:   "stream",
+			method: "miniresolverproto.MiniResolver/WatchService",
+			call: func(ctx context.Context) error {
+				stream, err := client.WatchService(ctx, &pb.ServiceQuery{Name: "dom.svc"})
+				if err != nil {
+					return err
+				}
+				for {
+					if _, err := stream.Recv(); err != nil {
+						return nil
+					}
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter.Reset()
+			ctx := metadata.AppendToOutgoingContext(context.Background(), "domain", "dom")
+			if err := tt.call(ctx); err != nil {
+				t.Fatalf("call: %v", err)
+			}
+			call := <-srv.calls
+			if len(call.traceparent) != 1 {
+				t.Fatalf("traceparent metadata %v", call.traceparent)
+			}
+
+			var client, server sdktrace.ReadOnlySpan
+			// the server span ends after the response is sent
+			deadline := time.Now().Add(5 * time.Second)
+			for len(exporter.GetSpans()) < 2 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			for _, span := range exporter.GetSpans().Snapshots() {
+				if span.Name() != tt.method {
+					t.Errorf("span name %s, want %s", span.Name(), tt.method)
+				}
+				switch span.SpanKind() {
+				case trace.SpanKindClient:
+					client = span
+				case trace.SpanKindServer:
+					server = span
+				}
+			}
+			if client == nil || server == nil {
+				t.Fatalf("client span %v, server span %v", client, server)
+			}
+			if server.Parent().SpanID() != client.SpanContext().SpanID() || server.SpanContext().TraceID() != client.SpanContext().TraceID() {
+				t.Errorf("server span %v not child of client span %v", server.Parent(), client.SpanContext())
+			}
+			if !call.span.Equal(server.SpanContext()) {
+				t.Errorf("handler context %v, want server span %v", call.span, server.SpanContext())
+			}
+			for _, span := range []sdktrace.ReadOnlySpan{client, server} {
+				var domain bool
+				for _, attr := range span.Attributes() {
+					if attr.Key == attrDomain && attr.Value.AsString() == "dom" {
+						domain = true
+					}
+				}
+				if !domain {
+					t.Errorf("%s span without domain attribute: %v", span.SpanKind(), span.Attributes())
+				}
+			}
+		})
+	}
+}
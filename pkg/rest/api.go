@@ -0,0 +1,348 @@
+package rest
+
+import (
+	"context"
+	"crypto/tls"
+	"embed"
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"github.com/je4/miniresolver/v2/pkg/rest/docs"
+	"github.com/je4/miniresolver/v2/pkg/selector"
+	"github.com/je4/miniresolver/v2/pkg/service"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	swaggerFiles "github.com/swaggo/files"
+	ginSwagger "github.com/swaggo/gin-swagger"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const BASEPATH = "/api/v1"
+
+//go:embed static/dashboard.html
+var staticFS embed.FS
+
+//	@title			MiniResolver API
+//	@version		1.0
+//	@description	MiniResolver admin API for listing, resolving, registering and evicting services
+//	@termsOfService	http://swagger.io/terms/
+
+//	@contact.name	Jürgen Enge
+//	@contact.url	https://ub.unibas.ch
+//	@contact.email	juergen.enge@unibas.ch
+
+// @license.name	Apache 2.0
+// @license.url	http://www.apache.org/licenses/LICENSE-2.0.html
+func NewMainController(addr, extAddr string, tlsConfig *tls.Config, mr pb.MiniResolverServer, logger zLogger.ZLogger) (*controller, error) {
+	u, err := url.Parse(extAddr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid external address '%s'", extAddr)
+	}
+	subpath := "/" + strings.Trim(u.Path, "/")
+
+	// programmatically set swagger info
+	docs.SwaggerInfo.BasePath = "/" + strings.Trim(subpath+BASEPATH, "/")
+	if tlsConfig == nil {
+		docs.SwaggerInfo.Schemes = []string{"http"}
+	} else {
+		docs.SwaggerInfo.Schemes = []string{"https"}
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+
+	_logger := logger.With().Str("service", "admin").Logger()
+	c := &controller{
+		addr:    addr,
+		extAddr: extAddr,
+		router:  router,
+		subpath: subpath,
+		mr:      mr,
+		logger:  &_logger,
+	}
+	if err := c.Init(tlsConfig); err != nil {
+		return nil, errors.Wrap(err, "cannot initialize rest controller")
+	}
+	return c, nil
+}
+
+type controller struct {
+	server  http.Server
+	router  *gin.Engine
+	addr    string
+	extAddr string
+	subpath string
+	mr      pb.MiniResolverServer
+	logger  zLogger.ZLogger
+}
+
+func (ctrl *controller) Init(tlsConfig *tls.Config) error {
+	ctrl.router.Use(gin.Recovery())
+
+	v1 := ctrl.router.Group(BASEPATH)
+
+	v1.GET("/ping", ctrl.ping)
+	v1.GET("/services", ctrl.listServices)
+	// mutations only with client certificates
+	if tlsConfig != nil && tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+		v1.POST("/services", ctrl.registerService)
+		v1.DELETE("/services/:service", ctrl.evictService)
+	} else {
+		ctrl.logger.Warn().Msg("admin api without client certificates: registering and evicting services disabled")
+	}
+	v1.GET("/resolve/:name", ctrl.resolveService)
+	ctrl.router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
+	ctrl.router.GET("/dashboard", ctrl.dashboard)
+	ctrl.router.GET("/", func(ctx *gin.Context) {
+		ctx.Redirect(http.StatusTemporaryRedirect, strings.TrimRight(ctrl.subpath, "/")+"/dashboard")
+	})
+
+	ctrl.server = http.Server{
+		Addr:      ctrl.addr,
+		Handler:   ctrl.router,
+		TLSConfig: tlsConfig,
+	}
+	return nil
+}
+
+func (ctrl *controller) Start(wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done() // let main know we are done cleaning up
+
+		var err error
+		if ctrl.server.TLSConfig == nil {
+			ctrl.logger.Info().Msgf("starting admin server at http://%s", ctrl.addr)
+			err = ctrl.server.ListenAndServe()
+		} else {
+			ctrl.logger.Info().Msgf("starting admin server at https://%s", ctrl.addr)
+			err = ctrl.server.ListenAndServeTLS("", "")
+		}
+		// always returns error. ErrServerClosed on graceful close
+		if errors.Is(err, http.ErrServerClosed) {
+			ctrl.logger.Info().Msg("admin server stopped")
+		} else {
+			// unexpected error. port in use?
+			ctrl.logger.Error().Err(err).Msgf("admin server on '%s' ended", ctrl.addr)
+		}
+	}()
+}
+
+func (ctrl *controller) Stop() {
+	ctrl.server.Shutdown(context.Background())
+}
+
+// callerContext passes the client certificate of the request to the authorization policy of the miniresolver
+func callerContext(ctx *gin.Context) context.Context {
+	if ctx.Request.TLS == nil || len(ctx.Request.TLS.PeerCertificates) == 0 {
+		return ctx.Request.Context()
+	}
+	return service.NewCertificateContext(ctx.Request.Context(), ctx.Request.TLS.PeerCertificates[0])
+}
+
+// grpcResultMessage maps the grpc status of err to a http status
+func grpcResultMessage(ctx *gin.Context, err error) {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		NewResultMessage(ctx, http.StatusBadRequest, err)
+	case codes.NotFound:
+		NewResultMessage(ctx, http.StatusNotFound, err)
+	case codes.PermissionDenied, codes.Unauthenticated:
+		NewResultMessage(ctx, http.StatusForbidden, err)
+	default:
+		NewResultMessage(ctx, http.StatusInternalServerError, err)
+	}
+}
+
+// ping godoc
+// @Summary      does pong
+// @ID			 get-ping
+// @Description  for testing if server is running
+// @Tags         miniresolver
+// @Produce      plain
+// @Success      200  {string}  string
+// @Router       /ping [get]
+func (ctrl *controller) ping(ctx *gin.Context) {
+	ctx.String(http.StatusOK, "pong")
+}
+
+// listServices godoc
+// @Summary      lists registered services
+// @ID			 get-services
+// @Description  lists all services with their instances, refresh time and health
+// @Tags         miniresolver
+// @Produce      json
+// @Param 		 domain query string false "only services of this domain"
+// @Param 		 prefix query string false "only services starting with prefix"
+// @Param 		 pageSize query int false "number of services per page"
+// @Param 		 pageToken query string false "nextPageToken of the previous page"
+// @Success      200  {object}  ServiceList
+// @Failure      400  {object}  HTTPResultMessage
+// @Failure      500  {object}  HTTPResultMessage
+// @Router       /services [get]
+func (ctrl *controller) listServices(ctx *gin.Context) {
+	var pageSize int64
+	if ps := ctx.Query("pageSize"); ps != "" {
+		var err error
+		if pageSize, err = strconv.ParseInt(ps, 10, 32); err != nil {
+			NewResultMessage(ctx, http.StatusBadRequest, errors.Wrapf(err, "invalid page size '%s'", ps))
+			return
+		}
+	}
+	resp, err := ctrl.mr.ListServices(ctx.Request.Context(), &pb.ListServicesRequest{
+		Domain:    ctx.Query("domain"),
+		Prefix:    ctx.Query("prefix"),
+		PageSize:  int32(pageSize),
+		PageToken: ctx.Query("pageToken"),
+	})
+	if err != nil {
+		grpcResultMessage(ctx, err)
+		return
+	}
+	result := ServiceList{
+		Services:      []Service{},
+		NextPageToken: resp.GetNextPageToken(),
+	}
+	for _, svc := range resp.GetServices() {
+		result.Services = append(result.Services, newService(svc))
+	}
+	ctx.JSON(http.StatusOK, result)
+}
+
+// resolveService godoc
+// @Summary      resolves a service
+// @ID			 get-resolve
+// @Description  returns all available instances of the qualified service name (domain.service)
+// @Tags         miniresolver
+// @Produce      json
+// @Param 		 name path string true "qualified service name"
+// @Param 		 selector query []string false "selector expression (i.e. zone=bs1)" collectionFormat(multi)
+// @Success      200  {array}   Instance
+// @Failure      400  {object}  HTTPResultMessage
+// @Failure      404  {object}  HTTPResultMessage
+// @Failure      500  {object}  HTTPResultMessage
+// @Router       /resolve/{name} [get]
+func (ctrl *controller) resolveService(ctx *gin.Context) {
+	name := ctx.Param("name")
+	query := &pb.ServiceQuery{Name: name}
+	for _, expr := range ctx.QueryArray("selector") {
+		sel, err := selector.Parse(expr)
+		if err != nil {
+			NewResultMessage(ctx, http.StatusBadRequest, err)
+			return
+		}
+		query.Selectors = append(query.Selectors, sel)
+	}
+	resp, err := ctrl.mr.ResolveServices(ctx.Request.Context(), query)
+	if err != nil {
+		grpcResultMessage(ctx, err)
+		return
+	}
+	if len(resp.GetInstances()) == 0 {
+		NewResultMessage(ctx, http.StatusNotFound, errors.Errorf("service '%s' not found", name))
+		return
+	}
+	var result = []Instance{}
+	for _, instance := range resp.GetInstances() {
+		result = append(result, newInstance(instance))
+	}
+	ctx.JSON(http.StatusOK, result)
+}
+
+// registerService godoc
+// @Summary      registers a service instance
+// @ID			 post-services
+// @Description  registers an instance, which expires if it is not refreshed within nextCallWait seconds (needs admin tls with client certificate)
+// @Tags         miniresolver
+// @Accept       json
+// @Produce      json
+// @Param 		 item body Registration true "instance to register"
+// @Success      200  {object}  RegistrationResult
+// @Failure      400  {object}  HTTPResultMessage
+// @Failure      500  {object}  HTTPResultMessage
+// @Router       /services [post]
+func (ctrl *controller) registerService(ctx *gin.Context) {
+	var reg Registration
+	if err := ctx.BindJSON(&reg); err != nil {
+		NewResultMessage(ctx, http.StatusBadRequest, errors.Wrap(err, "cannot bind registration"))
+		return
+	}
+	resp, err := ctrl.mr.AddService(callerContext(ctx), &pb.ServiceData{
+		Service:  reg.Service,
+		Host:     &reg.Host,
+		Port:     reg.Port,
+		Domains:  reg.Domains,
+		Single:   reg.Single,
+		Version:  reg.Version,
+		Zone:     reg.Zone,
+		Tags:     reg.Tags,
+		Metadata: reg.Metadata,
+		Weight:   reg.Weight,
+		Priority: reg.Priority,
+	})
+	if err != nil {
+		grpcResultMessage(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, RegistrationResult{
+		Message:      resp.GetResponse().GetMessage(),
+		NextCallWait: resp.GetNextCallWait(),
+	})
+}
+
+// evictService godoc
+// @Summary      evicts a service instance
+// @ID			 delete-services
+// @Description  removes the instance addr of service from the registry (needs admin tls with client certificate)
+// @Tags         miniresolver
+// @Produce      json
+// @Param 		 service path string true "service name without domain"
+// @Param 		 addr query string true "address of the instance (host:port)"
+// @Param 		 domain query []string false "domain of the service" collectionFormat(multi)
+// @Success      200  {object}  HTTPResultMessage
+// @Failure      400  {object}  HTTPResultMessage
+// @Failure      500  {object}  HTTPResultMessage
+// @Router       /services/{service} [delete]
+func (ctrl *controller) evictService(ctx *gin.Context) {
+	addr := ctx.Query("addr")
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		NewResultMessage(ctx, http.StatusBadRequest, errors.Wrapf(err, "invalid address '%s'", addr))
+		return
+	}
+	portInt, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		NewResultMessage(ctx, http.StatusBadRequest, errors.Wrapf(err, "invalid port in '%s'", addr))
+		return
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		host = fmt.Sprintf("[%s]", host)
+	}
+	resp, err := ctrl.mr.RemoveService(callerContext(ctx), &pb.ServiceData{
+		Service: ctx.Param("service"),
+		Host:    &host,
+		Port:    uint32(portInt),
+		Domains: ctx.QueryArray("domain"),
+	})
+	if err != nil {
+		grpcResultMessage(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, HTTPResultMessage{Code: http.StatusOK, Message: resp.GetMessage()})
+}
+
+func (ctrl *controller) dashboard(ctx *gin.Context) {
+	data, err := staticFS.ReadFile("static/dashboard.html")
+	if err != nil {
+		NewResultMessage(ctx, http.StatusInternalServerError, errors.Wrap(err, "cannot read dashboard"))
+		return
+	}
+	ctx.Data(http.StatusOK, "text/html; charset=utf-8", data)
+}
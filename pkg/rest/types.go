@@ -0,0 +1,84 @@
+package rest
+
+import (
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"time"
+)
+
+type Instance struct {
+	Addr        string            `json:"addr" example:"127.0.0.1:8443"`
+	Version     string            `json:"version,omitempty" example:"1.2.0"`
+	Zone        string            `json:"zone,omitempty" example:"bs1"`
+	Tags        []string          `json:"tags,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Weight      uint32            `json:"weight,omitempty"`
+	Priority    uint32            `json:"priority,omitempty"`
+	Health      string            `json:"health,omitempty" example:"healthy"`
+	Refreshed   *time.Time        `json:"refreshed,omitempty"`
+	Provisional bool              `json:"provisional,omitempty"`
+}
+
+type Service struct {
+	Name      string     `json:"name" example:"ubbasel.mediaserverproto.Database"`
+	Domain    string     `json:"domain" example:"ubbasel"`
+	Service   string     `json:"service" example:"mediaserverproto.Database"`
+	Single    bool       `json:"single,omitempty"`
+	Instances []Instance `json:"instances"`
+}
+
+type ServiceList struct {
+	Services      []Service `json:"services"`
+	NextPageToken string    `json:"nextPageToken,omitempty"`
+}
+
+type Registration struct {
+	Service  string            `json:"service" binding:"required" example:"mediaserverproto.Database"`
+	Host     string            `json:"host" binding:"required" example:"127.0.0.1"`
+	Port     uint32            `json:"port" binding:"required" example:"8443"`
+	Domains  []string          `json:"domains,omitempty"`
+	Single   bool              `json:"single,omitempty"`
+	Version  string            `json:"version,omitempty"`
+	Zone     string            `json:"zone,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Weight   uint32            `json:"weight,omitempty"`
+	Priority uint32            `json:"priority,omitempty"`
+}
+
+type RegistrationResult struct {
+	Message      string `json:"message"`
+	NextCallWait int64  `json:"nextCallWait"`
+}
+
+func newInstance(instance *pb.ServiceInstance) Instance {
+	return Instance{
+		Addr:     instance.GetAddr(),
+		Version:  instance.GetVersion(),
+		Zone:     instance.GetZone(),
+		Tags:     instance.GetTags(),
+		Metadata: instance.GetMetadata(),
+		Weight:   instance.GetWeight(),
+		Priority: instance.GetPriority(),
+	}
+}
+
+func newService(svc *pb.ListedService) Service {
+	s := Service{
+		Name:      svc.GetName(),
+		Domain:    svc.GetDomain(),
+		Service:   svc.GetService(),
+		Single:    svc.GetSingle(),
+		Instances: []Instance{},
+	}
+	for _, listed := range svc.GetInstances() {
+		instance := newInstance(listed.GetInstance())
+		instance.Health = listed.GetHealth()
+		instance.Provisional = listed.GetProvisional()
+		if listed.GetRefreshed() != nil {
+			refreshed := listed.GetRefreshed().AsTime()
+			instance.Refreshed = &refreshed
+		}
+		s.Instances = append(s.Instances, instance)
+	}
+	return s
+}
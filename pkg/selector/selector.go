@@ -0,0 +1,242 @@
+// Package selector parses and evaluates label selectors on service instances.
+//
+// Supported expressions:
+//
+//	zone=bs1, zone==bs1, zone!=bs1
+//	version>=2.1, version>2, version<=3.0, version<3
+//	tag in (canary, beta), zone notin (bs1)
+//	owner (label exists), !owner (label does not exist)
+//
+// The keys "version" and "zone" refer to the instance fields, "tag" to the instance tags
+// and every other key to the instance metadata.
+package selector
+
+import (
+	"emperror.dev/errors"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	OpEqual        = "="
+	OpNotEqual     = "!="
+	OpGreater      = ">"
+	OpGreaterEqual = ">="
+	OpLess         = "<"
+	OpLessEqual    = "<="
+	OpIn           = "in"
+	OpNotIn        = "notin"
+	OpExists       = "exists"
+	OpNotExists    = "!exists"
+)
+
+const (
+	KeyVersion = "version"
+	KeyZone    = "zone"
+	KeyTag     = "tag"
+)
+
+var setRegexp = regexp.MustCompile(`^\s*([a-zA-Z0-9_./-]+)\s+(?i:(in|notin))\s*\(([^)]*)\)\s*$`)
+var compareRegexp = regexp.MustCompile(`^\s*([a-zA-Z0-9_./-]+)\s*(==|!=|>=|<=|=|>|<)\s*(.*?)\s*$`)
+var existsRegexp = regexp.MustCompile(`^\s*(!?)\s*([a-zA-Z0-9_./-]+)\s*$`)
+
+// Parse parses a single selector expression
+func Parse(expr string) (*pb.LabelSelector, error) {
+	if matches := setRegexp.FindStringSubmatch(expr); matches != nil {
+		var values []string
+		for _, v := range strings.Split(matches[3], ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		return &pb.LabelSelector{Key: matches[1], Operator: strings.ToLower(matches[2]), Values: values}, nil
+	}
+	if matches := compareRegexp.FindStringSubmatch(expr); matches != nil {
+		op := matches[2]
+		if op == "==" {
+			op = OpEqual
+		}
+		return &pb.LabelSelector{Key: matches[1], Operator: op, Values: []string{matches[3]}}, nil
+	}
+	if matches := existsRegexp.FindStringSubmatch(expr); matches != nil {
+		op := OpExists
+		if matches[1] == "!" {
+			op = OpNotExists
+		}
+		return &pb.LabelSelector{Key: matches[2], Operator: op}, nil
+	}
+	return nil, errors.Errorf("invalid selector '%s'", expr)
+}
+
+// ParseQuery parses the query part of a target (i.e. "zone=bs1&version>=2.1").
+// every part is a selector expression
+func ParseQuery(rawQuery string) ([]*pb.LabelSelector, error) {
+	var selectors []*pb.LabelSelector
+	for _, part := range strings.Split(rawQuery, "&") {
+		if part == "" {
+			continue
+		}
+		expr, err := url.QueryUnescape(part)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot unescape '%s'", part)
+		}
+		sel, err := Parse(expr)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		selectors = append(selectors, sel)
+	}
+	return selectors, nil
+}
+
+// Query creates the query part of a target from selector expressions
+func Query(exprs ...string) string {
+	parts := make([]string, len(exprs))
+	for i, expr := range exprs {
+		parts[i] = url.QueryEscape(expr)
+	}
+	return strings.Join(parts, "&")
+}
+
+// String returns the expression of the selector
+func String(sel *pb.LabelSelector) string {
+	switch sel.GetOperator() {
+	case OpIn, OpNotIn:
+		return sel.GetKey() + " " + sel.GetOperator() + " (" + strings.Join(sel.GetValues(), ",") + ")"
+	case OpExists:
+		return sel.GetKey()
+	case OpNotExists:
+		return "!" + sel.GetKey()
+	default:
+		return sel.GetKey() + sel.GetOperator() + strings.Join(sel.GetValues(), ",")
+	}
+}
+
+// Validate checks operator and number of values
+func Validate(sel *pb.LabelSelector) error {
+	if sel.GetKey() == "" {
+		return errors.New("selector without key")
+	}
+	switch sel.GetOperator() {
+	case OpEqual, OpNotEqual, OpGreater, OpGreaterEqual, OpLess, OpLessEqual:
+		if len(sel.GetValues()) != 1 {
+			return errors.Errorf("selector '%s' needs exactly one value", String(sel))
+		}
+	case OpIn, OpNotIn:
+		if len(sel.GetValues()) == 0 {
+			return errors.Errorf("selector '%s' needs values", String(sel))
+		}
+	case OpExists, OpNotExists:
+	default:
+		return errors.Errorf("invalid operator '%s' in selector for '%s'", sel.GetOperator(), sel.GetKey())
+	}
+	return nil
+}
+
+// Match checks whether the instance matches all selectors
+func Match(selectors []*pb.LabelSelector, instance *pb.ServiceInstance) bool {
+	for _, sel := range selectors {
+		if !match(sel, instance) {
+			return false
+		}
+	}
+	return true
+}
+
+func labelValues(key string, instance *pb.ServiceInstance) []string {
+	switch key {
+	case KeyVersion:
+		if instance.GetVersion() == "" {
+			return nil
+		}
+		return []string{instance.GetVersion()}
+	case KeyZone:
+		if instance.GetZone() == "" {
+			return nil
+		}
+		return []string{instance.GetZone()}
+	case KeyTag:
+		return instance.GetTags()
+	default:
+		if v, ok := instance.GetMetadata()[key]; ok {
+			return []string{v}
+		}
+		return nil
+	}
+}
+
+func match(sel *pb.LabelSelector, instance *pb.ServiceInstance) bool {
+	values := labelValues(sel.GetKey(), instance)
+	switch sel.GetOperator() {
+	case OpExists:
+		return len(values) > 0
+	case OpNotExists:
+		return len(values) == 0
+	case OpIn, OpEqual:
+		for _, v := range sel.GetValues() {
+			if slices.Contains(values, v) {
+				return true
+			}
+		}
+		return false
+	case OpNotIn, OpNotEqual:
+		for _, v := range sel.GetValues() {
+			if slices.Contains(values, v) {
+				return false
+			}
+		}
+		return true
+	case OpGreater, OpGreaterEqual, OpLess, OpLessEqual:
+		if len(values) == 0 || len(sel.GetValues()) != 1 {
+			return false
+		}
+		cmp := CompareVersions(values[0], sel.GetValues()[0])
+		switch sel.GetOperator() {
+		case OpGreater:
+			return cmp > 0
+		case OpGreaterEqual:
+			return cmp >= 0
+		case OpLess:
+			return cmp < 0
+		default:
+			return cmp <= 0
+		}
+	default:
+		return false
+	}
+}
+
+// CompareVersions compares dotted versions (i.e. "v2.10.1" > "2.9").
+// numeric parts are compared as numbers, all others as strings.
+// missing parts of the shorter version are zero ("2.1" == "2.1.0")
+func CompareVersions(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for len(as) < len(bs) {
+		as = append(as, "0")
+	}
+	for len(bs) < len(as) {
+		bs = append(bs, "0")
+	}
+	for i := 0; i < len(as); i++ {
+		an, aErr := strconv.ParseInt(as[i], 10, 64)
+		bn, bErr := strconv.ParseInt(bs[i], 10, 64)
+		if aErr == nil && bErr == nil {
+			if an != bn {
+				if an < bn {
+					return -1
+				}
+				return 1
+			}
+			continue
+		}
+		if c := strings.Compare(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
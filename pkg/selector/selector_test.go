@@ -0,0 +1,136 @@
+package selector
+
+import (
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"slices"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		expr     string
+		key      string
+		operator string
+		values   []string
+		invalid  bool
+	}{
+		{expr: "zone=bs1", key: "zone", operator: OpEqual, values: []string{"bs1"}},
+		{expr: "zone == bs1", key: "zone", operator: OpEqual, values: []string{"bs1"}},
+		{expr: "zone!=bs1", key: "zone", operator: OpNotEqual, values: []string{"bs1"}},
+		{expr: "version>=2.1", key: "version", operator: OpGreaterEqual, values: []string{"2.1"}},
+		{expr: "version>2", key: "version", operator: OpGreater, values: []string{"2"}},
+		{expr: "version<=3.0", key: "version", operator: OpLessEqual, values: []string{"3.0"}},
+		{expr: "version<3", key: "version", operator: OpLess, values: []string{"3"}},
+		{expr: "tag in (canary, beta)", key: "tag", operator: OpIn, values: []string{"canary", "beta"}},
+		{expr: "zone NOTIN (bs1,)", key: "zone", operator: OpNotIn, values: []string{"bs1"}},
+		{expr: "owner", key: "owner", operator: OpExists},
+		{expr: "! owner", key: "owner", operator: OpNotExists},
+		{expr: "", invalid: true},
+		{expr: "tag in canary", invalid: true},
+		{expr: "a b", invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			sel, err := Parse(tt.expr)
+			if tt.invalid {
+				if err == nil {
+					t.Fatalf("no error for invalid selector, got %v", sel)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("cannot parse: %v", err)
+			}
+			if sel.GetKey() != tt.key || sel.GetOperator() != tt.operator || !slices.Equal(sel.GetValues(), tt.values) {
+				t.Errorf("got %s %s %v, want %s %s %v", sel.GetKey(), sel.GetOperator(), sel.GetValues(), tt.key, tt.operator, tt.values)
+			}
+			if err := Validate(sel); err != nil {
+				t.Errorf("parsed selector invalid: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	exprs := []string{"zone=bs1", "version>=2.1", "tag in (a,b)", "!owner"}
+	selectors, err := ParseQuery(Query(exprs...))
+	if err != nil {
+		t.Fatalf("cannot parse query: %v", err)
+	}
+	var got []string
+	for _, sel := range selectors {
+		got = append(got, String(sel))
+	}
+	want := []string{"zone=bs1", "version>=2.1", "tag in (a,b)", "!owner"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := ParseQuery("zone=bs1&a%20b"); err == nil {
+		t.Error("no error for invalid selector in query")
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"2.1", "2.1", 0},
+		{"2.1", "2.1.0", 0},
+		{"2.1.0", "2.1", 0},
+		{"v2.1", "2.1.0", 0},
+		{"2.1", "2.1.1", -1},
+		{"2.1.1", "2.1", 1},
+		{"2.10", "2.9", 1},
+		{"v2.10.1", "2.9", 1},
+		{"3", "2.9.9", 1},
+		{"2.1.beta", "2.1.alpha", 1},
+		{"2.1.beta", "2.1", 1},
+	}
+	for _, tt := range tests {
+		if got := CompareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	instance := &pb.ServiceInstance{
+		Version:  "2.1",
+		Zone:     "bs1",
+		Tags:     []string{"canary"},
+		Metadata: map[string]string{"owner": "ub"},
+	}
+	tests := []struct {
+		exprs []string
+		want  bool
+	}{
+		{[]string{"zone=bs1"}, true},
+		{[]string{"zone!=bs1"}, false},
+		{[]string{"version>=2.1.0"}, true},
+		{[]string{"version>2.1.0"}, false},
+		{[]string{"version<3"}, true},
+		{[]string{"version<=2.0"}, false},
+		{[]string{"tag in (beta, canary)"}, true},
+		{[]string{"tag notin (canary)"}, false},
+		{[]string{"owner"}, true},
+		{[]string{"!owner"}, false},
+		{[]string{"owner=ub", "zone in (bs1,bs2)", "version>=2"}, true},
+		{[]string{"owner=ub", "zone=bs2"}, false},
+		{[]string{"missing>1"}, false},
+		{nil, true},
+	}
+	for _, tt := range tests {
+		var selectors []*pb.LabelSelector
+		for _, expr := range tt.exprs {
+			sel, err := Parse(expr)
+			if err != nil {
+				t.Fatalf("cannot parse '%s': %v", expr, err)
+			}
+			selectors = append(selectors, sel)
+		}
+		if got := Match(selectors, instance); got != tt.want {
+			t.Errorf("Match(%v) = %v, want %v", tt.exprs, got, tt.want)
+		}
+	}
+}
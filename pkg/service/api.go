@@ -2,38 +2,271 @@ package service
 
 import (
 	"context"
+	"crypto/tls"
 	"emperror.dev/errors"
 	"fmt"
 	"github.com/elazarl/goproxy"
 	pbgeneric "github.com/je4/genericproto/v2/pkg/generic/proto"
 	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"github.com/je4/miniresolver/v2/pkg/selector"
 	"github.com/je4/utils/v2/pkg/zLogger"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
-	"google.golang.org/protobuf/types/known/wrapperspb"
 	"io"
 	"net"
 	"net/http"
 	"time"
 )
 
-func NewMiniResolver(bufferSize int, serviceExpiration time.Duration, proxy string, logger zLogger.ZLogger) *miniResolver {
+type Option func(*miniResolver)
+
+// WithMetrics registers the prometheus metrics of registry, resolution and proxy with registerer
+func WithMetrics(registerer prometheus.Registerer) Option {
+	return func(d *miniResolver) {
+		d.metricsRegisterer = registerer
+	}
+}
+
+// WithSnapshot persists the registry to filename every interval and on Close.
+// an existing snapshot is loaded at startup
+func WithSnapshot(filename string, interval time.Duration) Option {
+	return func(d *miniResolver) {
+		d.snapshotFile = filename
+		d.snapshotInterval = interval
+	}
+}
+
+// WithCluster replicates all mutations to the peers.
+// tlsConfig is the client configuration for the peers and can be nil for insecure connections
+func WithCluster(peers []string, tlsConfig *tls.Config) Option {
+	return func(d *miniResolver) {
+		d.clusterPeers = peers
+		d.clusterTLSConfig = tlsConfig
+	}
+}
+
+// WithHealthCheck enables active health checks of all registered instances.
+// tlsConfig is the client configuration for the instances and can be nil for insecure connections.
+// serviceConfigs overrides defaultConfig per service name
+func WithHealthCheck(tlsConfig *tls.Config, defaultConfig HealthCheckConfig, serviceConfigs map[string]HealthCheckConfig) Option {
+	return func(d *miniResolver) {
+		d.healthCheck = true
+		d.healthTLSConfig = tlsConfig
+		d.healthDefaultConfig = defaultConfig
+		d.healthServiceConfigs = serviceConfigs
+	}
+}
+
+// WithDNS serves SRV, A and AAAA queries for _<service>._tcp.<domain>.<zone> on addr (udp and tcp)
+func WithDNS(addr, zone string) Option {
+	return func(d *miniResolver) {
+		d.dnsAddr = addr
+		d.dnsZone = zone
+	}
+}
+
+// WithPolicy restricts the registration and removal of instances and the replication to callers
+// matching one of the rules. everything else is denied
+func WithPolicy(rules []PolicyRule) Option {
+	return func(d *miniResolver) {
+		d.policyRules = rules
+		d.policyEnabled = true
+	}
+}
+
+// WithLeaseTTL sets the bounds of the lease ttl clients may request.
+// the default is DefaultMinLeaseTTL to serviceExpiration, which is also used without request
+func WithLeaseTTL(minTTL, maxTTL time.Duration) Option {
+	return func(d *miniResolver) {
+		d.leaseMinTTL = minTTL
+		d.leaseMaxTTL = maxTTL
+	}
+}
+
+// WithEventLog keeps the last bufferSize registry events for GetEvents.
+// with auditFile all events are appended to the file as json lines
+func WithEventLog(bufferSize int, auditFile string) Option {
+	return func(d *miniResolver) {
+		d.eventBufferSize = bufferSize
+		d.auditFile = auditFile
+	}
+}
+
+// WithReverseProxy routes http requests on addr by host or first path segment (i.e. /dom.svc/...) to the instances.
+// upstreamTLS is the client configuration for the instances and can be nil for plain http
+func WithReverseProxy(addr string, upstreamTLS *tls.Config) Option {
+	return func(d *miniResolver) {
+		d.reverseProxyAddr = addr
+		d.reverseProxyTLS = upstreamTLS
+	}
+}
+
+// WithSNIProxy routes tls connections on addr by the server name <service>.<domain>.<zone> of the ClientHello
+// to the instances without terminating tls. it is not started with WithProxyAuth
+func WithSNIProxy(addr, zone string) Option {
+	return func(d *miniResolver) {
+		d.sniProxyAddr = addr
+		d.sniProxyZone = zone
+	}
+}
+
+// WithProxyLimits restricts the sessions of the connect, reverse and sni proxies
+func WithProxyLimits(limits ProxyLimits) Option {
+	return func(d *miniResolver) {
+		d.proxyLimits = limits
+	}
+}
+
+// WithProxyTLS serves the proxy via https. client certificates are verified with the ClientCAs of tlsConfig
+func WithProxyTLS(tlsConfig *tls.Config) Option {
+	return func(d *miniResolver) {
+		d.proxyTLS = tlsConfig
+	}
+}
+
+// WithProxyAuth requires a verified client certificate or Proxy-Authorization credentials of users
+// (user -> bcrypt hash of the password) for the proxy and the reverse proxy. clients may only connect to the
+// services allowed by rules, plain http requests to the proxy are denied and the sni proxy is not started
+func WithProxyAuth(users map[string]string, rules []ProxyRule) Option {
+	return func(d *miniResolver) {
+		d.proxyAuthEnabled = true
+		d.proxyUsers = users
+		d.proxyRules = rules
+	}
+}
+
+func NewMiniResolver(bufferSize int, serviceExpiration time.Duration, proxy string, logger zLogger.ZLogger, opts ...Option) *miniResolver {
 	_logger := logger.With().Str("rpcService", "miniResolver").Logger()
-	return &miniResolver{
+	d := &miniResolver{
 		logger:            &_logger,
 		services:          newCache(serviceExpiration, &_logger),
 		serviceExpiration: serviceExpiration,
 		proxyAddr:         proxy,
+		snapshotInterval:  time.Minute,
+		leaseMinTTL:       DefaultMinLeaseTTL,
+		leaseMaxTTL:       serviceExpiration,
+		eventBufferSize:   DefaultEventBufferSize,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	events, err := newEventLog(d.eventBufferSize, d.auditFile, d.logger)
+	if err != nil {
+		d.logger.Error().Err(err).Msgf("cannot create audit log")
+		events, _ = newEventLog(d.eventBufferSize, "", d.logger)
+	}
+	d.events = events
+	d.services.events = events
+	d.leases = newLeases(d.leaseMinTTL, d.leaseMaxTTL, d.expireLease, d.logger)
+	if d.policyEnabled {
+		d.policy = newPolicy(d.policyRules, d.logger)
+	}
+	if d.proxyAuthEnabled {
+		d.proxyAuth = newProxyAuth(d.proxyUsers, d.proxyRules, d.logger)
+	}
+	d.metrics = newMetrics(d.services)
+	d.limiter = newProxyLimiter(d.proxyLimits)
+	d.services.onExpire = func(svcs *serviceEntry, n int) {
+		d.metrics.expired.WithLabelValues(svcs.domain, svcs.name).Add(float64(n))
 	}
+	if d.metricsRegisterer != nil {
+		if err := d.metrics.register(d.metricsRegisterer); err != nil {
+			d.logger.Error().Err(err).Msgf("cannot register metrics")
+		}
+	}
+	if d.snapshotFile != "" {
+		if err := d.services.loadSnapshot(d.snapshotFile); err != nil {
+			d.logger.Error().Err(err).Msgf("cannot load snapshot")
+		}
+		d.services.startSnapshots(d.snapshotFile, d.snapshotInterval)
+	}
+	if d.healthCheck {
+		d.health = newHealthChecker(d.healthTLSConfig, d.healthDefaultConfig, d.healthServiceConfigs, d.services, d.logger)
+		d.health.Start()
+	}
+	if len(d.clusterPeers) > 0 {
+		var err error
+		if d.cluster, err = newCluster(d.clusterPeers, d.clusterTLSConfig, d.services, d.logger); err != nil {
+			d.logger.Error().Err(err).Msgf("cannot create cluster")
+		} else {
+			d.cluster.Start()
+		}
+	}
+	if d.dnsAddr != "" {
+		d.dns = newDNSServer(d.dnsAddr, d.dnsZone, d.services, d.logger)
+		d.dns.Start()
+	}
+	if d.reverseProxyAddr != "" {
+		d.reverseProxy = newReverseProxy(d.reverseProxyAddr, d.reverseProxyTLS, d.services, d.limiter, d.proxyAuth, d.metrics, d.logger)
+		d.reverseProxy.Start()
+	}
+	if d.sniProxyAddr != "" {
+		if d.proxyAuth != nil {
+			// the sni proxy does not terminate tls, so it sees neither client certificates nor credentials
+			d.logger.Error().Msgf("sni proxy on %s not started: it cannot authenticate clients for the proxy rules", d.sniProxyAddr)
+		} else {
+			d.sniProxy = newSNIProxy(d.sniProxyAddr, d.sniProxyZone, d.services, d.limiter, d.metrics, d.logger)
+			if err := d.sniProxy.Start(); err != nil {
+				d.logger.Error().Err(err).Msgf("cannot start sni proxy")
+			}
+		}
+	}
+	return d
 }
 
 type miniResolver struct {
 	pb.UnimplementedMiniResolverServer
-	logger            zLogger.ZLogger
-	services          *cache
-	serviceExpiration time.Duration
-	proxyAddr         string
-	proxyServer       *http.Server
+	logger               zLogger.ZLogger
+	services             *cache
+	serviceExpiration    time.Duration
+	proxyAddr            string
+	proxyServer          *http.Server
+	snapshotFile         string
+	snapshotInterval     time.Duration
+	clusterPeers         []string
+	clusterTLSConfig     *tls.Config
+	cluster              *cluster
+	healthCheck          bool
+	healthTLSConfig      *tls.Config
+	healthDefaultConfig  HealthCheckConfig
+	healthServiceConfigs map[string]HealthCheckConfig
+	health               *healthChecker
+	metrics              *metrics
+	metricsRegisterer    prometheus.Registerer
+	dnsAddr              string
+	dnsZone              string
+	dns                  *dnsServer
+	policyEnabled        bool
+	policyRules          []PolicyRule
+	policy               *policy
+	leaseMinTTL          time.Duration
+	leaseMaxTTL          time.Duration
+	leases               *leases
+	eventBufferSize      int
+	auditFile            string
+	events               *eventLog
+	reverseProxyAddr     string
+	reverseProxyTLS      *tls.Config
+	reverseProxy         *reverseProxy
+	sniProxyAddr         string
+	sniProxyZone         string
+	sniProxy             *sniProxy
+	proxyLimits          ProxyLimits
+	limiter              *proxyLimiter
+	proxyTLS             *tls.Config
+	proxyAuthEnabled     bool
+	proxyUsers           map[string]string
+	proxyRules           []ProxyRule
+	proxyAuth            *proxyAuth
+}
+
+// UnaryServerInterceptor measures the latency of all unary calls of the grpc server
+func (d *miniResolver) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return d.metrics.unaryServerInterceptor
 }
 
 /*
@@ -48,27 +281,138 @@ type miniResolver struct {
 */
 
 func (d *miniResolver) Close() {
+	if d.reverseProxy != nil {
+		d.reverseProxy.Close()
+	}
+	if d.sniProxy != nil {
+		d.sniProxy.Close()
+	}
+	if d.dns != nil {
+		d.dns.Close()
+	}
+	if d.cluster != nil {
+		d.cluster.Close()
+	}
+	if d.snapshotFile != "" {
+		if err := d.services.saveSnapshot(d.snapshotFile); err != nil {
+			d.logger.Error().Err(err).Msgf("cannot write snapshot")
+		}
+	}
+	d.leases.Close()
 	d.services.Close()
+	if err := d.events.Close(); err != nil {
+		d.logger.Error().Err(err).Msgf("cannot close event log")
+	}
+}
+
+// expireLease removes the instances of an expired lease
+func (d *miniResolver) expireLease(id uint64, entries []*pb.ReplicationEntry) {
+	for _, entry := range entries {
+		inst := entryInstance(entry)
+		d.logger.Debug().Msgf("lease %d of '%s.%s' - '%s' expired", id, inst.domain, inst.service, inst.addr)
+		d.services.removeService(inst.service, inst.addr, entry.GetDomains(), pb.EventType_EVENT_LEASE_EXPIRED, fmt.Sprintf("lease %d expired", id), caller{})
+		d.metrics.expired.WithLabelValues(inst.domain, inst.service).Inc()
+		if d.cluster != nil {
+			d.cluster.replicate(&pb.ReplicationEntry{
+				Operation: pb.ReplicationOperation_REPLICATION_REMOVE,
+				Service:   inst.service,
+				Addr:      inst.addr,
+				Domains:   entry.GetDomains(),
+			})
+		}
+	}
+}
+
+// refuseConnect answers a CONNECT, which exceeds the proxy limits, and closes the client
+func (d *miniResolver) refuseConnect(client net.Conn, req *http.Request, err error) {
+	status, reason := refusal(err)
+	d.logger.Debug().Str("proxy", "HijackConnect()").Msgf("connect from %s to %s refused: %v", req.RemoteAddr, req.URL.Host, err)
+	d.metrics.proxySessions.WithLabelValues(resultRejected).Inc()
+	d.metrics.proxyFailures.WithLabelValues(reason).Inc()
+	client.Write([]byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n\r\n", status, http.StatusText(status))))
+	client.Close()
 }
 
 func (d *miniResolver) StartProxy() error {
 	handler := goproxy.NewProxyHttpServer()
 	d.proxyServer = &http.Server{
-		Addr:    d.proxyAddr,
-		Handler: handler,
+		Addr:              d.proxyAddr,
+		Handler:           handler,
+		ReadHeaderTimeout: 30 * time.Second,
+		IdleTimeout:       d.proxyLimits.httpIdleTimeout(),
+	}
+	if d.proxyTLS != nil {
+		d.proxyServer.TLSConfig = d.proxyTLS.Clone()
+		if d.proxyServer.TLSConfig.ClientAuth < tls.VerifyClientCertIfGiven {
+			d.proxyServer.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	} else if d.proxyAuth != nil && len(d.proxyAuth.users) > 0 {
+		d.logger.Warn().Msgf("proxy credentials on %s are sent without tls", d.proxyAddr)
 	}
 	handler.Verbose = true
+	if d.proxyAuth != nil {
+		// the rules cover CONNECT to services only, so plain http requests are denied
+		handler.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			if err := d.limiter.allow(clientIP(req.RemoteAddr)); err != nil {
+				status, reason := refusal(err)
+				d.metrics.proxyFailures.WithLabelValues(reason).Inc()
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeText, status, http.StatusText(status))
+			}
+			if _, ok := d.proxyAuth.authenticate(req); !ok {
+				d.metrics.proxyFailures.WithLabelValues("unauthenticated").Inc()
+				resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusProxyAuthRequired, "proxy authentication required")
+				resp.Header.Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", proxyRealm))
+				return req, resp
+			}
+			d.metrics.proxyFailures.WithLabelValues("plain_http").Inc()
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "only CONNECT to services is allowed")
+		})
+	}
 	handler.OnRequest().HijackConnect(func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
-		addr, _ := d.services.getService(req.URL.Host)
+		if err := d.limiter.allow(clientIP(req.RemoteAddr)); err != nil {
+			d.refuseConnect(client, req, err)
+			return
+		}
+		if d.proxyAuth != nil {
+			ids, ok := d.proxyAuth.authenticate(req)
+			if !ok {
+				d.logger.Debug().Str("proxy", "HijackConnect()").Msgf("unauthenticated connect from %s to %s", req.RemoteAddr, req.URL.Host)
+				d.metrics.proxySessions.WithLabelValues(resultRejected).Inc()
+				d.metrics.proxyFailures.WithLabelValues("unauthenticated").Inc()
+				client.Write([]byte(fmt.Sprintf("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=%q\r\n\r\n", proxyRealm)))
+				client.Close()
+				return
+			}
+			domain, service, found := d.services.serviceOf(req.URL.Host)
+			if !found || !d.proxyAuth.allowed(ids, domain, service) {
+				d.logger.Warn().Strs("identities", ids).Msgf("connect from %s to %s denied", req.RemoteAddr, req.URL.Host)
+				d.metrics.proxySessions.WithLabelValues(resultRejected).Inc()
+				d.metrics.proxyFailures.WithLabelValues("forbidden").Inc()
+				client.Write([]byte("HTTP/1.1 403 Forbidden\r\n\r\n"))
+				client.Close()
+				return
+			}
+		}
+		addr, _ := d.services.getService(req.URL.Host, nil)
 		if addr == "" {
 			d.logger.Debug().Str("proxy", "HijackConnect()").Msgf("service '%s' not found", req.URL.Host)
+			d.metrics.proxySessions.WithLabelValues(resultNotFound).Inc()
+			d.metrics.proxyFailures.WithLabelValues("service_not_found").Inc()
 			client.Write([]byte("HTTP/1.1 404 Service not found\r\n\r\n"))
+			client.Close()
 			return
 		}
+		release, err := d.limiter.acquire(clientIP(req.RemoteAddr), req.URL.Host)
+		if err != nil {
+			d.refuseConnect(client, req, err)
+			return
+		}
+		defer release()
 		d.logger.Debug().Str("proxy", "HijackConnect()").Msgf("proxy connect to %s", req.URL.Host)
 		defer func() {
 			if e := recover(); e != nil {
 				d.logger.Debug().Str("proxy", "HijackConnect()").Msgf("error connecting to remote: %v", e)
+				d.metrics.proxyFailures.WithLabelValues("panic").Inc()
 				client.Write([]byte("HTTP/1.1 500 Cannot reach destination\r\n\r\n"))
 			}
 			client.Close()
@@ -77,33 +421,17 @@ func (d *miniResolver) StartProxy() error {
 		remote, err := net.Dial("tcp", addr)
 		if err != nil {
 			ctx.Logf("error connecting to remote: %v", err)
+			d.metrics.proxySessions.WithLabelValues(resultError).Inc()
+			d.metrics.proxyFailures.WithLabelValues("dial").Inc()
 			client.Write([]byte("HTTP/1.1 500 Cannot reach destination\r\n\r\n"))
 			return
 		}
 		client.Write([]byte("HTTP/1.1 200 Ok\r\n\r\n"))
+		d.metrics.proxySessions.WithLabelValues(resultOK).Inc()
 
 		//remoteBuf := bufio.NewReadWriter(bufio.NewReader(remote), bufio.NewWriter(remote))
 
-		done := make(chan bool)
-
-		go func() {
-			if _, err := io.Copy(client, remote); err != nil {
-				d.logger.Debug().Str("proxy", "HijackConnect()").Msgf("error copying from remote to client: %v", err)
-			}
-			defer client.Close()
-			done <- true
-		}()
-
-		go func() {
-			if _, err := io.Copy(remote, client); err != nil {
-				d.logger.Debug().Str("proxy", "HijackConnect()").Msgf("error copying from client to remote: %v", err)
-			}
-			defer remote.Close()
-			done <- true
-		}()
-
-		<-done
-		<-done
+		splice(client, remote, d.proxyLimits, d.metrics, d.logger)
 
 		/*
 			for {
@@ -140,7 +468,13 @@ func (d *miniResolver) StartProxy() error {
 	})
 	go func() {
 		d.logger.Debug().Str("proxy", "HijackConnect()").Msgf("starting proxy on %s", d.proxyAddr)
-		if err := d.proxyServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		var err error
+		if d.proxyServer.TLSConfig != nil {
+			err = d.proxyServer.ListenAndServeTLS("", "")
+		} else {
+			err = d.proxyServer.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			d.logger.Error().Str("proxy", "HijackConnect()").Msgf("cannot start proxy: %v", err)
 		}
 	}()
@@ -165,83 +499,361 @@ func (d *miniResolver) Ping(context.Context, *emptypb.Empty) (*pbgeneric.Default
 	}, nil
 }
 
+// instanceAddress returns host:port of the registration. without host the address of the caller is used
+func instanceAddress(ctx context.Context, data *pb.ServiceData) (string, error) {
+	if data.GetHost() != "" {
+		return fmt.Sprintf("%s:%d", data.GetHost(), data.GetPort()), nil
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", fmt.Errorf("cannot get peer")
+	}
+	peerAddr := p.Addr.String()
+	host, _, err := net.SplitHostPort(peerAddr)
+	if err != nil {
+		return "", fmt.Errorf("cannot split host port of '%s': %v", peerAddr, err)
+	}
+	ip := net.ParseIP(host)
+	if ip.To4() == nil {
+		host = fmt.Sprintf("[%s]", host)
+	}
+	return fmt.Sprintf("%s:%d", host, data.GetPort()), nil
+}
+
 func (d *miniResolver) AddService(ctx context.Context, data *pb.ServiceData) (*pb.ResolverDefaultResponse, error) {
+	result := resultError
+	defer func() { d.metrics.request("AddService", d.serviceLabel(data.GetService(), data.GetDomains()), result) }()
 	d.logger.Debug().Msgf("add service '%v.%s' - '%s:%d'", data.GetDomains(), data.GetService(), data.GetHost(), data.GetPort())
+	if err := d.policy.authorize(ctx, "AddService", data.GetService(), data.GetDomains()); err != nil {
+		return nil, err
+	}
 
-	var address = fmt.Sprintf("%s:%d", data.GetHost(), data.GetPort())
-	if data.GetHost() == "" {
-		p, ok := peer.FromContext(ctx)
-		if !ok {
-			return nil, fmt.Errorf("cannot get peer")
-		}
-		peerAddr := p.Addr.String()
-		host, _, err := net.SplitHostPort(peerAddr)
-		if err != nil {
-			return nil, fmt.Errorf("cannot split host port of '%s': %v", peerAddr, err)
-		}
-		ip := net.ParseIP(host)
-		if ip.To4() == nil {
-			host = fmt.Sprintf("[%s]", host)
-		}
-		address = fmt.Sprintf("%s:%d", host, data.GetPort())
+	address, err := instanceAddress(ctx, data)
+	if err != nil {
+		return nil, err
 	}
 	waitSeconds := int64((d.serviceExpiration.Seconds() * 2.0) / 3.0)
-	d.services.addService(data.GetService(), address, data.GetDomains(), data.GetSingle())
+	instance := &pb.ServiceInstance{
+		Addr:     address,
+		Version:  data.GetVersion(),
+		Zone:     data.GetZone(),
+		Tags:     data.GetTags(),
+		Metadata: data.GetMetadata(),
+		Weight:   data.GetWeight(),
+		Priority: data.GetPriority(),
+	}
+	cl := callerOf(ctx)
+	d.services.addService(data.GetService(), instance, data.GetDomains(), data.GetSingle(), time.Now(), cl)
+	domains := data.GetDomains()
+	if len(domains) == 0 {
+		domains = []string{""}
+	}
+	var entries []*pb.ReplicationEntry
+	for _, domain := range domains {
+		entries = append(entries, &pb.ReplicationEntry{
+			Operation:  pb.ReplicationOperation_REPLICATION_ADD,
+			Service:    data.GetService(),
+			Addr:       address,
+			Domains:    []string{domain},
+			Single:     data.GetSingle(),
+			Instance:   instance,
+			Identities: cl.identities,
+		})
+	}
+	leaseID, ttl := d.leases.grant(data.GetLeaseID(), time.Duration(data.GetTtl())*time.Second, entries)
+	for _, domain := range domains {
+		d.services.setLeased(data.GetService(), domain, address)
+	}
+	if d.cluster != nil {
+		d.cluster.replicate(&pb.ReplicationEntry{
+			Operation:  pb.ReplicationOperation_REPLICATION_ADD,
+			Service:    data.GetService(),
+			Addr:       address,
+			Domains:    data.GetDomains(),
+			Single:     data.GetSingle(),
+			Instance:   instance,
+			Identities: cl.identities,
+		})
+	}
 	d.logger.Debug().Msgf("service '%s' - '%s' added", data.Service, address)
+	result = resultOK
 	return &pb.ResolverDefaultResponse{
 		Response: &pbgeneric.DefaultResponse{
 			Status:  pbgeneric.ResultStatus_OK,
 			Message: fmt.Sprintf("service '%v.%s' - '%s' added", data.Domains, data.Service, address),
 		},
 		NextCallWait: waitSeconds,
+		LeaseID:      leaseID,
+		Ttl:          int64(ttl.Seconds()),
 	}, nil
 }
 
 func (d *miniResolver) RemoveService(ctx context.Context, data *pb.ServiceData) (*pbgeneric.DefaultResponse, error) {
+	result := resultError
+	label := d.serviceLabel(data.GetService(), data.GetDomains())
+	defer func() { d.metrics.request("RemoveService", label, result) }()
 	d.logger.Debug().Msgf("remove service '%s' - '%s:%d'", data.Service, data.GetHost(), data.GetPort())
+	if err := d.policy.authorize(ctx, "RemoveService", data.GetService(), data.GetDomains()); err != nil {
+		return nil, err
+	}
 
-	var address = fmt.Sprintf("%s:%d", data.GetHost(), data.GetPort())
-	if data.GetHost() == "" {
-		p, ok := peer.FromContext(ctx)
-		if !ok {
-			return nil, fmt.Errorf("cannot get peer")
-		}
-		peerAddr := p.Addr.String()
-		host, _, err := net.SplitHostPort(peerAddr)
-		if err != nil {
-			return nil, fmt.Errorf("cannot split host port of '%s': %v", peerAddr, err)
-		}
-		ip := net.ParseIP(host)
-		if ip.To4() == nil {
-			host = fmt.Sprintf("[%s]", host)
-		}
-		address = fmt.Sprintf("%s:%d", host, data.GetPort())
+	address, err := instanceAddress(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	cl := callerOf(ctx)
+	d.services.removeService(data.Service, address, data.Domains, pb.EventType_EVENT_REMOVED, "", cl)
+	domains := data.GetDomains()
+	if len(domains) == 0 {
+		domains = []string{""}
+	}
+	for _, domain := range domains {
+		d.leases.detach(leaseInstance{service: data.GetService(), domain: domain, addr: address})
+	}
+	if d.cluster != nil {
+		d.cluster.replicate(&pb.ReplicationEntry{
+			Operation:  pb.ReplicationOperation_REPLICATION_REMOVE,
+			Service:    data.GetService(),
+			Addr:       address,
+			Domains:    data.GetDomains(),
+			Identities: cl.identities,
+		})
 	}
-	d.services.removeService(data.Service, address, data.Domains)
 	d.logger.Debug().Msgf("service '%s' - '%s' removed", data.Service, address)
+	result = resultOK
 	return &pbgeneric.DefaultResponse{
 		Status:  pbgeneric.ResultStatus_OK,
 		Message: fmt.Sprintf("service '%s' - '%s' removed", data.Service, address),
 	}, nil
 }
 
-func (d *miniResolver) ResolveServices(ctx context.Context, data *wrapperspb.StringValue) (*pb.ServicesResponse, error) {
-	addrs, ncw := d.services.getServices(data.Value)
-	d.logger.Debug().Msgf("resolve services '%s': %d found", data.Value, len(addrs))
+// DrainService withdraws the instance from resolution. watchers are notified immediately,
+// the instance stays registered until it is removed or its lease expires
+func (d *miniResolver) DrainService(ctx context.Context, data *pb.ServiceData) (*pbgeneric.DefaultResponse, error) {
+	result := resultError
+	defer func() {
+		d.metrics.request("DrainService", d.serviceLabel(data.GetService(), data.GetDomains()), result)
+	}()
+	d.logger.Debug().Msgf("drain service '%v.%s' - '%s:%d'", data.GetDomains(), data.GetService(), data.GetHost(), data.GetPort())
+	if err := d.policy.authorize(ctx, "DrainService", data.GetService(), data.GetDomains()); err != nil {
+		return nil, err
+	}
+	address, err := instanceAddress(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	cl := callerOf(ctx)
+	if !d.services.drainService(data.GetService(), address, data.GetDomains(), cl) {
+		result = resultNotFound
+		return nil, status.Errorf(codes.NotFound, "service '%v.%s' - '%s' not found", data.GetDomains(), data.GetService(), address)
+	}
+	if d.cluster != nil {
+		d.cluster.replicate(&pb.ReplicationEntry{
+			Operation:  pb.ReplicationOperation_REPLICATION_DRAIN,
+			Service:    data.GetService(),
+			Addr:       address,
+			Domains:    data.GetDomains(),
+			Identities: cl.identities,
+		})
+	}
+	d.logger.Info().Msgf("service '%v.%s' - '%s' draining", data.GetDomains(), data.GetService(), address)
+	result = resultOK
+	return &pbgeneric.DefaultResponse{
+		Status:  pbgeneric.ResultStatus_OK,
+		Message: fmt.Sprintf("service '%v.%s' - '%s' draining", data.GetDomains(), data.GetService(), address),
+	}, nil
+}
+
+// serviceLabel returns the name for the request metrics, if the service is registered
+func (d *miniResolver) serviceLabel(name string, domains []string) string {
+	if !d.services.registered(name, domains) {
+		return unknownService
+	}
+	return name
+}
+
+// validateQuery checks the selectors of a service query
+func validateQuery(data *pb.ServiceQuery) error {
+	for _, sel := range data.GetSelectors() {
+		if err := selector.Validate(sel); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid query for service '%s': %v", data.GetName(), err)
+		}
+	}
+	return nil
+}
+
+func (d *miniResolver) ResolveServices(ctx context.Context, data *pb.ServiceQuery) (*pb.ServicesResponse, error) {
+	if err := validateQuery(data); err != nil {
+		return nil, err
+	}
+	instances, ncw := d.services.getServices(data.GetName(), data.GetSelectors())
+	d.logger.Debug().Msgf("resolve services '%s': %d found", data.GetName(), len(instances))
+	if len(instances) == 0 {
+		d.metrics.request("ResolveServices", d.serviceLabel(data.GetName(), nil), resultNotFound)
+	} else {
+		d.metrics.request("ResolveServices", data.GetName(), resultOK)
+	}
 	return &pb.ServicesResponse{
-		Addrs:        addrs,
+		Addrs:        instanceAddrs(instances),
 		NextCallWait: int64(ncw.Seconds()),
+		Instances:    instances,
 	}, nil
 }
 
-func (d *miniResolver) ResolveService(ctx context.Context, data *wrapperspb.StringValue) (*pb.ServiceResponse, error) {
-	addr, ncw := d.services.getService(data.Value)
-	d.logger.Debug().Msgf("resolve service '%s' - %s", data.Value, addr)
+func (d *miniResolver) ResolveService(ctx context.Context, data *pb.ServiceQuery) (*pb.ServiceResponse, error) {
+	if err := validateQuery(data); err != nil {
+		d.metrics.request("ResolveService", d.serviceLabel(data.GetName(), nil), resultError)
+		return nil, err
+	}
+	addr, ncw := d.services.getService(data.GetName(), data.GetSelectors())
+	d.logger.Debug().Msgf("resolve service '%s' - %s", data.GetName(), addr)
 	if addr == "" {
-		return nil, fmt.Errorf("service '%s' not found", data.Value)
+		d.metrics.request("ResolveService", d.serviceLabel(data.GetName(), nil), resultNotFound)
+		return nil, fmt.Errorf("service '%s' not found", data.GetName())
 	}
+	d.metrics.request("ResolveService", data.GetName(), resultOK)
 	return &pb.ServiceResponse{
 		Addr:         addr,
 		NextCallWait: int64(ncw.Seconds()),
 	}, nil
 }
+
+func (d *miniResolver) WatchService(data *pb.ServiceQuery, stream pb.MiniResolver_WatchServiceServer) error {
+	if err := validateQuery(data); err != nil {
+		return err
+	}
+	d.logger.Debug().Msgf("watch service '%s'", data.GetName())
+	ch, cancel := d.services.watch(data.GetName(), data.GetSelectors())
+	defer cancel()
+	for {
+		select {
+		case instances := <-ch:
+			d.logger.Debug().Msgf("watch service '%s': %d found", data.GetName(), len(instances))
+			if err := stream.Send(&pb.ServicesResponse{
+				Addrs:     instanceAddrs(instances),
+				Instances: instances,
+			}); err != nil {
+				return errors.Wrapf(err, "cannot send addresses of '%s'", data.GetName())
+			}
+		case <-stream.Context().Done():
+			d.logger.Debug().Msgf("watch service '%s' ended", data.GetName())
+			return nil
+		}
+	}
+}
+
+const (
+	defaultListPageSize = 100
+	maxListPageSize     = 1000
+)
+
+func (d *miniResolver) ListServices(ctx context.Context, data *pb.ListServicesRequest) (*pb.ListServicesResponse, error) {
+	pageSize := int(data.GetPageSize())
+	switch {
+	case pageSize < 0:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid page size %d", pageSize)
+	case pageSize == 0:
+		pageSize = defaultListPageSize
+	case pageSize > maxListPageSize:
+		pageSize = maxListPageSize
+	}
+	services, nextPageToken := d.services.listServices(data.GetDomain(), data.GetPrefix(), data.GetPageToken(), pageSize)
+	d.logger.Debug().Msgf("list services (domain '%s', prefix '%s'): %d found", data.GetDomain(), data.GetPrefix(), len(services))
+	return &pb.ListServicesResponse{
+		Services:      services,
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+func (d *miniResolver) Replicate(ctx context.Context, data *pb.ReplicationBatch) (*pbgeneric.DefaultResponse, error) {
+	if err := d.policy.authorizeReplication(ctx); err != nil {
+		return nil, err
+	}
+	for _, entry := range data.GetEntries() {
+		cl := caller{identities: entry.GetIdentities(), replicated: true}
+		switch entry.GetOperation() {
+		case pb.ReplicationOperation_REPLICATION_ADD:
+			instance := entry.GetInstance()
+			if instance == nil {
+				instance = &pb.ServiceInstance{}
+			}
+			instance.Addr = entry.GetAddr()
+			// the full sync keeps the refresh time of the origin, so the instance expires there and here at the same time
+			refreshed := time.Now()
+			if updated := entry.GetUpdated(); updated != nil {
+				// stale state of a peer, which missed the removal or expiration
+				if time.Since(updated.AsTime()) >= d.serviceExpiration || d.services.removedAfter(entry.GetService(), entry.GetAddr(), entry.GetDomains(), updated.AsTime()) {
+					d.logger.Debug().Msgf("ignoring stale replication of '%v.%s' - '%s' from %v", entry.GetDomains(), entry.GetService(), entry.GetAddr(), updated.AsTime())
+					continue
+				}
+				refreshed = updated.AsTime()
+			}
+			d.services.addService(entry.GetService(), instance, entry.GetDomains(), entry.GetSingle(), refreshed, cl)
+		case pb.ReplicationOperation_REPLICATION_REMOVE:
+			d.services.removeService(entry.GetService(), entry.GetAddr(), entry.GetDomains(), pb.EventType_EVENT_REMOVED, "", cl)
+		case pb.ReplicationOperation_REPLICATION_DRAIN:
+			d.services.drainService(entry.GetService(), entry.GetAddr(), entry.GetDomains(), cl)
+		default:
+			return nil, fmt.Errorf("unknown replication operation %v", entry.GetOperation())
+		}
+	}
+	d.logger.Debug().Msgf("%d entries replicated", len(data.GetEntries()))
+	return &pbgeneric.DefaultResponse{
+		Status:  pbgeneric.ResultStatus_OK,
+		Message: fmt.Sprintf("%d entries replicated", len(data.GetEntries())),
+	}, nil
+}
+
+// KeepAlive renews the leases of all received requests. an expired lease is answered with ttl 0,
+// the client has to register its instances again
+func (d *miniResolver) KeepAlive(stream pb.MiniResolver_KeepAliveServer) error {
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) || stream.Context().Err() != nil {
+				return nil
+			}
+			return errors.Wrap(err, "cannot receive keepalive")
+		}
+		ttl, entries := d.leases.keepAlive(req.GetLeaseID())
+		if ttl == 0 {
+			d.logger.Debug().Msgf("keepalive of unknown lease %d", req.GetLeaseID())
+		} else {
+			d.services.touch(entries)
+			if d.cluster != nil {
+				// peers expire the instances by their serviceExpiration
+				for _, entry := range entries {
+					d.cluster.replicate(entry)
+				}
+			}
+		}
+		if err := stream.Send(&pb.KeepAliveResponse{
+			LeaseID: req.GetLeaseID(),
+			Ttl:     int64(ttl.Seconds()),
+		}); err != nil {
+			return errors.Wrapf(err, "cannot send keepalive of lease %d", req.GetLeaseID())
+		}
+	}
+}
+
+// GetEvents returns the buffered registry events after the requested sequence
+func (d *miniResolver) GetEvents(ctx context.Context, data *pb.GetEventsRequest) (*pb.GetEventsResponse, error) {
+	if data.GetLimit() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid limit %d", data.GetLimit())
+	}
+	events, first, last := d.events.get(data.GetAfterSequence(), int(data.GetLimit()), data.GetService())
+	d.logger.Debug().Msgf("get events after %d: %d found", data.GetAfterSequence(), len(events))
+	return &pb.GetEventsResponse{
+		Events:        events,
+		LastSequence:  last,
+		FirstSequence: first,
+	}, nil
+}
+
+func instanceAddrs(instances []*pb.ServiceInstance) []string {
+	addrs := make([]string, len(instances))
+	for i, instance := range instances {
+		addrs[i] = instance.GetAddr()
+	}
+	return addrs
+}
@@ -1,8 +1,15 @@
 package service
 
 import (
+	"fmt"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"github.com/je4/miniresolver/v2/pkg/selector"
 	"github.com/je4/utils/v2/pkg/zLogger"
 	"golang.org/x/exp/maps"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 )
@@ -11,26 +18,49 @@ const minNextCallTimeout = 10 * time.Second
 
 func newCache(timeout time.Duration, logger zLogger.ZLogger) *cache {
 	c := &cache{
-		Mutex:    sync.Mutex{},
-		timeout:  timeout,
-		services: make(map[string]*serviceEntry),
-		logger:   logger,
-		done:     make(chan bool),
+		Mutex:      sync.Mutex{},
+		timeout:    timeout,
+		services:   make(map[string]*serviceEntry),
+		watchers:   make(map[string]map[*watcher]bool),
+		tombstones: make(map[tombstone]time.Time),
+		logger:     logger,
+		done:       make(chan bool),
 	}
 	c.Start()
 	return c
 }
 
+// watcher receives the instances of a service which match its selectors
+type watcher struct {
+	ch        chan []*pb.ServiceInstance
+	selectors []*pb.LabelSelector
+}
+
+// tombstone is an explicitly removed address, which is sent to the cluster peers by the full sync
+type tombstone struct {
+	domain, name, addr string
+}
+
 type cache struct {
 	sync.Mutex
-	timeout  time.Duration
-	services map[string]*serviceEntry
-	logger   zLogger.ZLogger
-	done     chan bool
+	timeout      time.Duration
+	services     map[string]*serviceEntry
+	watchers     map[string]map[*watcher]bool
+	tombstones   map[tombstone]time.Time // time of the removal
+	logger       zLogger.ZLogger
+	done         chan bool
+	snapshotLock sync.Mutex
+	onExpire     func(svcs *serviceEntry, n int)
+	events       *eventLog
+}
+
+// event records a change of the address of svcs. lock must be held by caller
+func (c *cache) event(eventType pb.EventType, svcs *serviceEntry, addr, reason string, cl caller) {
+	c.events.record(eventType, svcs.domain, svcs.name, addr, reason, cl)
 }
 
 func (c *cache) Close() {
-	c.done <- true
+	close(c.done)
 	c.Lock()
 	defer c.Unlock()
 	for _, svcs := range c.services {
@@ -43,7 +73,7 @@ func (c *cache) Start() {
 		for {
 			select {
 			case <-time.After(time.Minute):
-				c.removeUnavailable()
+				c.removeExpired()
 			case <-c.done:
 				return
 			}
@@ -51,7 +81,9 @@ func (c *cache) Start() {
 	}()
 }
 
-func (c *cache) addService(name, addr string, domains []string, single bool) {
+// addService registers the address of instance as refreshed at the given time
+func (c *cache) addService(name string, instance *pb.ServiceInstance, domains []string, single bool, refreshed time.Time, cl caller) {
+	addr := instance.GetAddr()
 	c.Lock()
 	defer c.Unlock()
 	if len(domains) == 0 {
@@ -62,18 +94,31 @@ func (c *cache) addService(name, addr string, domains []string, single bool) {
 		if domain != "" {
 			serviceName = domain + "." + name
 		}
+		delete(c.tombstones, tombstone{domain: domain, name: name, addr: addr})
 		svcs, ok := c.services[serviceName]
 		if ok {
-			if !svcs.refreshAddress(addr) {
+			svcs.single = single
+			if svcs.refreshAddress(instance, refreshed) {
+				c.event(pb.EventType_EVENT_REFRESHED, svcs, addr, "", cl)
+			} else {
 				if single {
+					for _, old := range svcs.getAddresses() {
+						c.event(pb.EventType_EVENT_REPLACED, svcs, old, fmt.Sprintf("single registration of %s", addr), cl)
+						c.tombstones[tombstone{domain: domain, name: name, addr: old}] = time.Now()
+					}
 					svcs.Clear()
 				}
-				svcs.addAddress(addr)
+				svcs.addAddress(instance, refreshed)
+				c.event(pb.EventType_EVENT_REGISTERED, svcs, addr, "", cl)
+				c.notify(serviceName)
 			}
 		} else {
-			svcs = NewServiceEntry(serviceName, c.logger)
-			svcs.addAddress(addr)
+			svcs = NewServiceEntry(domain, name, c.logger)
+			svcs.single = single
+			svcs.addAddress(instance, refreshed)
 			c.services[serviceName] = svcs
+			c.event(pb.EventType_EVENT_REGISTERED, svcs, addr, "", cl)
+			c.notify(serviceName)
 		}
 
 		c.logger.Debug().Msgf("service address added %s: %v", serviceName, addr)
@@ -87,54 +132,397 @@ func (c *cache) addService(name, addr string, domains []string, single bool) {
 	}
 }
 
-func (c *cache) removeService(name, addr string, domains []string) {
+// removeService removes the address. eventType and reason are recorded as cause of the removal
+func (c *cache) removeService(name, addr string, domains []string, eventType pb.EventType, reason string, cl caller) {
 	c.Lock()
 	defer c.Unlock()
 	if len(domains) == 0 {
 		domains = []string{""}
 	}
 	for _, domain := range domains {
+		serviceName := name
 		if domain != "" {
-			name = domain + "." + name
+			serviceName = domain + "." + name
 		}
-		svcs, ok := c.services[name]
+		svcs, ok := c.services[serviceName]
 		if !ok {
-			return
+			c.tombstones[tombstone{domain: domain, name: name, addr: addr}] = time.Now()
+			continue
 		}
-		svcs.removeAddress(addr)
-		if len(svcs.addresses) == 0 {
-			delete(c.services, name)
+		c.removeAddress(svcs, addr, eventType, reason, cl)
+		c.notify(serviceName)
+	}
+}
+
+// removeAddress removes the address from svcs, records the tombstone and deletes the empty entry.
+// the watchers are not notified. lock must be held by caller
+func (c *cache) removeAddress(svcs *serviceEntry, addr string, eventType pb.EventType, reason string, cl caller) {
+	c.tombstones[tombstone{domain: svcs.domain, name: svcs.name, addr: addr}] = time.Now()
+	if _, ok := svcs.addresses[addr]; ok {
+		c.event(eventType, svcs, addr, reason, cl)
+	}
+	svcs.removeAddress(addr)
+	if len(svcs.addresses) == 0 {
+		delete(c.services, svcs.service)
+	}
+}
+
+// removedAfter reports whether the address was removed from one of the domains after t
+func (c *cache) removedAfter(name, addr string, domains []string, t time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+	if len(domains) == 0 {
+		domains = []string{""}
+	}
+	for _, domain := range domains {
+		if removed, ok := c.tombstones[tombstone{domain: domain, name: name, addr: addr}]; ok && removed.After(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// registered reports whether the service has instances in one of the domains
+func (c *cache) registered(name string, domains []string) bool {
+	c.Lock()
+	defer c.Unlock()
+	if len(domains) == 0 {
+		domains = []string{""}
+	}
+	for _, domain := range domains {
+		serviceName := name
+		if domain != "" {
+			serviceName = domain + "." + name
+		}
+		if _, ok := c.services[serviceName]; ok {
+			return true
 		}
 	}
+	return false
 }
 
-func (c *cache) getServices(name string) ([]string, time.Duration) {
+// drainService withdraws the address from resolution and notifies the watchers.
+// returns false, if the address is not registered
+func (c *cache) drainService(name, addr string, domains []string, cl caller) bool {
+	c.Lock()
+	defer c.Unlock()
+	if len(domains) == 0 {
+		domains = []string{""}
+	}
+	var found bool
+	for _, domain := range domains {
+		serviceName := name
+		if domain != "" {
+			serviceName = domain + "." + name
+		}
+		svcs, ok := c.services[serviceName]
+		if !ok {
+			continue
+		}
+		h, ok := svcs.health[addr]
+		if !ok {
+			continue
+		}
+		found = true
+		if h.state != InstanceDraining {
+			h.state = InstanceDraining
+			c.event(pb.EventType_EVENT_DRAINING, svcs, addr, "", cl)
+			c.notify(serviceName)
+		}
+	}
+	return found
+}
+
+func (c *cache) getServices(name string, selectors []*pb.LabelSelector) ([]*pb.ServiceInstance, time.Duration) {
 	c.Lock()
 	defer c.Unlock()
 	svcs, ok := c.services[name]
 	if !ok {
-		return []string{}, minNextCallTimeout
+		return []*pb.ServiceInstance{}, minNextCallTimeout
 	}
-	return svcs.getAddresses(c.timeout), svcs.nextCallTimeout()
+	if c.removeOld(svcs) {
+		c.notify(name)
+	}
+	return filterInstances(svcs.getAvailableInstances(), selectors), svcs.nextCallTimeout()
+}
+
+// getServicesFold resolves the qualified service name case-insensitively like dns names.
+// ok is false, if the service is not registered
+func (c *cache) getServicesFold(name string) (instances []*pb.ServiceInstance, ncw time.Duration, ok bool) {
+	c.Lock()
+	name, ok = c.foldName(name)
+	c.Unlock()
+	if !ok {
+		return nil, minNextCallTimeout, false
+	}
+	instances, ncw = c.getServices(name, nil)
+	return instances, ncw, true
+}
+
+// getServiceFold selects an address of the case-insensitive qualified service name like getService
+func (c *cache) getServiceFold(name string) string {
+	c.Lock()
+	name, ok := c.foldName(name)
+	c.Unlock()
+	if !ok {
+		return ""
+	}
+	addr, _ := c.getService(name, nil)
+	return addr
 }
 
-func (c *cache) getService(name string) (string, time.Duration) {
+// serviceOf returns domain and service name of the registered qualified name, which is matched case-insensitively
+func (c *cache) serviceOf(name string) (domain, service string, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	name, ok = c.foldName(name)
+	if !ok {
+		return "", "", false
+	}
+	svcs := c.services[name]
+	return svcs.domain, svcs.name, true
+}
+
+// foldName returns the registered service name, which matches name case-insensitively
+// lock must be held by caller
+func (c *cache) foldName(name string) (string, bool) {
+	if _, ok := c.services[name]; ok {
+		return name, true
+	}
+	for n := range c.services {
+		if strings.EqualFold(n, name) {
+			return n, true
+		}
+	}
+	return "", false
+}
+
+func (c *cache) getService(name string, selectors []*pb.LabelSelector) (string, time.Duration) {
 	c.Lock()
 	defer c.Unlock()
 	svcs, ok := c.services[name]
 	if !ok {
 		return "", minNextCallTimeout
 	}
-	return svcs.getAddress(c.timeout)
+	if c.removeOld(svcs) {
+		c.notify(name)
+	}
+	return svcs.getAddress(selectors)
+}
+
+// setLeased marks the address of the service in domain as managed by a lease
+func (c *cache) setLeased(name, domain, addr string) {
+	c.Lock()
+	defer c.Unlock()
+	if domain != "" {
+		name = domain + "." + name
+	}
+	if svcs, ok := c.services[name]; ok {
+		if _, ok := svcs.addresses[addr]; ok {
+			svcs.leased[addr] = true
+		}
+	}
+}
+
+// touch refreshes the addresses of the registrations (one domain each) without changing them
+func (c *cache) touch(entries []*pb.ReplicationEntry) {
+	c.Lock()
+	defer c.Unlock()
+	for _, entry := range entries {
+		inst := entryInstance(entry)
+		name := inst.service
+		if inst.domain != "" {
+			name = inst.domain + "." + name
+		}
+		if svcs, ok := c.services[name]; ok {
+			if _, ok := svcs.addresses[inst.addr]; ok {
+				svcs.addresses[inst.addr] = time.Now()
+			}
+		}
+	}
+}
+
+// removeOld removes the expired addresses of svcs and reports whether there were any
+// lock must be held by caller
+func (c *cache) removeOld(svcs *serviceEntry) bool {
+	olds := svcs.removeOld(c.timeout)
+	if len(olds) == 0 {
+		return false
+	}
+	for _, addr := range olds {
+		c.event(pb.EventType_EVENT_EXPIRED, svcs, addr, fmt.Sprintf("not refreshed within %v", c.timeout), caller{})
+	}
+	if c.onExpire != nil {
+		c.onExpire(svcs, len(olds))
+	}
+	return true
+}
+
+func (c *cache) removeExpired() {
+	c.Lock()
+	defer c.Unlock()
+	for name, svcs := range c.services {
+		if c.removeOld(svcs) {
+			c.notify(name)
+		}
+	}
+	c.removeOldTombstones()
+}
+
+// removeOldTombstones forgets removals older than the service expiration, since the peers
+// have expired these addresses by themselves. lock must be held by caller
+func (c *cache) removeOldTombstones() {
+	for ts, removed := range c.tombstones {
+		if time.Since(removed) >= c.timeout {
+			delete(c.tombstones, ts)
+		}
+	}
+}
+
+// listServices returns the services of domain starting with prefix in the order of their qualified names.
+// the page starts after the qualified name pageToken. nextPageToken is empty on the last page
+func (c *cache) listServices(domain, prefix, pageToken string, pageSize int) ([]*pb.ListedService, string) {
+	c.Lock()
+	defer c.Unlock()
+	names := make([]string, 0, len(c.services))
+	for name, svcs := range c.services {
+		if domain != "" && svcs.domain != domain {
+			continue
+		}
+		if !strings.HasPrefix(svcs.name, prefix) {
+			continue
+		}
+		if pageToken != "" && name <= pageToken {
+			continue
+		}
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var nextPageToken string
+	if pageSize > 0 && len(names) > pageSize {
+		names = names[:pageSize]
+		nextPageToken = names[pageSize-1]
+	}
+	var result = []*pb.ListedService{}
+	for _, name := range names {
+		svcs := c.services[name]
+		listed := &pb.ListedService{
+			Name:    name,
+			Domain:  svcs.domain,
+			Service: svcs.name,
+			Single:  svcs.single,
+		}
+		for _, addr := range svcs.getAddresses() {
+			var state = InstanceHealthy
+			if h, ok := svcs.health[addr]; ok {
+				state = h.state
+			}
+			listed.Instances = append(listed.Instances, &pb.ListedInstance{
+				Instance:    proto.Clone(svcs.instances[addr]).(*pb.ServiceInstance),
+				Refreshed:   timestamppb.New(svcs.addresses[addr]),
+				Health:      state.String(),
+				Provisional: svcs.provisional[addr],
+			})
+		}
+		result = append(result, listed)
+	}
+	return result, nextPageToken
 }
 
-func (c *cache) removeUnavailable() {
+// replicationState returns all registered addresses with their drain state and the removals
+// of the last service expiration as replication entries
+func (c *cache) replicationState() []*pb.ReplicationEntry {
+	c.Lock()
+	defer c.Unlock()
+	var entries = []*pb.ReplicationEntry{}
 	for _, svcs := range c.services {
-		addrs := svcs.getUnavailable()
-		if len(addrs) > 0 {
-			c.Lock()
-			svcs.removeAddress(addrs...)
-			c.Unlock()
+		for _, addr := range svcs.getAddresses() {
+			entries = append(entries, &pb.ReplicationEntry{
+				Operation: pb.ReplicationOperation_REPLICATION_ADD,
+				Service:   svcs.name,
+				Addr:      addr,
+				Domains:   []string{svcs.domain},
+				Instance:  svcs.instances[addr],
+				Updated:   timestamppb.New(svcs.addresses[addr]),
+			})
+			if h, ok := svcs.health[addr]; ok && h.state == InstanceDraining {
+				entries = append(entries, &pb.ReplicationEntry{
+					Operation: pb.ReplicationOperation_REPLICATION_DRAIN,
+					Service:   svcs.name,
+					Addr:      addr,
+					Domains:   []string{svcs.domain},
+				})
+			}
+		}
+	}
+	c.removeOldTombstones()
+	for ts := range c.tombstones {
+		entries = append(entries, &pb.ReplicationEntry{
+			Operation: pb.ReplicationOperation_REPLICATION_REMOVE,
+			Service:   ts.name,
+			Addr:      ts.addr,
+			Domains:   []string{ts.domain},
+		})
+	}
+	return entries
+}
+
+// watch registers a watcher for the service name, which only receives instances matching the selectors.
+// the current address set is delivered immediately, every change afterward replaces
+// an undelivered older set, so the receiver always gets the latest state
+func (c *cache) watch(name string, selectors []*pb.LabelSelector) (<-chan []*pb.ServiceInstance, func()) {
+	c.Lock()
+	defer c.Unlock()
+	w := &watcher{
+		ch:        make(chan []*pb.ServiceInstance, 1),
+		selectors: selectors,
+	}
+	if _, ok := c.watchers[name]; !ok {
+		c.watchers[name] = make(map[*watcher]bool)
+	}
+	c.watchers[name][w] = true
+	c.notifyWatcher(name, w)
+	return w.ch, func() {
+		c.Lock()
+		defer c.Unlock()
+		delete(c.watchers[name], w)
+		if len(c.watchers[name]) == 0 {
+			delete(c.watchers, name)
+		}
+	}
+}
+
+// notify sends the current address set of name to all watchers
+// lock must be held by caller
+func (c *cache) notify(name string) {
+	for w := range c.watchers[name] {
+		c.notifyWatcher(name, w)
+	}
+}
+
+func (c *cache) notifyWatcher(name string, w *watcher) {
+	var instances = []*pb.ServiceInstance{}
+	if svcs, ok := c.services[name]; ok {
+		instances = filterInstances(svcs.getAvailableInstances(), w.selectors)
+	}
+	// drop undelivered state
+	select {
+	case <-w.ch:
+	default:
+	}
+	w.ch <- instances
+}
+
+// filterInstances returns the instances matching all selectors
+func filterInstances(instances []*pb.ServiceInstance, selectors []*pb.LabelSelector) []*pb.ServiceInstance {
+	if len(selectors) == 0 {
+		return instances
+	}
+	result := make([]*pb.ServiceInstance, 0, len(instances))
+	for _, instance := range instances {
+		if selector.Match(selectors, instance) {
+			result = append(result, instance)
 		}
 	}
+	return result
 }
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCacheListServices(t *testing.T) {
+	c := newCache(time.Minute, testLogger())
+	defer c.Close()
+	c.events, _ = newEventLog(10, "", testLogger())
+	for _, reg := range []struct{ domain, name string }{
+		{"ub", "mediaserver"}, {"ub", "mediaconvert"}, {"ub", "indexer"}, {"dh", "mediaserver"}, {"", "mediaserver"},
+	} {
+		var domains []string
+		if reg.domain != "" {
+			domains = []string{reg.domain}
+		}
+		c.addService(reg.name, &pb.ServiceInstance{Addr: "a:1"}, domains, false, time.Now(), caller{})
+	}
+
+	tests := []struct {
+		name           string
+		domain, prefix string
+		pageToken      string
+		pageSize       int
+		pages          [][]string
+	}{
+		{name: "all", pages: [][]string{{"dh.mediaserver", "mediaserver", "ub.indexer", "ub.mediaconvert", "ub.mediaserver"}}},
+		{name: "domain", domain: "ub", pages: [][]string{{"ub.indexer", "ub.mediaconvert", "ub.mediaserver"}}},
+		{name: "prefix", prefix: "media", pages: [][]string{{"dh.mediaserver", "mediaserver", "ub.mediaconvert", "ub.mediaserver"}}},
+		{name: "domain and prefix", domain: "ub", prefix: "mediaserver", pages: [][]string{{"ub.mediaserver"}}},
+		{name: "unknown domain", domain: "xx", pages: [][]string{{}}},
+		{name: "pages", pageSize: 2, pages: [][]string{{"dh.mediaserver", "mediaserver"}, {"ub.indexer", "ub.mediaconvert"}, {"ub.mediaserver"}}},
+		// the last page is full, there is no empty page after it
+		{name: "full last page", domain: "ub", pageSize: 3, pages: [][]string{{"ub.indexer", "ub.mediaconvert", "ub.mediaserver"}}},
+		{name: "filtered pages", prefix: "media", pageSize: 3, pages: [][]string{{"dh.mediaserver", "mediaserver", "ub.mediaconvert"}, {"ub.mediaserver"}}},
+		{name: "page token", pageToken: "ub.indexer", pages: [][]string{{"ub.mediaconvert", "ub.mediaserver"}}},
+		{name: "page token after the last service", pageToken: "ub.mediaserver", pageSize: 2, pages: [][]string{{}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pageToken := tt.pageToken
+			for i, want := range tt.pages {
+				services, next := c.listServices(tt.domain, tt.prefix, pageToken, tt.pageSize)
+				got := []string{}
+				for _, s := range services {
+					got = append(got, s.GetName())
+				}
+				if !slices.Equal(got, want) {
+					t.Fatalf("page %d: %v, want %v", i, got, want)
+				}
+				if last := i == len(tt.pages)-1; last != (next == "") {
+					t.Fatalf("page %d: next page token '%s'", i, next)
+				}
+				pageToken = next
+			}
+		})
+	}
+}
+
+func TestListServicesPageSize(t *testing.T) {
+	d := NewMiniResolver(0, time.Minute, "", testLogger())
+	defer d.Close()
+	for i := 0; i < maxListPageSize+1; i++ {
+		d.services.addService("svc", &pb.ServiceInstance{Addr: "a:1"}, []string{fmt.Sprintf("dom%d", i)}, false, time.Now(), caller{})
+	}
+	tests := []struct {
+		pageSize int32
+		want     int
+		code     codes.Code
+	}{
+		{pageSize: 0, want: defaultListPageSize},
+		{pageSize: 10, want: 10},
+		{pageSize: maxListPageSize + 100, want: maxListPageSize},
+		{pageSize: -1, code: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		resp, err := d.ListServices(context.Background(), &pb.ListServicesRequest{PageSize: tt.pageSize})
+		if status.Code(err) != tt.code {
+			t.Errorf("page size %d: error %v, want %v", tt.pageSize, err, tt.code)
+			continue
+		}
+		if err == nil && (len(resp.GetServices()) != tt.want || resp.GetNextPageToken() == "") {
+			t.Errorf("page size %d: %d services (next '%s'), want %d", tt.pageSize, len(resp.GetServices()), resp.GetNextPageToken(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"emperror.dev/errors"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"time"
+)
+
+const clusterQueueSize = 1024
+const clusterBatchSize = 128
+const clusterRetryWait = 5 * time.Second
+
+// newCluster creates a replication link to every peer.
+// every node ships its own mutations to all peers. since registrations are refreshed
+// periodically, the nodes converge even if a mutation gets lost
+func newCluster(peers []string, tlsConfig *tls.Config, services *cache, logger zLogger.ZLogger) (*cluster, error) {
+	c := &cluster{
+		peers:    make([]*clusterPeer, 0, len(peers)),
+		services: services,
+		logger:   logger,
+		done:     make(chan bool),
+	}
+	var creds = insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	for _, addr := range peers {
+		conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			c.Close()
+			return nil, errors.Wrapf(err, "cannot create client for cluster peer %s", addr)
+		}
+		c.peers = append(c.peers, &clusterPeer{
+			addr:   addr,
+			conn:   conn,
+			client: pb.NewMiniResolverClient(conn),
+			queue:  make(chan *pb.ReplicationEntry, clusterQueueSize),
+		})
+	}
+	return c, nil
+}
+
+type clusterPeer struct {
+	addr   string
+	conn   *grpc.ClientConn
+	client pb.MiniResolverClient
+	queue  chan *pb.ReplicationEntry
+}
+
+type cluster struct {
+	peers    []*clusterPeer
+	services *cache
+	logger   zLogger.ZLogger
+	done     chan bool
+}
+
+func (c *cluster) Start() {
+	for _, p := range c.peers {
+		go c.run(p)
+	}
+}
+
+func (c *cluster) Close() {
+	close(c.done)
+	for _, p := range c.peers {
+		p.conn.Close()
+	}
+}
+
+// replicate queues the entry for all peers
+func (c *cluster) replicate(entry *pb.ReplicationEntry) {
+	for _, p := range c.peers {
+		select {
+		case p.queue <- entry:
+		default:
+			c.logger.Warn().Msgf("replication queue of cluster peer %s full, dropping %s of '%s'", p.addr, entry.GetOperation(), entry.GetService())
+		}
+	}
+}
+
+// run ships the queued entries to the peer.
+// after every failure the full state is sent again before queued entries are shipped
+func (c *cluster) run(p *clusterPeer) {
+	var inSync = false
+	for {
+		if !inSync {
+			if err := c.send(p, c.services.replicationState()); err != nil {
+				c.logger.Debug().Err(err).Msgf("cannot sync cluster peer %s", p.addr)
+				if !c.wait(p) {
+					return
+				}
+				continue
+			}
+			c.logger.Info().Msgf("cluster peer %s in sync", p.addr)
+			inSync = true
+		}
+		select {
+		case entry := <-p.queue:
+			entries := []*pb.ReplicationEntry{entry}
+			for len(entries) < clusterBatchSize && len(p.queue) > 0 {
+				entries = append(entries, <-p.queue)
+			}
+			if err := c.send(p, entries); err != nil {
+				c.logger.Error().Err(err).Msgf("cannot replicate to cluster peer %s", p.addr)
+				inSync = false
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// wait discards queued entries until retry, since the next sync contains the full state
+func (c *cluster) wait(p *clusterPeer) bool {
+	timeout := time.After(clusterRetryWait)
+	for {
+		select {
+		case <-p.queue:
+		case <-timeout:
+			return true
+		case <-c.done:
+			return false
+		}
+	}
+}
+
+func (c *cluster) send(p *clusterPeer, entries []*pb.ReplicationEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := p.client.Replicate(ctx, &pb.ReplicationBatch{Entries: entries})
+	if err != nil {
+		return errors.Wrapf(err, "cannot replicate %d entries to %s", len(entries), p.addr)
+	}
+	c.logger.Debug().Msgf("cluster peer %s: %s", p.addr, resp.GetMessage())
+	return nil
+}
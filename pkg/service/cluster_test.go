@@ -0,0 +1,250 @@
+package service
+
+import (
+	"context"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func testLogger() zLogger.ZLogger {
+	nop := zerolog.Nop()
+	return &nop
+}
+
+// eventually polls cond until it is true or the timeout is reached
+func eventually(t *testing.T, timeout time.Duration, cond func() bool, format string, args ...any) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// testNode is a miniresolver of a cluster on loopback without tls
+type testNode struct {
+	addr     string
+	resolver *miniResolver
+	server   *grpc.Server
+	client   pb.MiniResolverClient
+}
+
+func (n *testNode) serve(t *testing.T) {
+	t.Helper()
+	lis, err := net.Listen("tcp", n.addr)
+	if err != nil {
+		t.Fatalf("cannot listen on %s: %v", n.addr, err)
+	}
+	n.server = grpc.NewServer()
+	pb.RegisterMiniResolverServer(n.server, n.resolver)
+	go n.server.Serve(lis)
+}
+
+func (n *testNode) addrs(name string) []string {
+	instances, _ := n.resolver.services.getServices(name, nil)
+	var result []string
+	for _, instance := range instances {
+		result = append(result, instance.GetAddr())
+	}
+	slices.Sort(result)
+	return result
+}
+
+// startCluster starts n nodes, which replicate to each other
+func startCluster(t *testing.T, n int) []*testNode {
+	t.Helper()
+	nodes := make([]*testNode, n)
+	for i := range nodes {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("cannot listen: %v", err)
+		}
+		nodes[i] = &testNode{addr: lis.Addr().String()}
+		lis.Close()
+	}
+	for i, node := range nodes {
+		var peers []string
+		for j, peer := range nodes {
+			if i != j {
+				peers = append(peers, peer.addr)
+			}
+		}
+		node.resolver = NewMiniResolver(0, time.Minute, "", testLogger(), WithCluster(peers, nil))
+		node.serve(t)
+		conn, err := grpc.NewClient(node.addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatalf("cannot connect to %s: %v", node.addr, err)
+		}
+		node.client = pb.NewMiniResolverClient(conn)
+		t.Cleanup(func() {
+			conn.Close()
+			node.server.Stop()
+			node.resolver.Close()
+		})
+	}
+	return nodes
+}
+
+func serviceData(service, domain string, port uint32) *pb.ServiceData {
+	host := "127.0.0.1"
+	return &pb.ServiceData{Service: service, Host: &host, Port: port, Domains: []string{domain}}
+}
+
+func TestClusterReplication(t *testing.T) {
+	nodes := startCluster(t, 3)
+	ctx := context.Background()
+	for _, port := range []uint32{1001, 1002} {
+		if _, err := nodes[0].client.AddService(ctx, serviceData("svc", "dom", port)); err != nil {
+			t.Fatalf("cannot add service: %v", err)
+		}
+	}
+	want := []string{"127.0.0.1:1001", "127.0.0.1:1002"}
+	for i, node := range nodes {
+		eventually(t, 5*time.Second, func() bool { return slices.Equal(node.addrs("dom.svc"), want) }, "node %d: %v, want %v", i, node.addrs("dom.svc"), want)
+	}
+
+	if _, err := nodes[1].client.DrainService(ctx, serviceData("svc", "dom", 1002)); err != nil {
+		t.Fatalf("cannot drain service: %v", err)
+	}
+	want = []string{"127.0.0.1:1001"}
+	for i, node := range nodes {
+		eventually(t, 5*time.Second, func() bool { return slices.Equal(node.addrs("dom.svc"), want) }, "node %d after drain: %v, want %v", i, node.addrs("dom.svc"), want)
+	}
+
+	// node 2 misses the removal and gets it by the full sync after the outage
+	nodes[2].server.Stop()
+	if _, err := nodes[0].client.RemoveService(ctx, serviceData("svc", "dom", 1001)); err != nil {
+		t.Fatalf("cannot remove service: %v", err)
+	}
+	eventually(t, 5*time.Second, func() bool { return len(nodes[1].addrs("dom.svc")) == 0 }, "node 1 after removal: %v", nodes[1].addrs("dom.svc"))
+	if got := nodes[2].addrs("dom.svc"); !slices.Equal(got, want) {
+		t.Fatalf("node 2 during outage: %v, want %v", got, want)
+	}
+	nodes[2].serve(t)
+	eventually(t, 30*time.Second, func() bool { return len(nodes[2].addrs("dom.svc")) == 0 }, "node 2 after resync: %v", nodes[2].addrs("dom.svc"))
+	for i, node := range nodes[:2] {
+		if got := node.addrs("dom.svc"); len(got) != 0 {
+			t.Errorf("node %d after resync: %v", i, got)
+		}
+	}
+}
+
+func TestReplicateFullSync(t *testing.T) {
+	removed := time.Now().Add(-time.Second)
+	tests := []struct {
+		name    string
+		entry   *pb.ReplicationEntry
+		removed bool
+		want    []string
+	}{
+		{
+			name:  "live addition",
+			entry: &pb.ReplicationEntry{Service: "svc", Addr: "a:1", Domains: []string{"dom"}},
+			want:  []string{"a:1"},
+		},
+		{
+			name:  "current addition",
+			entry: &pb.ReplicationEntry{Service: "svc", Addr: "a:1", Domains: []string{"dom"}, Updated: timestamppb.Now()},
+			want:  []string{"a:1"},
+		},
+		{
+			name:    "addition after removal",
+			entry:   &pb.ReplicationEntry{Service: "svc", Addr: "a:1", Domains: []string{"dom"}, Updated: timestamppb.Now()},
+			removed: true,
+			want:    []string{"a:1"},
+		},
+		{
+			name:    "stale addition before removal",
+			entry:   &pb.ReplicationEntry{Service: "svc", Addr: "a:1", Domains: []string{"dom"}, Updated: timestamppb.New(removed.Add(-time.Minute))},
+			removed: true,
+		},
+		{
+			name:  "expired addition",
+			entry: &pb.ReplicationEntry{Service: "svc", Addr: "a:1", Domains: []string{"dom"}, Updated: timestamppb.New(time.Now().Add(-2 * time.Minute))},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewMiniResolver(0, time.Minute, "", testLogger())
+			defer d.Close()
+			if tt.removed {
+				d.services.removeService("svc", "a:1", []string{"dom"}, pb.EventType_EVENT_REMOVED, "", caller{})
+				d.services.tombstones[tombstone{domain: "dom", name: "svc", addr: "a:1"}] = removed
+			}
+			if _, err := d.Replicate(context.Background(), &pb.ReplicationBatch{Entries: []*pb.ReplicationEntry{tt.entry}}); err != nil {
+				t.Fatalf("cannot replicate: %v", err)
+			}
+			var got []string
+			instances, _ := d.services.getServices("dom.svc", nil)
+			for _, instance := range instances {
+				got = append(got, instance.GetAddr())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("addresses %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplicationState(t *testing.T) {
+	c := newCache(time.Minute, testLogger())
+	defer c.Close()
+	c.events, _ = newEventLog(10, "", testLogger())
+	c.addService("svc", &pb.ServiceInstance{Addr: "a:1"}, []string{"dom"}, false, time.Now(), caller{})
+	c.addService("svc", &pb.ServiceInstance{Addr: "b:2"}, []string{"dom"}, false, time.Now(), caller{})
+	c.addService("svc", &pb.ServiceInstance{Addr: "c:3"}, []string{"dom"}, false, time.Now(), caller{})
+	c.drainService("svc", "b:2", []string{"dom"}, caller{})
+	c.removeService("svc", "c:3", []string{"dom"}, pb.EventType_EVENT_REMOVED, "", caller{})
+	c.tombstones[tombstone{domain: "dom", name: "svc", addr: "old:1"}] = time.Now().Add(-time.Hour)
+
+	var got []string
+	for _, entry := range c.replicationState() {
+		got = append(got, entry.GetOperation().String()+" "+entry.GetAddr())
+		if entry.GetOperation() == pb.ReplicationOperation_REPLICATION_ADD && entry.GetUpdated() == nil {
+			t.Errorf("addition of %s without update time", entry.GetAddr())
+		}
+	}
+	slices.Sort(got)
+	want := []string{"REPLICATION_ADD a:1", "REPLICATION_ADD b:2", "REPLICATION_DRAIN b:2", "REPLICATION_REMOVE c:3"}
+	if !slices.Equal(got, want) {
+		t.Errorf("replication state %v, want %v", got, want)
+	}
+	if _, ok := c.tombstones[tombstone{domain: "dom", name: "svc", addr: "old:1"}]; ok {
+		t.Error("expired tombstone not removed")
+	}
+
+	c.addService("svc", &pb.ServiceInstance{Addr: "c:3"}, []string{"dom"}, false, time.Now(), caller{})
+	if c.removedAfter("svc", "c:3", []string{"dom"}, time.Time{}) {
+		t.Error("tombstone of registered address not removed")
+	}
+}
+
+func TestReplicateKeepsRefreshTime(t *testing.T) {
+	d := NewMiniResolver(0, time.Minute, "", testLogger())
+	defer d.Close()
+	// expires on its origin in 300ms
+	updated := time.Now().Add(-time.Minute + 300*time.Millisecond)
+	entry := &pb.ReplicationEntry{Service: "svc", Addr: "a:1", Domains: []string{"dom"}, Updated: timestamppb.New(updated)}
+	if _, err := d.Replicate(context.Background(), &pb.ReplicationBatch{Entries: []*pb.ReplicationEntry{entry}}); err != nil {
+		t.Fatalf("cannot replicate: %v", err)
+	}
+	if instances, _ := d.services.getServices("dom.svc", nil); len(instances) != 1 {
+		t.Fatalf("replicated addition missing: %v", instances)
+	}
+	expired := func() bool {
+		d.services.removeExpired()
+		instances, _ := d.services.getServices("dom.svc", nil)
+		return len(instances) == 0
+	}
+	eventually(t, 2*time.Second, expired, "replicated addition not expired with its origin")
+}
@@ -0,0 +1,268 @@
+package service
+
+import (
+	"encoding/hex"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"github.com/miekg/dns"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dnsAddrLabel is the label of the synthetic host names of instances registered with an ip address
+const dnsAddrLabel = "addr"
+
+// dnsAddrTTL is the ttl of the synthetic host names. they contain the ip address, so they never change
+const dnsAddrTTL = uint32(time.Hour / time.Second)
+
+// newDNSServer answers SRV, A and AAAA queries for _<service>._tcp.<domain>.<zone> and A and AAAA queries
+// for the host names <service>.<domain>.<zone> from the registry. SRV targets of instances registered with an ip address are synthetic names <hex ip>.addr.<zone>
+func newDNSServer(addr, zone string, services *cache, logger zLogger.ZLogger) *dnsServer {
+	return &dnsServer{
+		addr:     addr,
+		zone:     dns.CanonicalName(zone),
+		services: services,
+		logger:   logger,
+	}
+}
+
+type dnsServer struct {
+	addr     string
+	zone     string
+	services *cache
+	logger   zLogger.ZLogger
+	servers  []*dns.Server
+}
+
+func (s *dnsServer) Start() {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(s.zone, s.handle)
+	for _, network := range []string{"udp", "tcp"} {
+		server := &dns.Server{
+			Addr:    s.addr,
+			Net:     network,
+			Handler: mux,
+		}
+		s.servers = append(s.servers, server)
+		go func() {
+			s.logger.Info().Msgf("starting dns server on %s/%s for zone '%s'", s.addr, network, s.zone)
+			if err := server.ListenAndServe(); err != nil {
+				s.logger.Error().Err(err).Msgf("dns server on %s/%s ended", s.addr, network)
+			}
+		}()
+	}
+}
+
+func (s *dnsServer) Close() {
+	for _, server := range s.servers {
+		if err := server.Shutdown(); err != nil {
+			s.logger.Debug().Msgf("cannot shutdown dns server on %s/%s: %v", s.addr, server.Net, err)
+		}
+	}
+}
+
+func (s *dnsServer) handle(w dns.ResponseWriter, req *dns.Msg) {
+	if err := w.WriteMsg(s.reply(req)); err != nil {
+		s.logger.Debug().Msgf("cannot write dns answer: %v", err)
+	}
+}
+
+// reply answers the query. negative answers (NXDOMAIN and NODATA) carry the SOA of the zone for negative caching
+func (s *dnsServer) reply(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	if len(req.Question) != 1 {
+		m.Rcode = dns.RcodeFormatError
+		return m
+	}
+	s.answer(m, req.Question[0])
+	if len(m.Answer) == 0 && (m.Rcode == dns.RcodeSuccess || m.Rcode == dns.RcodeNameError) {
+		m.Ns = append(m.Ns, s.soa())
+	}
+	return m
+}
+
+// soa is the SOA record of the zone. its ttl limits the caching of negative answers like the next call wait
+func (s *dnsServer) soa() dns.RR {
+	ttl := uint32(minNextCallTimeout / time.Second)
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: s.zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      s.zone,
+		Mbox:    "hostmaster." + s.zone,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  ttl,
+	}
+}
+
+// answer fills m with the records for question q
+func (s *dnsServer) answer(m *dns.Msg, q dns.Question) {
+	labels := dns.SplitDomainName(q.Name)
+	labels = labels[:len(labels)-dns.CountLabel(s.zone)]
+
+	// zone apex
+	if len(labels) == 0 {
+		if q.Qtype == dns.TypeSOA {
+			m.Answer = append(m.Answer, s.soa())
+		}
+		return
+	}
+
+	// synthetic host name of an instance
+	if len(labels) == 2 && strings.EqualFold(labels[1], dnsAddrLabel) {
+		ip, err := hex.DecodeString(labels[0])
+		if err != nil || (len(ip) != net.IPv4len && len(ip) != net.IPv6len) {
+			m.Rcode = dns.RcodeNameError
+			return
+		}
+		if rr := ipRecord(q.Name, q.Qtype, net.IP(ip), dnsAddrTTL); rr != nil {
+			m.Answer = append(m.Answer, rr)
+		}
+		return
+	}
+
+	var instances []*pb.ServiceInstance
+	var ncw time.Duration
+	var ok bool
+	name, srv := s.serviceName(labels)
+	if srv {
+		instances, ncw, ok = s.services.getServicesFold(name)
+	} else {
+		name, instances, ncw, ok = s.resolveHostName(labels)
+	}
+	if !ok {
+		s.logger.Debug().Msgf("dns: service '%s' not found", name)
+		m.Rcode = dns.RcodeNameError
+		return
+	}
+	ttl := uint32(ncw / time.Second)
+	s.logger.Debug().Msgf("dns: %s %s: %d instances", dns.TypeToString[q.Qtype], name, len(instances))
+	for _, instance := range instances {
+		host, portStr, err := net.SplitHostPort(instance.GetAddr())
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		switch q.Qtype {
+		case dns.TypeSRV:
+			// host names have no SRV records
+			if !srv {
+				continue
+			}
+			port, err := strconv.ParseUint(portStr, 10, 16)
+			if err != nil {
+				continue
+			}
+			target := dns.Fqdn(host)
+			if ip != nil {
+				target = hostLabel(ip) + "." + dnsAddrLabel + "." + s.zone
+				var qtype = dns.TypeA
+				if ip.To4() == nil {
+					qtype = dns.TypeAAAA
+				}
+				m.Extra = append(m.Extra, ipRecord(target, qtype, ip, dnsAddrTTL))
+			}
+			m.Answer = append(m.Answer, &dns.SRV{
+				Hdr:      dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl},
+				Priority: clampUint16(instance.GetPriority()),
+				Weight:   clampUint16(instanceWeight(instance)),
+				Port:     uint16(port),
+				Target:   target,
+			})
+		case dns.TypeA, dns.TypeAAAA:
+			// instances registered with a host name are only available via SRV
+			if ip == nil {
+				continue
+			}
+			if rr := ipRecord(q.Name, q.Qtype, ip, ttl); rr != nil {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+	}
+}
+
+// serviceName converts the labels _<service>._tcp.<domain> to the qualified service name <domain>.<service>.
+// service names may contain dots, so all labels before _tcp belong to the service
+func (s *dnsServer) serviceName(labels []string) (string, bool) {
+	for i, label := range labels {
+		if !strings.EqualFold(label, "_tcp") {
+			continue
+		}
+		if i == 0 || !strings.HasPrefix(labels[0], "_") {
+			return "", false
+		}
+		name := strings.TrimPrefix(strings.Join(labels[:i], "."), "_")
+		if domain := strings.Join(labels[i+1:], "."); domain != "" {
+			name = domain + "." + name
+		}
+		return name, true
+	}
+	return "", false
+}
+
+// resolveHostName resolves the labels <service>.<domain> of a host name. service names may contain dots,
+// so the last label is tried as domain first and then the name of a service without domain
+func (s *dnsServer) resolveHostName(labels []string) (string, []*pb.ServiceInstance, time.Duration, bool) {
+	var names []string
+	if len(labels) > 1 {
+		last := len(labels) - 1
+		names = append(names, labels[last]+"."+strings.Join(labels[:last], "."))
+	}
+	names = append(names, strings.Join(labels, "."))
+	for _, name := range names {
+		if instances, ncw, ok := s.services.getServicesFold(name); ok {
+			return name, instances, ncw, true
+		}
+	}
+	return "", nil, minNextCallTimeout, false
+}
+
+// hostLabel encodes the ip address as dns label
+func hostLabel(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return hex.EncodeToString(ip4)
+	}
+	return hex.EncodeToString(ip.To16())
+}
+
+// ipRecord returns an A or AAAA record for ip or nil, if ip does not belong to the type
+func ipRecord(name string, qtype uint16, ip net.IP, ttl uint32) dns.RR {
+	switch qtype {
+	case dns.TypeA:
+		if ip4 := ip.To4(); ip4 != nil {
+			return &dns.A{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+				A:   ip4,
+			}
+		}
+	case dns.TypeAAAA:
+		if ip.To4() == nil {
+			return &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl},
+				AAAA: ip.To16(),
+			}
+		}
+	}
+	return nil
+}
+
+// instanceWeight returns the weight of the instance, instances without weight count as 1
+func instanceWeight(instance *pb.ServiceInstance) uint32 {
+	if w := instance.GetWeight(); w > 0 {
+		return w
+	}
+	return 1
+}
+
+func clampUint16(v uint32) uint16 {
+	if v > math.MaxUint16 {
+		return math.MaxUint16
+	}
+	return uint16(v)
+}
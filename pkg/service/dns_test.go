@@ -0,0 +1,91 @@
+package service
+
+import (
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"github.com/miekg/dns"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDNSAnswer(t *testing.T) {
+	c := newCache(time.Minute, testLogger())
+	defer c.Close()
+	c.addService("svc", &pb.ServiceInstance{Addr: "127.0.0.1:1001"}, []string{"dom"}, false, time.Now(), caller{})
+	c.addService("svc", &pb.ServiceInstance{Addr: "[::1]:1002", Weight: 3, Priority: 1}, []string{"dom"}, false, time.Now(), caller{})
+	c.addService("mediaserverproto.Action", &pb.ServiceInstance{Addr: "127.0.0.2:1003"}, []string{"ub"}, false, time.Now(), caller{})
+	c.addService("db", &pb.ServiceInstance{Addr: "db.example.org:5432"}, nil, false, time.Now(), caller{})
+	s := newDNSServer("", "miniresolver", c, testLogger())
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers []string
+		soa     bool
+	}{
+		{"_svc._tcp.dom.miniresolver.", dns.TypeSRV, dns.RcodeSuccess, []string{"SRV 0 1 1001 7f000001.addr.miniresolver.", "SRV 1 3 1002 00000000000000000000000000000001.addr.miniresolver."}, false},
+		{"_SVC._tcp.DOM.miniresolver.", dns.TypeA, dns.RcodeSuccess, []string{"A 127.0.0.1"}, false},
+		{"svc.dom.miniresolver.", dns.TypeA, dns.RcodeSuccess, []string{"A 127.0.0.1"}, false},
+		{"svc.dom.miniresolver.", dns.TypeAAAA, dns.RcodeSuccess, []string{"AAAA ::1"}, false},
+		{"svc.dom.miniresolver.", dns.TypeSRV, dns.RcodeSuccess, nil, true},
+		{"mediaserverproto.action.ub.miniresolver.", dns.TypeA, dns.RcodeSuccess, []string{"A 127.0.0.2"}, false},
+		{"_mediaserverproto.Action._tcp.ub.miniresolver.", dns.TypeA, dns.RcodeSuccess, []string{"A 127.0.0.2"}, false},
+		{"_db._tcp.miniresolver.", dns.TypeSRV, dns.RcodeSuccess, []string{"SRV 0 1 5432 db.example.org."}, false},
+		{"db.miniresolver.", dns.TypeA, dns.RcodeSuccess, nil, true},
+		{"7f000001.addr.miniresolver.", dns.TypeA, dns.RcodeSuccess, []string{"A 127.0.0.1"}, false},
+		{"7f000001.addr.miniresolver.", dns.TypeAAAA, dns.RcodeSuccess, nil, true},
+		{"miniresolver.", dns.TypeA, dns.RcodeSuccess, nil, true},
+		{"miniresolver.", dns.TypeSOA, dns.RcodeSuccess, []string{"SOA miniresolver. hostmaster.miniresolver. 1 3600 600 86400 10"}, false},
+		{"other.dom.miniresolver.", dns.TypeA, dns.RcodeNameError, nil, true},
+		{"_other._tcp.dom.miniresolver.", dns.TypeSRV, dns.RcodeNameError, nil, true},
+		{"zz.addr.miniresolver.", dns.TypeA, dns.RcodeNameError, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(dns.TypeToString[tt.qtype]+" "+tt.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(tt.name, tt.qtype)
+			m := s.reply(req)
+			if m.Rcode != tt.rcode {
+				t.Errorf("rcode %s, want %s", dns.RcodeToString[m.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			var answers []string
+			for _, rr := range m.Answer {
+				if rr.Header().Name != tt.name {
+					t.Errorf("answer for %s, want %s", rr.Header().Name, tt.name)
+				}
+				answers = append(answers, dns.TypeToString[rr.Header().Rrtype]+" "+strings.TrimPrefix(rr.String(), rr.Header().String()))
+			}
+			slices.Sort(answers)
+			if !slices.Equal(answers, tt.answers) {
+				t.Errorf("answers %v, want %v", answers, tt.answers)
+			}
+			if soa := len(m.Ns) == 1 && m.Ns[0].Header().Rrtype == dns.TypeSOA; soa != tt.soa {
+				t.Errorf("authority %v, want soa %v", m.Ns, tt.soa)
+			}
+		})
+	}
+}
+
+func TestDNSServiceName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"_svc._tcp.dom", "dom.svc", true},
+		{"_svc._tcp", "svc", true},
+		{"_mediaserverproto.Action._tcp.ub", "ub.mediaserverproto.Action", true},
+		{"svc._tcp.dom", "", false},
+		{"_tcp.dom", "", false},
+		{"svc.dom", "", false},
+	}
+	s := &dnsServer{}
+	for _, tt := range tests {
+		got, ok := s.serviceName(strings.Split(tt.name, "."))
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("serviceName(%s) = %s, %v, want %s, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
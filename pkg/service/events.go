@@ -0,0 +1,135 @@
+package service
+
+import (
+	"context"
+	"emperror.dev/errors"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultEventBufferSize is the number of registry events kept in memory
+const DefaultEventBufferSize = 1000
+
+// caller describes who caused a change of the registry
+type caller struct {
+	identities []string
+	replicated bool
+}
+
+// callerOf returns the identities of the caller of a grpc method
+func callerOf(ctx context.Context) caller {
+	return caller{identities: identities(ctx)}
+}
+
+// newEventLog keeps the last size events in a ring buffer. with auditFile all events
+// are appended as json lines
+func newEventLog(size int, auditFile string, logger zLogger.ZLogger) (*eventLog, error) {
+	if size <= 0 {
+		size = DefaultEventBufferSize
+	}
+	el := &eventLog{
+		events: make([]*pb.Event, size),
+		logger: logger,
+	}
+	if auditFile != "" {
+		fp, err := os.OpenFile(auditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot open audit file '%s'", auditFile)
+		}
+		el.audit = fp
+	}
+	return el, nil
+}
+
+type eventLog struct {
+	sync.Mutex
+	events   []*pb.Event
+	sequence uint64 // sequence of the last event
+	audit    *os.File
+	logger   zLogger.ZLogger
+}
+
+func (el *eventLog) Close() error {
+	el.Lock()
+	defer el.Unlock()
+	if el.audit == nil {
+		return nil
+	}
+	err := el.audit.Close()
+	el.audit = nil
+	return errors.Wrap(err, "cannot close audit file")
+}
+
+// record adds the event to the buffer and the audit file
+func (el *eventLog) record(eventType pb.EventType, domain, service, addr, reason string, c caller) {
+	if el == nil {
+		return
+	}
+	el.Lock()
+	defer el.Unlock()
+	el.sequence++
+	event := &pb.Event{
+		Sequence:   el.sequence,
+		Time:       timestamppb.New(time.Now()),
+		Type:       eventType,
+		Domain:     domain,
+		Service:    service,
+		Addr:       addr,
+		Reason:     reason,
+		Identities: c.identities,
+		Replicated: c.replicated,
+	}
+	el.events[el.sequence%uint64(len(el.events))] = event
+	if el.audit == nil {
+		return
+	}
+	data, err := protojson.Marshal(event)
+	if err != nil {
+		el.logger.Error().Err(err).Msgf("cannot marshal event %d", event.Sequence)
+		return
+	}
+	if _, err := el.audit.Write(append(data, '\n')); err != nil {
+		el.logger.Error().Err(err).Msgf("cannot write event %d to audit file", event.Sequence)
+	}
+}
+
+// get returns up to limit events after afterSequence of the qualified service name (all services if empty)
+// and the sequences of the oldest buffered and the last event
+func (el *eventLog) get(afterSequence uint64, limit int, name string) (events []*pb.Event, first, last uint64) {
+	el.Lock()
+	defer el.Unlock()
+	size := uint64(len(el.events))
+	first = 1
+	if el.sequence > size {
+		first = el.sequence - size + 1
+	}
+	if el.sequence == 0 {
+		first = 0
+	}
+	start := max(afterSequence+1, first)
+	events = []*pb.Event{}
+	for seq := start; seq <= el.sequence; seq++ {
+		event := el.events[seq%size]
+		if name != "" && qualifiedName(event.GetDomain(), event.GetService()) != name {
+			continue
+		}
+		events = append(events, event)
+		if limit > 0 && len(events) >= limit {
+			break
+		}
+	}
+	return events, first, el.sequence
+}
+
+// qualifiedName returns domain.service or service without domain
+func qualifiedName(domain, service string) string {
+	if domain == "" {
+		return service
+	}
+	return domain + "." + service
+}
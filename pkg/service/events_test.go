@@ -0,0 +1,93 @@
+package service
+
+import (
+	"bufio"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"google.golang.org/protobuf/encoding/protojson"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestEventLogGet(t *testing.T) {
+	el, err := newEventLog(3, "", testLogger())
+	if err != nil {
+		t.Fatalf("cannot create event log: %v", err)
+	}
+	if events, first, last := el.get(0, 0, ""); len(events) != 0 || first != 0 || last != 0 {
+		t.Errorf("empty log: %v, %d, %d", events, first, last)
+	}
+	// sequences 1-5, the buffer keeps 3-5
+	for _, service := range []string{"a", "b", "a", "b", "a"} {
+		el.record(pb.EventType_EVENT_REGISTERED, "dom", service, "127.0.0.1:1", "", caller{})
+	}
+
+	tests := []struct {
+		name          string
+		afterSequence uint64
+		limit         int
+		service       string
+		want          []uint64
+	}{
+		{name: "buffered events", want: []uint64{3, 4, 5}},
+		{name: "after sequence", afterSequence: 3, want: []uint64{4, 5}},
+		{name: "after last sequence", afterSequence: 5, want: []uint64{}},
+		{name: "limit", limit: 2, want: []uint64{3, 4}},
+		{name: "service", service: "dom.a", want: []uint64{3, 5}},
+		{name: "service and limit", service: "dom.b", limit: 1, want: []uint64{4}},
+		{name: "unknown service", service: "dom.c", want: []uint64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, first, last := el.get(tt.afterSequence, tt.limit, tt.service)
+			got := []uint64{}
+			for _, event := range events {
+				got = append(got, event.GetSequence())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("sequences %v, want %v", got, tt.want)
+			}
+			if first != 3 || last != 5 {
+				t.Errorf("first %d, last %d, want 3, 5", first, last)
+			}
+		})
+	}
+}
+
+func TestEventLogAudit(t *testing.T) {
+	auditFile := filepath.Join(t.TempDir(), "audit.jsonl")
+	el, err := newEventLog(1, auditFile, testLogger())
+	if err != nil {
+		t.Fatalf("cannot create event log: %v", err)
+	}
+	el.record(pb.EventType_EVENT_REGISTERED, "dom", "svc", "127.0.0.1:1", "", caller{identities: []string{"client"}})
+	el.record(pb.EventType_EVENT_EXPIRED, "dom", "svc", "127.0.0.1:1", "not refreshed", caller{replicated: true})
+	if err := el.Close(); err != nil {
+		t.Fatalf("cannot close event log: %v", err)
+	}
+
+	fp, err := os.Open(auditFile)
+	if err != nil {
+		t.Fatalf("cannot open audit file: %v", err)
+	}
+	defer fp.Close()
+	var events []*pb.Event
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		event := &pb.Event{}
+		if err := protojson.Unmarshal(scanner.Bytes(), event); err != nil {
+			t.Fatalf("invalid audit line '%s': %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != 2 {
+		t.Fatalf("%d audit lines, want 2", len(events))
+	}
+	if events[0].GetType() != pb.EventType_EVENT_REGISTERED || !slices.Equal(events[0].GetIdentities(), []string{"client"}) {
+		t.Errorf("first event %v", events[0])
+	}
+	if events[1].GetSequence() != 2 || events[1].GetReason() != "not refreshed" || !events[1].GetReplicated() {
+		t.Errorf("second event %v", events[1])
+	}
+}
@@ -0,0 +1,250 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"emperror.dev/errors"
+	"fmt"
+	pbgeneric "github.com/je4/genericproto/v2/pkg/generic/proto"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"sync"
+	"time"
+)
+
+type InstanceState int
+
+const (
+	InstanceHealthy InstanceState = iota
+	InstanceUnhealthy
+	InstanceDraining
+)
+
+func (s InstanceState) String() string {
+	switch s {
+	case InstanceHealthy:
+		return "healthy"
+	case InstanceUnhealthy:
+		return "unhealthy"
+	case InstanceDraining:
+		return "draining"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+const (
+	// HealthProtocolGRPC uses the standard grpc.health.v1 protocol
+	HealthProtocolGRPC = "grpc"
+	// HealthProtocolPing calls the generic Ping method of the registered service
+	HealthProtocolPing = "ping"
+)
+
+type HealthCheckConfig struct {
+	Protocol         string
+	Interval         time.Duration
+	Timeout          time.Duration
+	FailureThreshold int
+}
+
+var DefaultHealthCheckConfig = HealthCheckConfig{
+	Protocol:         HealthProtocolGRPC,
+	Interval:         30 * time.Second,
+	Timeout:          5 * time.Second,
+	FailureThreshold: 3,
+}
+
+const healthCheckTick = time.Second
+
+type instanceHealth struct {
+	state    InstanceState
+	failures int
+	checked  time.Time
+}
+
+type healthProbe struct {
+	svcs   *serviceEntry
+	addr   string
+	client *grpc.ClientConn
+	config HealthCheckConfig
+	err    error
+}
+
+// newHealthChecker creates a checker for all registered instances.
+// serviceConfigs overrides defaultConfig per service name (with or without domain)
+func newHealthChecker(tlsConfig *tls.Config, defaultConfig HealthCheckConfig, serviceConfigs map[string]HealthCheckConfig, services *cache, logger zLogger.ZLogger) *healthChecker {
+	var creds = insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	if serviceConfigs == nil {
+		serviceConfigs = map[string]HealthCheckConfig{}
+	}
+	return &healthChecker{
+		creds:          creds,
+		defaultConfig:  defaultConfig,
+		serviceConfigs: serviceConfigs,
+		services:       services,
+		logger:         logger,
+	}
+}
+
+type healthChecker struct {
+	creds          credentials.TransportCredentials
+	defaultConfig  HealthCheckConfig
+	serviceConfigs map[string]HealthCheckConfig
+	services       *cache
+	logger         zLogger.ZLogger
+}
+
+func (hc *healthChecker) Start() {
+	go func() {
+		for {
+			select {
+			case <-time.After(healthCheckTick):
+				hc.check()
+			case <-hc.services.done:
+				return
+			}
+		}
+	}()
+}
+
+func (hc *healthChecker) config(svcs *serviceEntry) HealthCheckConfig {
+	if conf, ok := hc.serviceConfigs[svcs.service]; ok {
+		return conf
+	}
+	if conf, ok := hc.serviceConfigs[svcs.name]; ok {
+		return conf
+	}
+	return hc.defaultConfig
+}
+
+// check probes all instances which are due and updates their state
+func (hc *healthChecker) check() {
+	probes := hc.dueProbes()
+	if len(probes) == 0 {
+		return
+	}
+	// probe without holding the lock
+	var wg sync.WaitGroup
+	for _, p := range probes {
+		wg.Add(1)
+		go func(p *healthProbe) {
+			defer wg.Done()
+			p.err = hc.probe(p)
+		}(p)
+	}
+	wg.Wait()
+
+	c := hc.services
+	c.Lock()
+	defer c.Unlock()
+	for _, p := range probes {
+		if p.svcs.client[p.addr] != p.client {
+			// address removed in the meantime
+			continue
+		}
+		if hc.update(p) {
+			c.notify(p.svcs.service)
+		}
+	}
+}
+
+func (hc *healthChecker) dueProbes() []*healthProbe {
+	c := hc.services
+	c.Lock()
+	defer c.Unlock()
+	var probes = []*healthProbe{}
+	for _, svcs := range c.services {
+		conf := hc.config(svcs)
+		for addr, h := range svcs.health {
+			if time.Since(h.checked) < conf.Interval {
+				continue
+			}
+			client, ok := svcs.client[addr]
+			if !ok {
+				var err error
+				if client, err = grpc.NewClient(addr, grpc.WithTransportCredentials(hc.creds)); err != nil {
+					hc.logger.Error().Err(err).Msgf("cannot create health check client for %s::%s", svcs.service, addr)
+					continue
+				}
+				svcs.client[addr] = client
+			}
+			h.checked = time.Now()
+			probes = append(probes, &healthProbe{
+				svcs:   svcs,
+				addr:   addr,
+				client: client,
+				config: conf,
+			})
+		}
+	}
+	return probes
+}
+
+func (hc *healthChecker) probe(p *healthProbe) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.Timeout)
+	defer cancel()
+	switch p.config.Protocol {
+	case HealthProtocolPing:
+		resp := &pbgeneric.DefaultResponse{}
+		if err := p.client.Invoke(ctx, fmt.Sprintf("/%s/Ping", p.svcs.name), &emptypb.Empty{}, resp); err != nil {
+			return errors.Wrap(err, "cannot ping")
+		}
+		if resp.GetStatus() != pbgeneric.ResultStatus_OK {
+			return errors.Errorf("ping status %s: %s", resp.GetStatus(), resp.GetMessage())
+		}
+	default:
+		resp, err := healthpb.NewHealthClient(p.client).Check(ctx, &healthpb.HealthCheckRequest{Service: p.svcs.name})
+		if err != nil {
+			return errors.Wrap(err, "cannot check health")
+		}
+		if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+			return errors.Errorf("health status %s", resp.GetStatus())
+		}
+	}
+	return nil
+}
+
+// update applies the probe result. lock must be held by caller
+// returns true, if the set of available addresses changed
+func (hc *healthChecker) update(p *healthProbe) bool {
+	svcs := p.svcs
+	h, ok := svcs.health[p.addr]
+	if !ok {
+		return false
+	}
+	if p.err == nil {
+		h.failures = 0
+		if h.state == InstanceUnhealthy {
+			hc.logger.Info().Msgf("%s::%s healthy", svcs.service, p.addr)
+			h.state = InstanceHealthy
+			hc.services.event(pb.EventType_EVENT_HEALTHY, svcs, p.addr, "", caller{})
+			return true
+		}
+		return false
+	}
+	h.failures++
+	hc.logger.Debug().Err(p.err).Msgf("health check %s::%s failed [%d/%d]", svcs.service, p.addr, h.failures, p.config.FailureThreshold)
+	if svcs.provisional[p.addr] {
+		hc.logger.Info().Msgf("provisional address %s::%s not available", svcs.service, p.addr)
+		hc.services.removeAddress(svcs, p.addr, pb.EventType_EVENT_REMOVED, fmt.Sprintf("provisional address not available: %v", p.err), caller{})
+		if hc.services.onExpire != nil {
+			hc.services.onExpire(svcs, 1)
+		}
+		return true
+	}
+	if h.state == InstanceHealthy && h.failures >= p.config.FailureThreshold {
+		hc.logger.Info().Msgf("%s::%s unhealthy", svcs.service, p.addr)
+		h.state = InstanceUnhealthy
+		hc.services.event(pb.EventType_EVENT_UNHEALTHY, svcs, p.addr, p.err.Error(), caller{})
+		return true
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package service
+
+import (
+	"emperror.dev/errors"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestHealthUpdate(t *testing.T) {
+	failed := errors.New("connection refused")
+	tests := []struct {
+		name      string
+		state     InstanceState
+		threshold int
+		results   []error
+		states    []InstanceState
+		changed   []bool
+	}{
+		{
+			name:      "failure threshold",
+			threshold: 3,
+			results:   []error{failed, failed, failed, failed},
+			states:    []InstanceState{InstanceHealthy, InstanceHealthy, InstanceUnhealthy, InstanceUnhealthy},
+			changed:   []bool{false, false, true, false},
+		},
+		{
+			name:      "success resets the failures",
+			threshold: 2,
+			results:   []error{failed, nil, failed},
+			states:    []InstanceState{InstanceHealthy, InstanceHealthy, InstanceHealthy},
+			changed:   []bool{false, false, false},
+		},
+		{
+			name:      "recovery",
+			threshold: 2,
+			results:   []error{failed, failed, nil, failed},
+			states:    []InstanceState{InstanceHealthy, InstanceUnhealthy, InstanceHealthy, InstanceHealthy},
+			changed:   []bool{false, true, true, false},
+		},
+		{
+			name:      "draining survives probes",
+			state:     InstanceDraining,
+			threshold: 1,
+			results:   []error{nil, failed, failed, nil},
+			states:    []InstanceState{InstanceDraining, InstanceDraining, InstanceDraining, InstanceDraining},
+			changed:   []bool{false, false, false, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCache(time.Minute, testLogger())
+			defer c.Close()
+			c.events, _ = newEventLog(10, "", testLogger())
+			c.addService("svc", &pb.ServiceInstance{Addr: "a:1"}, []string{"dom"}, false, time.Now(), caller{})
+			svcs := c.services["dom.svc"]
+			svcs.health["a:1"].state = tt.state
+			hc := newHealthChecker(nil, HealthCheckConfig{FailureThreshold: tt.threshold}, nil, c, testLogger())
+			for i, err := range tt.results {
+				changed := hc.update(&healthProbe{svcs: svcs, addr: "a:1", config: hc.defaultConfig, err: err})
+				if state := svcs.health["a:1"].state; state != tt.states[i] || changed != tt.changed[i] {
+					t.Errorf("probe %d: %s (changed %v), want %s (changed %v)", i, state, changed, tt.states[i], tt.changed[i])
+				}
+			}
+		})
+	}
+}
+
+func TestHealthProvisionalRemoval(t *testing.T) {
+	c := newCache(time.Minute, testLogger())
+	defer c.Close()
+	c.events, _ = newEventLog(10, "", testLogger())
+	var expired int
+	c.onExpire = func(svcs *serviceEntry, n int) { expired += n }
+	svcs := NewServiceEntry("dom", "svc", testLogger())
+	svcs.addProvisionalAddress(&pb.ServiceInstance{Addr: "a:1"}, time.Now())
+	c.services["dom.svc"] = svcs
+
+	hc := newHealthChecker(nil, HealthCheckConfig{FailureThreshold: 3}, nil, c, testLogger())
+	if !hc.update(&healthProbe{svcs: svcs, addr: "a:1", config: hc.defaultConfig, err: errors.New("connection refused")}) {
+		t.Error("removal of provisional address not reported as change")
+	}
+	if _, ok := c.services["dom.svc"]; ok {
+		t.Error("empty service entry not removed")
+	}
+	if _, _, ok := c.getServicesFold("dom.svc"); ok {
+		t.Error("service without addresses still resolvable")
+	}
+	if !c.removedAfter("svc", "a:1", []string{"dom"}, time.Now().Add(-time.Second)) {
+		t.Error("no tombstone for removed provisional address")
+	}
+	if expired != 1 {
+		t.Errorf("%d expired instances counted, want 1", expired)
+	}
+	if events, _, _ := c.events.get(0, 0, ""); len(events) != 1 || events[0].GetType() != pb.EventType_EVENT_REMOVED {
+		t.Errorf("events %v, want one removal", events)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	server := grpc.NewServer()
+	status := health.NewServer()
+	healthpb.RegisterHealthServer(server, status)
+	go server.Serve(lis)
+	defer server.Stop()
+	addr := lis.Addr().String()
+
+	c := newCache(time.Minute, testLogger())
+	defer c.Close()
+	c.events, _ = newEventLog(10, "", testLogger())
+	c.addService("svc", &pb.ServiceInstance{Addr: addr}, []string{"dom"}, false, time.Now(), caller{})
+	conf := HealthCheckConfig{Protocol: HealthProtocolGRPC, Timeout: time.Second, FailureThreshold: 2}
+	hc := newHealthChecker(nil, conf, nil, c, testLogger())
+	available := func() []string {
+		c.Lock()
+		defer c.Unlock()
+		return slices.Clone(c.services["dom.svc"].getAvailableAddresses())
+	}
+
+	status.SetServingStatus("svc", healthpb.HealthCheckResponse_SERVING)
+	hc.check()
+	if got := available(); !slices.Equal(got, []string{addr}) {
+		t.Fatalf("serving instance: available %v", got)
+	}
+	status.SetServingStatus("svc", healthpb.HealthCheckResponse_NOT_SERVING)
+	hc.check()
+	if got := available(); !slices.Equal(got, []string{addr}) {
+		t.Fatalf("instance unavailable before failure threshold")
+	}
+	hc.check()
+	if got := available(); len(got) != 0 {
+		t.Fatalf("unhealthy instance available: %v", got)
+	}
+	status.SetServingStatus("svc", healthpb.HealthCheckResponse_SERVING)
+	hc.check()
+	if got := available(); !slices.Equal(got, []string{addr}) {
+		t.Fatalf("recovered instance: available %v", got)
+	}
+}
@@ -0,0 +1,189 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"sync"
+	"time"
+)
+
+// DefaultMinLeaseTTL is the shortest lease a client may request
+const DefaultMinLeaseTTL = 5 * time.Second
+
+// leaseInstance identifies an instance of a service in one domain
+type leaseInstance struct {
+	service string
+	domain  string
+	addr    string
+}
+
+type lease struct {
+	id      uint64
+	ttl     time.Duration
+	expires time.Time
+	timer   *time.Timer
+	entries map[leaseInstance]*pb.ReplicationEntry
+}
+
+// newLeases manages the leases of all registered instances. onExpire is called with the
+// registrations of every lease, which was not renewed within its ttl
+func newLeases(minTTL, maxTTL time.Duration, onExpire func(id uint64, entries []*pb.ReplicationEntry), logger zLogger.ZLogger) *leases {
+	return &leases{
+		minTTL:    minTTL,
+		maxTTL:    maxTTL,
+		leases:    map[uint64]*lease{},
+		instances: map[leaseInstance]uint64{},
+		onExpire:  onExpire,
+		logger:    logger,
+	}
+}
+
+type leases struct {
+	sync.Mutex
+	minTTL    time.Duration
+	maxTTL    time.Duration
+	leases    map[uint64]*lease
+	instances map[leaseInstance]uint64 // lease of every instance
+	onExpire  func(id uint64, entries []*pb.ReplicationEntry)
+	logger    zLogger.ZLogger
+}
+
+func (ls *leases) Close() {
+	ls.Lock()
+	defer ls.Unlock()
+	for _, l := range ls.leases {
+		l.timer.Stop()
+	}
+	ls.leases = map[uint64]*lease{}
+	ls.instances = map[leaseInstance]uint64{}
+}
+
+// ttl limits the requested ttl to the bounds of the server. 0 requests the maximum
+func (ls *leases) ttl(requested time.Duration) time.Duration {
+	switch {
+	case requested <= 0 || requested > ls.maxTTL:
+		return ls.maxTTL
+	case requested < ls.minTTL:
+		return ls.minTTL
+	default:
+		return requested
+	}
+}
+
+func newLeaseID() uint64 {
+	var b [8]byte
+	for {
+		rand.Read(b[:])
+		// lease ids are positive int64 values for clients without unsigned types
+		if id := binary.BigEndian.Uint64(b[:]) >> 1; id != 0 {
+			return id
+		}
+	}
+}
+
+func entryInstance(entry *pb.ReplicationEntry) leaseInstance {
+	var domain string
+	if len(entry.GetDomains()) > 0 {
+		domain = entry.GetDomains()[0]
+	}
+	return leaseInstance{service: entry.GetService(), domain: domain, addr: entry.GetAddr()}
+}
+
+// grant adds the registrations (one domain each) to the lease id, which is renewed.
+// a new lease is created if id is 0 or unknown. an instance belongs to one lease only,
+// so a registration moves it from its previous lease
+func (ls *leases) grant(id uint64, ttl time.Duration, entries []*pb.ReplicationEntry) (uint64, time.Duration) {
+	ls.Lock()
+	defer ls.Unlock()
+	l, ok := ls.leases[id]
+	if ok {
+		l.expires = time.Now().Add(l.ttl)
+		l.timer.Reset(l.ttl)
+	} else {
+		for id = newLeaseID(); ls.leases[id] != nil; id = newLeaseID() {
+		}
+		l = &lease{
+			id:      id,
+			ttl:     ls.ttl(ttl),
+			entries: map[leaseInstance]*pb.ReplicationEntry{},
+		}
+		l.expires = time.Now().Add(l.ttl)
+		l.timer = time.AfterFunc(l.ttl, func() { ls.expire(id) })
+		ls.leases[id] = l
+		ls.logger.Debug().Msgf("lease %d granted with ttl %v", id, l.ttl)
+	}
+	for _, entry := range entries {
+		inst := entryInstance(entry)
+		if old, ok := ls.instances[inst]; ok && old != id {
+			ls.detachLocked(inst)
+		}
+		ls.instances[inst] = id
+		l.entries[inst] = entry
+	}
+	return id, l.ttl
+}
+
+// keepAlive renews the lease and returns its ttl and registrations. the ttl is 0 if the lease has expired
+func (ls *leases) keepAlive(id uint64) (time.Duration, []*pb.ReplicationEntry) {
+	ls.Lock()
+	defer ls.Unlock()
+	l, ok := ls.leases[id]
+	if !ok {
+		return 0, nil
+	}
+	l.expires = time.Now().Add(l.ttl)
+	l.timer.Reset(l.ttl)
+	entries := make([]*pb.ReplicationEntry, 0, len(l.entries))
+	for _, entry := range l.entries {
+		entries = append(entries, entry)
+	}
+	return l.ttl, entries
+}
+
+// detach removes the instance from its lease
+func (ls *leases) detach(inst leaseInstance) {
+	ls.Lock()
+	defer ls.Unlock()
+	ls.detachLocked(inst)
+}
+
+// detachLocked removes the instance from its lease. a lease without instances is revoked
+// lock must be held by caller
+func (ls *leases) detachLocked(inst leaseInstance) {
+	id, ok := ls.instances[inst]
+	if !ok {
+		return
+	}
+	delete(ls.instances, inst)
+	if l, ok := ls.leases[id]; ok {
+		delete(l.entries, inst)
+		if len(l.entries) == 0 {
+			l.timer.Stop()
+			delete(ls.leases, id)
+			ls.logger.Debug().Msgf("lease %d revoked without instances", id)
+		}
+	}
+}
+
+func (ls *leases) expire(id uint64) {
+	ls.Lock()
+	l, ok := ls.leases[id]
+	// the timer may fire concurrently with a renewal
+	if !ok || time.Now().Before(l.expires) {
+		ls.Unlock()
+		return
+	}
+	delete(ls.leases, id)
+	entries := make([]*pb.ReplicationEntry, 0, len(l.entries))
+	for inst, entry := range l.entries {
+		delete(ls.instances, inst)
+		entries = append(entries, entry)
+	}
+	ls.Unlock()
+	ls.logger.Debug().Msgf("lease %d expired with %d instances", id, len(entries))
+	if ls.onExpire != nil {
+		ls.onExpire(id, entries)
+	}
+}
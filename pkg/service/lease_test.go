@@ -0,0 +1,107 @@
+package service
+
+import (
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"testing"
+	"time"
+)
+
+func leaseEntry(service, domain, addr string) *pb.ReplicationEntry {
+	return &pb.ReplicationEntry{Operation: pb.ReplicationOperation_REPLICATION_ADD, Service: service, Domains: []string{domain}, Addr: addr}
+}
+
+func TestLeaseTTL(t *testing.T) {
+	ls := newLeases(5*time.Second, time.Minute, nil, testLogger())
+	defer ls.Close()
+	tests := []struct {
+		requested time.Duration
+		want      time.Duration
+	}{
+		{0, time.Minute},
+		{-time.Second, time.Minute},
+		{time.Hour, time.Minute},
+		{time.Second, 5 * time.Second},
+		{30 * time.Second, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		id, ttl := ls.grant(0, tt.requested, []*pb.ReplicationEntry{leaseEntry("svc", "dom", "a:1")})
+		if id == 0 || int64(id) < 0 {
+			t.Errorf("invalid lease id %d", id)
+		}
+		if ttl != tt.want {
+			t.Errorf("ttl for %v: %v, want %v", tt.requested, ttl, tt.want)
+		}
+	}
+}
+
+func TestLeaseGrant(t *testing.T) {
+	ls := newLeases(time.Second, time.Minute, nil, testLogger())
+	defer ls.Close()
+	a := leaseEntry("svc", "dom", "a:1")
+	b := leaseEntry("svc", "dom", "b:2")
+
+	first, _ := ls.grant(0, 0, []*pb.ReplicationEntry{a})
+	if id, _ := ls.grant(first, 0, []*pb.ReplicationEntry{b}); id != first {
+		t.Fatalf("renewal granted lease %d, want %d", id, first)
+	}
+	if ttl, entries := ls.keepAlive(first); ttl != time.Minute || len(entries) != 2 {
+		t.Fatalf("keepAlive: %v, %d entries, want %v, 2 entries", ttl, len(entries), time.Minute)
+	}
+	if id, _ := ls.grant(12345, 0, nil); id == 12345 {
+		t.Error("unknown lease id granted")
+	}
+
+	// the instances move to the new lease, the empty lease is revoked
+	second, _ := ls.grant(0, 0, []*pb.ReplicationEntry{a})
+	if _, entries := ls.keepAlive(first); len(entries) != 1 || entries[0] != b {
+		t.Errorf("first lease after move: %v, want %v", entries, []*pb.ReplicationEntry{b})
+	}
+	ls.detach(entryInstance(b))
+	if ttl, _ := ls.keepAlive(first); ttl != 0 {
+		t.Error("lease without instances not revoked")
+	}
+	if ttl, entries := ls.keepAlive(second); ttl == 0 || len(entries) != 1 || entries[0] != a {
+		t.Errorf("second lease: %v, %v, want %v", ttl, entries, []*pb.ReplicationEntry{a})
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	type expiry struct {
+		id      uint64
+		entries []*pb.ReplicationEntry
+	}
+	expired := make(chan expiry, 2)
+	ls := newLeases(10*time.Millisecond, time.Minute, func(id uint64, entries []*pb.ReplicationEntry) {
+		expired <- expiry{id: id, entries: entries}
+	}, testLogger())
+	defer ls.Close()
+
+	renewed, _ := ls.grant(0, 200*time.Millisecond, []*pb.ReplicationEntry{leaseEntry("svc", "dom", "a:1")})
+	idle, _ := ls.grant(0, 200*time.Millisecond, []*pb.ReplicationEntry{leaseEntry("svc", "dom", "b:2"), leaseEntry("svc", "other", "b:2")})
+	for i := 0; i < 8; i++ {
+		time.Sleep(40 * time.Millisecond)
+		if ttl, _ := ls.keepAlive(renewed); ttl == 0 {
+			t.Fatal("renewed lease expired")
+		}
+	}
+	select {
+	case e := <-expired:
+		if e.id != idle || len(e.entries) != 2 {
+			t.Errorf("expired lease %d with %d entries, want %d with 2 entries", e.id, len(e.entries), idle)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lease not expired")
+	}
+	if ttl, _ := ls.keepAlive(idle); ttl != 0 {
+		t.Error("keepAlive of expired lease")
+	}
+
+	select {
+	case e := <-expired:
+		if e.id != renewed {
+			t.Errorf("expired lease %d, want %d", e.id, renewed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lease without renewal not expired")
+	}
+}
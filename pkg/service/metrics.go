@@ -0,0 +1,158 @@
+package service
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"io"
+	"path"
+	"time"
+)
+
+const metricsNamespace = "miniresolver"
+
+const (
+	resultOK       = "ok"
+	resultNotFound = "not_found"
+	resultError    = "error"
+	resultRejected = "rejected"
+)
+
+// unknownService is the service label of requests for services, which are not registered.
+// otherwise every client could create new time series with random names
+const unknownService = "unknown"
+
+const (
+	proxyUpstream   = "upstream"   // client to service
+	proxyDownstream = "downstream" // service to client
+)
+
+// newMetrics creates all collectors. they are registered only if WithMetrics is used
+func newMetrics(services *cache) *metrics {
+	return &metrics{
+		services: services,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_total",
+			Help:      "number of registry requests by method, service and result",
+		}, []string{"method", "service", "result"}),
+		expired: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "expired_instances_total",
+			Help:      "number of instances removed, because they were not refreshed",
+		}, []string{"domain", "service"}),
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "rpc_duration_seconds",
+			Help:      "latency of unary grpc calls",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "code"}),
+		instancesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "registered_instances"),
+			"number of registered instances by domain, service and health state",
+			[]string{"domain", "service", "state"}, nil,
+		),
+		proxySessions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "proxy",
+			Name:      "sessions_total",
+			Help:      "number of proxy CONNECT sessions by result",
+		}, []string{"result"}),
+		proxyActive: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "proxy",
+			Name:      "active_sessions",
+			Help:      "number of open proxy CONNECT sessions",
+		}),
+		proxyBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "proxy",
+			Name:      "bytes_total",
+			Help:      "bytes copied by the proxy (upstream: client to service, downstream: service to client)",
+		}, []string{"direction"}),
+		proxyFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "proxy",
+			Name:      "failures_total",
+			Help:      "number of proxy failures by reason",
+		}, []string{"reason"}),
+		reverseProxyRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "reverseproxy",
+			Name:      "requests_total",
+			Help:      "number of reverse proxy requests by routing result",
+		}, []string{"result"}),
+	}
+}
+
+type metrics struct {
+	services      *cache
+	requests      *prometheus.CounterVec
+	expired       *prometheus.CounterVec
+	rpcDuration   *prometheus.HistogramVec
+	instancesDesc *prometheus.Desc
+	proxySessions *prometheus.CounterVec
+	proxyActive   prometheus.Gauge
+	proxyBytes    *prometheus.CounterVec
+	proxyFailures *prometheus.CounterVec
+
+	reverseProxyRequests *prometheus.CounterVec
+}
+
+func (m *metrics) register(registerer prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{m, m.requests, m.expired, m.rpcDuration, m.proxySessions, m.proxyActive, m.proxyBytes, m.proxyFailures, m.reverseProxyRequests} {
+		if err := registerer.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Describe implements prometheus.Collector for the registered instances
+func (m *metrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.instancesDesc
+}
+
+// Collect implements prometheus.Collector. the instances are counted at scrape time
+func (m *metrics) Collect(ch chan<- prometheus.Metric) {
+	m.services.Lock()
+	defer m.services.Unlock()
+	for _, svcs := range m.services.services {
+		counts := map[InstanceState]int{}
+		for _, addr := range svcs.getAddresses() {
+			state := InstanceHealthy
+			if h, ok := svcs.health[addr]; ok {
+				state = h.state
+			}
+			counts[state]++
+		}
+		for state, count := range counts {
+			ch <- prometheus.MustNewConstMetric(m.instancesDesc, prometheus.GaugeValue, float64(count), svcs.domain, svcs.name, state.String())
+		}
+	}
+}
+
+func (m *metrics) request(method, service, result string) {
+	m.requests.WithLabelValues(method, service, result).Inc()
+}
+
+// unaryServerInterceptor measures the latency of all unary calls
+func (m *metrics) unaryServerInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	m.rpcDuration.WithLabelValues(path.Base(info.FullMethod), status.Code(err).String()).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// countingWriter counts the bytes written to the proxy connection
+type countingWriter struct {
+	w       io.Writer
+	counter prometheus.Counter
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.counter.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,43 @@
+package service
+
+import (
+	"context"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"testing"
+	"time"
+)
+
+func TestRequestMetricsServiceLabel(t *testing.T) {
+	d := NewMiniResolver(0, time.Minute, "", testLogger())
+	defer d.Close()
+	ctx := context.Background()
+	if _, err := d.AddService(ctx, serviceData("svc", "dom", 1001)); err != nil {
+		t.Fatalf("cannot add service: %v", err)
+	}
+	for _, name := range []string{"dom.svc", "dom.random1", "dom.random2"} {
+		d.ResolveServices(ctx, &pb.ServiceQuery{Name: name})
+		d.ResolveService(ctx, &pb.ServiceQuery{Name: name})
+	}
+	d.RemoveService(ctx, serviceData("random3", "dom", 1001))
+
+	tests := []struct {
+		method, service, result string
+		want                    float64
+	}{
+		{"AddService", "svc", resultOK, 1},
+		{"ResolveServices", "dom.svc", resultOK, 1},
+		{"ResolveService", "dom.svc", resultOK, 1},
+		{"ResolveServices", unknownService, resultNotFound, 2},
+		{"ResolveService", unknownService, resultNotFound, 2},
+		{"RemoveService", unknownService, resultOK, 1},
+	}
+	for _, tt := range tests {
+		if got := testutil.ToFloat64(d.metrics.requests.WithLabelValues(tt.method, tt.service, tt.result)); got != tt.want {
+			t.Errorf("%s %s %s: %v, want %v", tt.method, tt.service, tt.result, got, tt.want)
+		}
+	}
+	if got := testutil.CollectAndCount(d.metrics.requests); got != len(tests) {
+		t.Errorf("%d time series, want %d", got, len(tests))
+	}
+}
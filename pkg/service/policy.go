@@ -0,0 +1,134 @@
+package service
+
+import (
+	"context"
+	"crypto/x509"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"path"
+	"slices"
+)
+
+// PolicyRule allows all callers with a matching identity to register and remove instances of
+// the matching services. all patterns use path.Match syntax (i.e. "grpc:ubbasel.*", "mediaserverproto.*")
+type PolicyRule struct {
+	// Identity is matched against the URI SANs and the common name of the client certificate
+	Identity string
+	// Services are the allowed service names without domain. empty allows all services
+	Services []string
+	// Domains are the allowed domains. "" is the domain of services without domain. empty allows all domains
+	Domains []string
+	// Replicate allows the identity to replicate all mutations as cluster peer
+	Replicate bool
+}
+
+// certificateKey is the context key of client certificates given by in-process callers
+type certificateKey struct{}
+
+// NewCertificateContext sets the verified client certificate of in-process callers like the admin api,
+// which are not called via grpc
+func NewCertificateContext(ctx context.Context, cert *x509.Certificate) context.Context {
+	return context.WithValue(ctx, certificateKey{}, cert)
+}
+
+// identities returns the URI SANs and the common name of the client certificate
+func identities(ctx context.Context) []string {
+	if cert, ok := ctx.Value(certificateKey{}).(*x509.Certificate); ok {
+		return certIdentities(cert)
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return nil
+	}
+	return certIdentities(tlsInfo.State.PeerCertificates[0])
+}
+
+func certIdentities(cert *x509.Certificate) []string {
+	var result []string
+	for _, u := range cert.URIs {
+		result = append(result, u.String())
+	}
+	if cert.Subject.CommonName != "" {
+		result = append(result, cert.Subject.CommonName)
+	}
+	return result
+}
+
+func newPolicy(rules []PolicyRule, logger zLogger.ZLogger) *policy {
+	return &policy{
+		rules:  rules,
+		logger: logger,
+	}
+}
+
+// policy allows mutations of the registry only for callers matching a rule.
+// everything not allowed is denied
+type policy struct {
+	rules  []PolicyRule
+	logger zLogger.ZLogger
+}
+
+func matchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		ok, _ := path.Match(pattern, value)
+		return ok
+	})
+}
+
+// matchingRules returns all rules of the identities
+func (p *policy) matchingRules(ids []string) []PolicyRule {
+	var result []PolicyRule
+	for _, rule := range p.rules {
+		if slices.ContainsFunc(ids, func(id string) bool {
+			ok, _ := path.Match(rule.Identity, id)
+			return ok
+		}) {
+			result = append(result, rule)
+		}
+	}
+	return result
+}
+
+// authorize checks whether the caller may change the instances of service in all domains
+func (p *policy) authorize(ctx context.Context, method, service string, domains []string) error {
+	if p == nil {
+		return nil
+	}
+	if len(domains) == 0 {
+		domains = []string{""}
+	}
+	ids := identities(ctx)
+	rules := p.matchingRules(ids)
+	for _, domain := range domains {
+		if !slices.ContainsFunc(rules, func(rule PolicyRule) bool {
+			return matchAny(rule.Services, service) && matchAny(rule.Domains, domain)
+		}) {
+			p.logger.Warn().Strs("identities", ids).Msgf("%s of '%s' in domain '%s' denied", method, service, domain)
+			return status.Errorf(codes.PermissionDenied, "%v not allowed to change service '%s' in domain '%s'", ids, service, domain)
+		}
+	}
+	return nil
+}
+
+// authorizeReplication checks whether the caller is a cluster peer
+func (p *policy) authorizeReplication(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	ids := identities(ctx)
+	if !slices.ContainsFunc(p.matchingRules(ids), func(rule PolicyRule) bool { return rule.Replicate }) {
+		p.logger.Warn().Strs("identities", ids).Msg("replication denied")
+		return status.Errorf(codes.PermissionDenied, "%v not allowed to replicate", ids)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"net/url"
+	"testing"
+)
+
+func TestPolicyAuthorize(t *testing.T) {
+	p := newPolicy([]PolicyRule{
+		{Identity: "grpc:ubbasel.*", Services: []string{"mediaserverproto.*"}, Domains: []string{"ubbasel"}},
+		{Identity: "operator", Domains: []string{"test"}},
+	}, testLogger())
+	grpcURI, _ := url.Parse("grpc:ubbasel.mediaserverproto.Action")
+	service := &x509.Certificate{URIs: []*url.URL{grpcURI}, Subject: pkix.Name{CommonName: "action"}}
+	operator := &x509.Certificate{Subject: pkix.Name{CommonName: "operator"}}
+	grpcPeer := func(cert *x509.Certificate) context.Context {
+		return peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}}})
+	}
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		service string
+		domains []string
+		allowed bool
+	}{
+		{"grpc caller", grpcPeer(service), "mediaserverproto.Action", []string{"ubbasel"}, true},
+		{"grpc caller in other domain", grpcPeer(service), "mediaserverproto.Action", []string{"ubbasel", "test"}, false},
+		{"grpc caller of other service", grpcPeer(service), "other", []string{"ubbasel"}, false},
+		{"certificate of in-process caller", NewCertificateContext(context.Background(), operator), "other", []string{"test"}, true},
+		{"certificate of in-process caller in other domain", NewCertificateContext(context.Background(), operator), "other", nil, false},
+		{"in-process caller without certificate", context.Background(), "other", []string{"test"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.authorize(tt.ctx, "AddService", tt.service, tt.domains)
+			if allowed := err == nil; allowed != tt.allowed {
+				t.Errorf("allowed %v, want %v (%v)", allowed, tt.allowed, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"path"
+	"slices"
+)
+
+// ProxyRule allows all proxy clients with a matching identity to connect to the matching services.
+// all patterns use path.Match syntax
+type ProxyRule struct {
+	// Identity is matched against the user of the Proxy-Authorization credentials and
+	// the URI SANs and the common name of the client certificate
+	Identity string
+	// Services are the reachable service names without domain. empty allows all services
+	Services []string
+	// Domains are the reachable domains. "" is the domain of services without domain. empty allows all domains
+	Domains []string
+}
+
+// proxyRealm is the realm of the basic authentication challenge
+const proxyRealm = "miniresolver"
+
+func newProxyAuth(users map[string]string, rules []ProxyRule, logger zLogger.ZLogger) *proxyAuth {
+	a := &proxyAuth{
+		users:  map[string][]byte{},
+		rules:  rules,
+		logger: logger,
+	}
+	for user, hash := range users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			logger.Error().Err(err).Msgf("invalid bcrypt hash of proxy user '%s'", user)
+			continue
+		}
+		a.users[user] = []byte(hash)
+	}
+	return a
+}
+
+// proxyAuth authenticates proxy clients by client certificate or Proxy-Authorization credentials.
+// everything not allowed by a rule is denied
+type proxyAuth struct {
+	users  map[string][]byte // bcrypt hashes of the passwords
+	rules  []ProxyRule
+	logger zLogger.ZLogger
+}
+
+// authenticate returns the identities of the verified client certificate and of the Proxy-Authorization credentials.
+// ok is false if there is neither a client certificate nor valid credentials
+func (a *proxyAuth) authenticate(req *http.Request) (ids []string, ok bool) {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && len(req.TLS.VerifiedChains[0]) > 0 {
+		ids = certIdentities(req.TLS.VerifiedChains[0][0])
+	}
+	if user, password, found := proxyBasicAuth(req); found {
+		hash, known := a.users[user]
+		if !known || bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+			a.logger.Warn().Msgf("invalid proxy credentials of user '%s' from %s", user, req.RemoteAddr)
+			return nil, false
+		}
+		ids = append(ids, user)
+	}
+	return ids, len(ids) > 0
+}
+
+// allowed checks whether one of the identities may connect to service in domain
+func (a *proxyAuth) allowed(ids []string, domain, service string) bool {
+	return slices.ContainsFunc(a.rules, func(rule ProxyRule) bool {
+		return slices.ContainsFunc(ids, func(id string) bool {
+			ok, _ := path.Match(rule.Identity, id)
+			return ok
+		}) && matchAny(rule.Services, service) && matchAny(rule.Domains, domain)
+	})
+}
+
+// proxyBasicAuth returns the basic credentials of the Proxy-Authorization header
+func proxyBasicAuth(req *http.Request) (user, password string, ok bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return "", "", false
+	}
+	r := &http.Request{Header: http.Header{"Authorization": []string{auth}}}
+	return r.BasicAuth()
+}
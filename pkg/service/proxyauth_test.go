@@ -0,0 +1,241 @@
+package service
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+func testProxyUsers(t *testing.T) map[string]string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("cannot hash password: %v", err)
+	}
+	return map[string]string{"ci": string(hash), "invalid": "no bcrypt hash"}
+}
+
+var testProxyRules = []ProxyRule{
+	{Identity: "ci", Services: []string{"svc"}, Domains: []string{"dom"}},
+	{Identity: "grpc:ops.*"},
+}
+
+func basicProxyAuth(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+func TestProxyAuthenticate(t *testing.T) {
+	a := newProxyAuth(testProxyUsers(t), testProxyRules, testLogger())
+	opsURI, _ := url.Parse("grpc:ops.deploy")
+	cert := &x509.Certificate{URIs: []*url.URL{opsURI}, Subject: pkix.Name{CommonName: "deploy"}}
+	tests := []struct {
+		name     string
+		auth     string
+		verified bool // verified client certificate
+		given    bool // client certificate without verification
+		ids      []string
+		ok       bool
+	}{
+		{name: "anonymous"},
+		{name: "credentials", auth: basicProxyAuth("ci", "secret"), ids: []string{"ci"}, ok: true},
+		{name: "wrong password", auth: basicProxyAuth("ci", "wrong")},
+		{name: "unknown user", auth: basicProxyAuth("other", "secret")},
+		{name: "user with invalid hash", auth: basicProxyAuth("invalid", "no bcrypt hash")},
+		{name: "no basic auth", auth: "Bearer token"},
+		{name: "client certificate", verified: true, ids: []string{"grpc:ops.deploy", "deploy"}, ok: true},
+		{name: "client certificate and credentials", verified: true, auth: basicProxyAuth("ci", "secret"), ids: []string{"grpc:ops.deploy", "deploy", "ci"}, ok: true},
+		{name: "client certificate and wrong password", verified: true, auth: basicProxyAuth("ci", "wrong")},
+		{name: "unverified client certificate", given: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodConnect, "http://dom.svc", nil)
+			if tt.auth != "" {
+				req.Header.Set("Proxy-Authorization", tt.auth)
+			}
+			if tt.verified || tt.given {
+				req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+				if tt.verified {
+					req.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+				}
+			}
+			ids, ok := a.authenticate(req)
+			if ok != tt.ok || !slices.Equal(ids, tt.ids) {
+				t.Errorf("authenticate: %v, %v, want %v, %v", ids, ok, tt.ids, tt.ok)
+			}
+		})
+	}
+}
+
+func TestProxyAuthAllowed(t *testing.T) {
+	a := newProxyAuth(nil, testProxyRules, testLogger())
+	tests := []struct {
+		ids             []string
+		domain, service string
+		want            bool
+	}{
+		{[]string{"ci"}, "dom", "svc", true},
+		{[]string{"ci"}, "dom", "other", false},
+		{[]string{"ci"}, "", "svc", false},
+		{[]string{"grpc:ops.deploy", "deploy"}, "any", "other", true},
+		{[]string{"deploy"}, "dom", "svc", false},
+		{nil, "dom", "svc", false},
+	}
+	for _, tt := range tests {
+		if got := a.allowed(tt.ids, tt.domain, tt.service); got != tt.want {
+			t.Errorf("allowed(%v, %s, %s) = %v, want %v", tt.ids, tt.domain, tt.service, got, tt.want)
+		}
+	}
+}
+
+func TestReverseProxyAuth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "credentials: "+req.Header.Get("Proxy-Authorization"))
+	}))
+	defer backend.Close()
+	c := newCache(time.Minute, testLogger())
+	defer c.Close()
+	for _, service := range []string{"svc", "other"} {
+		c.addService(service, &pb.ServiceInstance{Addr: backend.Listener.Addr().String()}, []string{"dom"}, false, time.Now(), caller{})
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		auth   []string // Proxy-Authorization of the requests
+		limits ProxyLimits
+		status []int
+	}{
+		{name: "allowed", target: "http://dom.svc/", auth: []string{basicProxyAuth("ci", "secret")}, status: []int{http.StatusOK}},
+		{name: "path routing", target: "http://proxy/DOM.svc/", auth: []string{basicProxyAuth("ci", "secret")}, status: []int{http.StatusOK}},
+		{name: "anonymous", target: "http://dom.svc/", auth: []string{""}, status: []int{http.StatusProxyAuthRequired}},
+		{name: "wrong password", target: "http://dom.svc/", auth: []string{basicProxyAuth("ci", "wrong")}, status: []int{http.StatusProxyAuthRequired}},
+		{name: "service of other rule", target: "http://dom.other/", auth: []string{basicProxyAuth("ci", "secret")}, status: []int{http.StatusForbidden}},
+		{name: "unknown service", target: "http://dom.unknown/", auth: []string{basicProxyAuth("ci", "secret")}, status: []int{http.StatusNotFound}},
+		{
+			name:   "rate limit before authentication",
+			target: "http://dom.svc/",
+			auth:   []string{basicProxyAuth("ci", "wrong"), basicProxyAuth("ci", "wrong"), basicProxyAuth("ci", "secret")},
+			limits: ProxyLimits{Rate: 0.001, Burst: 2},
+			status: []int{http.StatusProxyAuthRequired, http.StatusProxyAuthRequired, http.StatusTooManyRequests},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := newProxyAuth(testProxyUsers(t), testProxyRules, testLogger())
+			rp := newReverseProxy("", nil, c, newProxyLimiter(tt.limits), auth, newMetrics(c), testLogger())
+			for i, credentials := range tt.auth {
+				req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+				if credentials != "" {
+					req.Header.Set("Proxy-Authorization", credentials)
+				}
+				w := httptest.NewRecorder()
+				rp.ServeHTTP(w, req)
+				if w.Code != tt.status[i] {
+					t.Fatalf("request %d: status %d, want %d", i, w.Code, tt.status[i])
+				}
+				switch w.Code {
+				case http.StatusOK:
+					if body := w.Body.String(); body != "credentials: " {
+						t.Errorf("proxy credentials forwarded: %s", body)
+					}
+				case http.StatusProxyAuthRequired:
+					if w.Header().Get("Proxy-Authenticate") == "" {
+						t.Error("no Proxy-Authenticate challenge")
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestConnectProxyAuth(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	proxyAddr := lis.Addr().String()
+	lis.Close()
+
+	d := NewMiniResolver(0, time.Minute, proxyAddr, testLogger(),
+		WithProxyAuth(testProxyUsers(t), testProxyRules),
+		WithProxyLimits(ProxyLimits{Rate: 0.001, Burst: 5}),
+	)
+	defer d.Close()
+	for _, service := range []string{"svc", "other"} {
+		d.services.addService(service, &pb.ServiceInstance{Addr: backend.Addr().String()}, []string{"dom"}, false, time.Now(), caller{})
+	}
+	if err := d.StartProxy(); err != nil {
+		t.Fatalf("cannot start proxy: %v", err)
+	}
+	defer d.StopProxy()
+
+	request := func(method, target, credentials string) int {
+		t.Helper()
+		var conn net.Conn
+		eventually(t, 5*time.Second, func() bool {
+			conn, err = net.Dial("tcp", proxyAddr)
+			return err == nil
+		}, "cannot connect to proxy: %v", err)
+		defer conn.Close()
+		fmt.Fprintf(conn, "%s %s HTTP/1.1\r\nHost: dom.svc\r\n", method, target)
+		if credentials != "" {
+			fmt.Fprintf(conn, "Proxy-Authorization: %s\r\n", credentials)
+		}
+		io.WriteString(conn, "\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("cannot read response: %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		credentials string
+		status      int
+	}{
+		{"allowed", http.MethodConnect, "dom.svc", basicProxyAuth("ci", "secret"), http.StatusOK},
+		{"service of other rule", http.MethodConnect, "dom.other", basicProxyAuth("ci", "secret"), http.StatusForbidden},
+		{"anonymous", http.MethodConnect, "dom.svc", "", http.StatusProxyAuthRequired},
+		{"plain http", http.MethodGet, "http://dom.svc/", basicProxyAuth("ci", "secret"), http.StatusForbidden},
+		{"plain http without credentials", http.MethodGet, "http://dom.svc/", "", http.StatusProxyAuthRequired},
+		// the burst of 5 sessions is used up, the credentials are not checked anymore
+		{"rate limit", http.MethodConnect, "dom.svc", basicProxyAuth("ci", "secret"), http.StatusTooManyRequests},
+		{"rate limit of plain http", http.MethodGet, "http://dom.svc/", basicProxyAuth("ci", "wrong"), http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		if status := request(tt.method, tt.target, tt.credentials); status != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, status, tt.status)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"emperror.dev/errors"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProxyLimits restricts the sessions of all proxies. zero values disable the limit
+type ProxyLimits struct {
+	// MaxConnsPerClient is the number of concurrent sessions of a client ip
+	MaxConnsPerClient int
+	// MaxConnsPerTarget is the number of concurrent sessions to a service
+	MaxConnsPerTarget int
+	// Rate is the number of new sessions per second of a client ip
+	Rate float64
+	// Burst is the number of sessions a client ip may open at once. defaults to 1 with Rate
+	Burst int
+	// IdleTimeout closes a tunnel without data in both directions and idle keep-alive connections
+	IdleTimeout time.Duration
+	// MaxDuration closes a tunnel after this time and limits the duration of reverse proxy requests
+	MaxDuration time.Duration
+}
+
+// defaultProxyIdleTimeout closes idle keep-alive connections of the http proxies without IdleTimeout
+const defaultProxyIdleTimeout = 2 * time.Minute
+
+// httpIdleTimeout is the idle timeout of keep-alive connections of the http proxies
+func (limits ProxyLimits) httpIdleTimeout() time.Duration {
+	if limits.IdleTimeout > 0 {
+		return limits.IdleTimeout
+	}
+	return defaultProxyIdleTimeout
+}
+
+// bucketSweepInterval is the interval of the removal of full token buckets
+const bucketSweepInterval = time.Minute
+
+func newProxyLimiter(limits ProxyLimits) *proxyLimiter {
+	if limits.Rate > 0 && limits.Burst <= 0 {
+		limits.Burst = 1
+	}
+	return &proxyLimiter{
+		limits:  limits,
+		clients: map[string]int{},
+		targets: map[string]int{},
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+type proxyLimiter struct {
+	sync.Mutex
+	limits    ProxyLimits
+	clients   map[string]int
+	targets   map[string]int
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// take removes a token, if there is one. the bucket is refilled with rate tokens per second up to burst
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) bool {
+	b.tokens = min(float64(burst), b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// limitError is returned if a session is not allowed
+type limitError struct {
+	status int // http status for the client
+	reason string
+}
+
+func (e *limitError) Error() string {
+	return e.reason
+}
+
+// refusal returns the http status and the failure reason of an error of acquire
+func refusal(err error) (status int, reason string) {
+	var le *limitError
+	if errors.As(err, &le) {
+		return le.status, le.reason
+	}
+	return http.StatusServiceUnavailable, "limit"
+}
+
+// allow takes a token of the client ip for a new session. it is called before the client is authenticated,
+// so the rate limits password guessing too. the rate limit is answered with 429
+func (l *proxyLimiter) allow(clientIP string) error {
+	if l.limits.Rate <= 0 {
+		return nil
+	}
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastSweep) > bucketSweepInterval {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[clientIP]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.limits.Burst), updated: now}
+		l.buckets[clientIP] = b
+	}
+	if !b.take(now, l.limits.Rate, l.limits.Burst) {
+		return &limitError{status: http.StatusTooManyRequests, reason: "rate_limit"}
+	}
+	return nil
+}
+
+// acquire reserves a session of the client ip to target, which was allowed before. release has to be called
+// at the end of the session. client limits are answered with 429, target limits with 503
+func (l *proxyLimiter) acquire(clientIP, target string) (release func(), err error) {
+	l.Lock()
+	defer l.Unlock()
+	if l.limits.MaxConnsPerClient > 0 && l.clients[clientIP] >= l.limits.MaxConnsPerClient {
+		return nil, &limitError{status: http.StatusTooManyRequests, reason: "client_limit"}
+	}
+	if l.limits.MaxConnsPerTarget > 0 && l.targets[target] >= l.limits.MaxConnsPerTarget {
+		return nil, &limitError{status: http.StatusServiceUnavailable, reason: "target_limit"}
+	}
+	l.clients[clientIP]++
+	l.targets[target]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.Lock()
+			defer l.Unlock()
+			if l.clients[clientIP]--; l.clients[clientIP] <= 0 {
+				delete(l.clients, clientIP)
+			}
+			if l.targets[target]--; l.targets[target] <= 0 {
+				delete(l.targets, target)
+			}
+		})
+	}, nil
+}
+
+// sweep removes the buckets, which are refilled completely. lock must be held by caller
+func (l *proxyLimiter) sweep(now time.Time) {
+	for ip, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*l.limits.Rate >= float64(l.limits.Burst) {
+			delete(l.buckets, ip)
+		}
+	}
+	l.lastSweep = now
+}
+
+// clientIP returns the ip address of a remote address (host:port)
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// idleConn extends the read deadline of the connection with every read. a read timeout is only
+// reported, if there was no activity in the other direction of the tunnel either
+type idleConn struct {
+	net.Conn
+	timeout  time.Duration
+	activity *atomic.Int64 // unix nanoseconds of the last read in both directions
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		n, err := c.Conn.Read(p)
+		if n > 0 {
+			c.activity.Store(time.Now().UnixNano())
+		}
+		if err != nil && n == 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+			if time.Since(time.Unix(0, c.activity.Load())) < c.timeout {
+				continue
+			}
+		}
+		return n, err
+	}
+}
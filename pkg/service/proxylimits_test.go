@@ -0,0 +1,212 @@
+package service
+
+import (
+	"emperror.dev/errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		takes []time.Duration // time of every take after start
+		want  []bool
+	}{
+		{
+			name:  "burst",
+			rate:  1,
+			burst: 3,
+			takes: []time.Duration{0, 0, 0, 0},
+			want:  []bool{true, true, true, false},
+		},
+		{
+			name:  "refill",
+			rate:  2,
+			burst: 1,
+			takes: []time.Duration{0, 0, 400 * time.Millisecond, 500 * time.Millisecond, 500 * time.Millisecond},
+			want:  []bool{true, false, false, true, false},
+		},
+		{
+			name:  "refill up to burst",
+			rate:  10,
+			burst: 2,
+			takes: []time.Duration{0, 0, time.Hour, time.Hour, time.Hour},
+			want:  []bool{true, true, true, true, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &tokenBucket{tokens: float64(tt.burst), updated: start}
+			for i, at := range tt.takes {
+				if got := b.take(start.Add(at), tt.rate, tt.burst); got != tt.want[i] {
+					t.Errorf("take %d at %v: %v, want %v", i, at, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestProxyLimiterAcquire(t *testing.T) {
+	type session struct {
+		client, target string
+		status         int // 0 if the session is allowed
+		release        bool
+	}
+	tests := []struct {
+		name     string
+		limits   ProxyLimits
+		sessions []session
+	}{
+		{
+			name:     "no limits",
+			sessions: []session{{client: "a", target: "s"}, {client: "a", target: "s"}, {client: "a", target: "s"}},
+		},
+		{
+			name:   "rate",
+			limits: ProxyLimits{Rate: 0.001, Burst: 2},
+			sessions: []session{
+				{client: "a", target: "s", release: true},
+				{client: "a", target: "s", release: true},
+				{client: "a", target: "s", status: http.StatusTooManyRequests},
+				{client: "b", target: "s"},
+			},
+		},
+		{
+			name:   "client limit",
+			limits: ProxyLimits{MaxConnsPerClient: 1},
+			sessions: []session{
+				{client: "a", target: "s"},
+				{client: "a", target: "t", status: http.StatusTooManyRequests},
+				{client: "b", target: "s", release: true},
+				{client: "b", target: "s"},
+			},
+		},
+		{
+			name:   "target limit",
+			limits: ProxyLimits{MaxConnsPerTarget: 2},
+			sessions: []session{
+				{client: "a", target: "s"},
+				{client: "b", target: "s"},
+				{client: "c", target: "s", status: http.StatusServiceUnavailable},
+				{client: "c", target: "t"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newProxyLimiter(tt.limits)
+			var releases []func()
+			for i, s := range tt.sessions {
+				err := l.allow(s.client)
+				var release func()
+				if err == nil {
+					release, err = l.acquire(s.client, s.target)
+				}
+				if s.status == 0 {
+					if err != nil {
+						t.Fatalf("session %d refused: %v", i, err)
+					}
+					if s.release {
+						release()
+						release()
+					} else {
+						releases = append(releases, release)
+					}
+					continue
+				}
+				if err == nil {
+					t.Fatalf("session %d allowed, want status %d", i, s.status)
+				}
+				if status, _ := refusal(err); status != s.status {
+					t.Errorf("session %d: status %d, want %d", i, status, s.status)
+				}
+			}
+			for _, release := range releases {
+				release()
+			}
+			if len(l.clients) != 0 || len(l.targets) != 0 {
+				t.Errorf("sessions left after release: %v, %v", l.clients, l.targets)
+			}
+		})
+	}
+}
+
+func TestRefusal(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		reason string
+	}{
+		{&limitError{status: http.StatusTooManyRequests, reason: "rate_limit"}, http.StatusTooManyRequests, "rate_limit"},
+		{errors.Wrap(&limitError{status: http.StatusServiceUnavailable, reason: "target_limit"}, "refused"), http.StatusServiceUnavailable, "target_limit"},
+		{errors.New("other"), http.StatusServiceUnavailable, "limit"},
+	}
+	for _, tt := range tests {
+		if status, reason := refusal(tt.err); status != tt.status || reason != tt.reason {
+			t.Errorf("refusal(%v) = %d, %s, want %d, %s", tt.err, status, reason, tt.status, tt.reason)
+		}
+	}
+}
+
+func TestSpliceTimeouts(t *testing.T) {
+	c := newCache(time.Minute, testLogger())
+	defer c.Close()
+	tests := []struct {
+		name   string
+		limits ProxyLimits
+		// traffic is sent from the client every interval
+		interval time.Duration
+		min, max time.Duration
+	}{
+		{name: "idle timeout", limits: ProxyLimits{IdleTimeout: 100 * time.Millisecond}, min: 100 * time.Millisecond, max: 2 * time.Second},
+		{name: "activity", limits: ProxyLimits{IdleTimeout: 100 * time.Millisecond, MaxDuration: 400 * time.Millisecond}, interval: 30 * time.Millisecond, min: 400 * time.Millisecond, max: 2 * time.Second},
+		{name: "max duration", limits: ProxyLimits{MaxDuration: 100 * time.Millisecond}, min: 100 * time.Millisecond, max: 2 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, clientPeer := net.Pipe()
+			remote, remotePeer := net.Pipe()
+			defer clientPeer.Close()
+			defer remotePeer.Close()
+			go func() {
+				buf := make([]byte, 16)
+				for {
+					if _, err := remotePeer.Read(buf); err != nil {
+						return
+					}
+				}
+			}()
+			if tt.interval > 0 {
+				go func() {
+					for {
+						time.Sleep(tt.interval)
+						if _, err := clientPeer.Write([]byte("x")); err != nil {
+							return
+						}
+					}
+				}()
+			}
+			start := time.Now()
+			done := make(chan struct{})
+			go func() {
+				splice(client, remote, tt.limits, newMetrics(c), testLogger())
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(tt.max):
+				client.Close()
+				remote.Close()
+				t.Fatalf("tunnel not closed after %v", tt.max)
+			}
+			if d := time.Since(start); d < tt.min {
+				t.Errorf("tunnel closed after %v, want at least %v", d, tt.min)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// reverseProxyRoute is the target of a request
+type reverseProxyRoute struct {
+	service string
+	addr    string
+	prefix  string // stripped path prefix, empty for routing by host
+}
+
+type reverseProxyRouteKey struct{}
+
+/*
+newReverseProxy routes http requests to an instance of the service named by the host header
+or, if the host is no service, by the first path segment (i.e. /dom.svc/...), which is stripped and sent
+as X-Forwarded-Prefix.
+http/2 is accepted without tls (h2c). with upstreamTLS the instances are called via https.
+with auth the clients need Proxy-Authorization credentials, which are not forwarded
+*/
+func newReverseProxy(addr string, upstreamTLS *tls.Config, services *cache, limiter *proxyLimiter, auth *proxyAuth, m *metrics, logger zLogger.ZLogger) *reverseProxy {
+	rp := &reverseProxy{
+		addr:     addr,
+		services: services,
+		limiter:  limiter,
+		auth:     auth,
+		metrics:  m,
+		logger:   logger,
+		scheme:   "http",
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if upstreamTLS != nil {
+		rp.scheme = "https"
+		transport.TLSClientConfig = upstreamTLS.Clone()
+	}
+	rp.proxy = &httputil.ReverseProxy{
+		Rewrite:      rp.rewrite,
+		Transport:    transport,
+		ErrorHandler: rp.errorHandler,
+	}
+	rp.server = &http.Server{
+		Addr:              addr,
+		Handler:           h2c.NewHandler(rp, &http2.Server{}),
+		ReadHeaderTimeout: 30 * time.Second,
+		IdleTimeout:       limiter.limits.httpIdleTimeout(),
+		WriteTimeout:      limiter.limits.MaxDuration,
+	}
+	return rp
+}
+
+type reverseProxy struct {
+	addr     string
+	scheme   string
+	services *cache
+	limiter  *proxyLimiter
+	auth     *proxyAuth
+	metrics  *metrics
+	logger   zLogger.ZLogger
+	proxy    *httputil.ReverseProxy
+	server   *http.Server
+}
+
+func (rp *reverseProxy) Start() {
+	go func() {
+		rp.logger.Info().Msgf("starting reverse proxy on %s", rp.addr)
+		if err := rp.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			rp.logger.Error().Err(err).Msgf("reverse proxy on %s ended", rp.addr)
+		}
+	}()
+}
+
+func (rp *reverseProxy) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := rp.server.Shutdown(ctx); err != nil {
+		rp.logger.Debug().Msgf("cannot shutdown reverse proxy on %s: %v", rp.addr, err)
+	}
+}
+
+// route finds the service of the request and selects an instance
+func (rp *reverseProxy) route(req *http.Request) (*reverseProxyRoute, bool) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if addr := rp.services.getServiceFold(host); addr != "" {
+		return &reverseProxyRoute{service: host, addr: addr}, true
+	}
+	name, _, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	if name == "" {
+		return nil, false
+	}
+	if addr := rp.services.getServiceFold(name); addr != "" {
+		return &reverseProxyRoute{service: name, addr: addr, prefix: "/" + name}, true
+	}
+	return nil, false
+}
+
+func (rp *reverseProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := rp.limiter.allow(clientIP(req.RemoteAddr)); err != nil {
+		rp.refuse(w, req, err)
+		return
+	}
+	var ids []string
+	if rp.auth != nil {
+		var ok bool
+		if ids, ok = rp.auth.authenticate(req); !ok {
+			rp.logger.Debug().Str("proxy", "reverse").Msgf("unauthenticated request from %s to %s%s", req.RemoteAddr, req.Host, req.URL.Path)
+			rp.metrics.reverseProxyRequests.WithLabelValues(resultRejected).Inc()
+			rp.metrics.proxyFailures.WithLabelValues("unauthenticated").Inc()
+			w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", proxyRealm))
+			http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+	}
+	route, ok := rp.route(req)
+	if !ok {
+		rp.logger.Debug().Str("proxy", "reverse").Msgf("no service for %s%s", req.Host, req.URL.Path)
+		rp.metrics.reverseProxyRequests.WithLabelValues(resultNotFound).Inc()
+		http.Error(w, "service not found", http.StatusNotFound)
+		return
+	}
+	if rp.auth != nil {
+		domain, service, found := rp.services.serviceOf(route.service)
+		if !found || !rp.auth.allowed(ids, domain, service) {
+			rp.logger.Warn().Strs("identities", ids).Msgf("request from %s to '%s' denied", req.RemoteAddr, route.service)
+			rp.metrics.reverseProxyRequests.WithLabelValues(resultRejected).Inc()
+			rp.metrics.proxyFailures.WithLabelValues("forbidden").Inc()
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+	release, err := rp.limiter.acquire(clientIP(req.RemoteAddr), route.service)
+	if err != nil {
+		rp.refuse(w, req, err)
+		return
+	}
+	defer release()
+	rp.logger.Debug().Str("proxy", "reverse").Msgf("%s %s%s to %s (%s)", req.Method, req.Host, req.URL.Path, route.addr, route.service)
+	rp.metrics.reverseProxyRequests.WithLabelValues(resultOK).Inc()
+	rp.proxy.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), reverseProxyRouteKey{}, route)))
+}
+
+// refuse answers a request, which exceeds the proxy limits
+func (rp *reverseProxy) refuse(w http.ResponseWriter, req *http.Request, err error) {
+	status, reason := refusal(err)
+	rp.logger.Debug().Str("proxy", "reverse").Msgf("request from %s to %s%s refused: %v", req.RemoteAddr, req.Host, req.URL.Path, err)
+	rp.metrics.reverseProxyRequests.WithLabelValues(resultRejected).Inc()
+	rp.metrics.proxyFailures.WithLabelValues(reason).Inc()
+	http.Error(w, http.StatusText(status), status)
+}
+
+func (rp *reverseProxy) rewrite(pr *httputil.ProxyRequest) {
+	route := pr.In.Context().Value(reverseProxyRouteKey{}).(*reverseProxyRoute)
+	if route.prefix != "" {
+		pr.Out.URL.Path = strings.TrimPrefix(pr.In.URL.Path, route.prefix)
+		pr.Out.URL.RawPath = ""
+		if pr.Out.URL.Path == "" {
+			pr.Out.URL.Path = "/"
+		}
+		pr.Out.Header.Set("X-Forwarded-Prefix", route.prefix)
+	} else {
+		pr.Out.Header.Del("X-Forwarded-Prefix")
+	}
+	// the original host is sent as X-Forwarded-Host
+	pr.SetURL(&url.URL{Scheme: rp.scheme, Host: route.addr})
+	pr.SetXForwarded()
+}
+
+func (rp *reverseProxy) errorHandler(w http.ResponseWriter, req *http.Request, err error) {
+	route, _ := req.Context().Value(reverseProxyRouteKey{}).(*reverseProxyRoute)
+	if errors.Is(err, context.Canceled) {
+		rp.logger.Debug().Str("proxy", "reverse").Msgf("request to %s canceled", route.addr)
+		return
+	}
+	rp.logger.Debug().Str("proxy", "reverse").Err(err).Msgf("cannot reach %s (%s)", route.addr, route.service)
+	rp.metrics.proxyFailures.WithLabelValues("reverse_upstream").Inc()
+	http.Error(w, "cannot reach service", http.StatusBadGateway)
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"encoding/json"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// forwardedRequest is the request as seen by the backend
+type forwardedRequest struct {
+	Path, Prefix, ForwardedHost string
+}
+
+func TestReverseProxyRoute(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(forwardedRequest{
+			Path:          req.URL.Path,
+			Prefix:        req.Header.Get("X-Forwarded-Prefix"),
+			ForwardedHost: req.Header.Get("X-Forwarded-Host"),
+		})
+	}))
+	defer backend.Close()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	unreachable := lis.Addr().String()
+	lis.Close()
+
+	c := newCache(time.Minute, testLogger())
+	defer c.Close()
+	c.events, _ = newEventLog(10, "", testLogger())
+	c.addService("svc", &pb.ServiceInstance{Addr: backend.Listener.Addr().String()}, []string{"dom"}, false, time.Now(), caller{})
+	c.addService("down", &pb.ServiceInstance{Addr: unreachable}, []string{"dom"}, false, time.Now(), caller{})
+	rp := newReverseProxy("", nil, c, newProxyLimiter(ProxyLimits{}), nil, newMetrics(c), testLogger())
+
+	tests := []struct {
+		name   string
+		host   string
+		path   string
+		prefix string // X-Forwarded-Prefix of the client
+		status int
+		want   forwardedRequest
+	}{
+		{name: "host", host: "dom.svc", path: "/a/b", status: http.StatusOK, want: forwardedRequest{Path: "/a/b", ForwardedHost: "dom.svc"}},
+		{name: "host with port", host: "dom.svc:8080", path: "/a", status: http.StatusOK, want: forwardedRequest{Path: "/a", ForwardedHost: "dom.svc:8080"}},
+		{name: "host in upper case", host: "DOM.Svc", path: "/", status: http.StatusOK, want: forwardedRequest{Path: "/", ForwardedHost: "DOM.Svc"}},
+		{name: "host without prefix of the client", host: "dom.svc", path: "/a", prefix: "/evil", status: http.StatusOK, want: forwardedRequest{Path: "/a", ForwardedHost: "dom.svc"}},
+		{name: "first path segment", host: "proxy", path: "/dom.svc/a/b", status: http.StatusOK, want: forwardedRequest{Path: "/a/b", Prefix: "/dom.svc", ForwardedHost: "proxy"}},
+		{name: "first path segment only", host: "proxy", path: "/dom.svc", status: http.StatusOK, want: forwardedRequest{Path: "/", Prefix: "/dom.svc", ForwardedHost: "proxy"}},
+		{name: "first path segment replaces prefix of the client", host: "proxy", path: "/dom.svc/", prefix: "/evil", status: http.StatusOK, want: forwardedRequest{Path: "/", Prefix: "/dom.svc", ForwardedHost: "proxy"}},
+		{name: "unknown host", host: "dom.unknown", path: "/a", status: http.StatusNotFound},
+		{name: "unknown first path segment", host: "proxy", path: "/dom.unknown/a", status: http.StatusNotFound},
+		{name: "empty path", host: "proxy", path: "/", status: http.StatusNotFound},
+		{name: "unreachable instance", host: "dom.down", path: "/a", status: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://"+tt.host+tt.path, nil)
+			if tt.prefix != "" {
+				req.Header.Set("X-Forwarded-Prefix", tt.prefix)
+			}
+			w := httptest.NewRecorder()
+			rp.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var got forwardedRequest
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatalf("cannot decode backend response: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("forwarded %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,31 +1,49 @@
 package service
 
 import (
-	"context"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"github.com/je4/miniresolver/v2/pkg/selector"
 	"github.com/je4/utils/v2/pkg/zLogger"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/credentials/insecure"
-	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	"time"
 )
 
-func NewServiceEntry(service string, logger zLogger.ZLogger) *serviceEntry {
+func NewServiceEntry(domain, name string, logger zLogger.ZLogger) *serviceEntry {
+	service := name
+	if domain != "" {
+		service = domain + "." + name
+	}
 	return &serviceEntry{
-		service:   service,
-		addresses: make(map[string]time.Time),
-		client:    make(map[string]*grpc.ClientConn),
-		sort:      make([]string, 0, 1),
-		logger:    logger,
+		service:     service,
+		domain:      domain,
+		name:        name,
+		addresses:   make(map[string]time.Time),
+		provisional: make(map[string]bool),
+		health:      make(map[string]*instanceHealth),
+		instances:   make(map[string]*pb.ServiceInstance),
+		client:      make(map[string]*grpc.ClientConn),
+		current:     make(map[string]int64),
+		leased:      make(map[string]bool),
+		sort:        make([]string, 0, 1),
+		logger:      logger,
 	}
 }
 
 type serviceEntry struct {
-	service   string
-	addresses map[string]time.Time
-	client    map[string]*grpc.ClientConn
-	sort      []string
-	logger    zLogger.ZLogger
+	service     string
+	domain      string
+	name        string
+	addresses   map[string]time.Time
+	provisional map[string]bool
+	health      map[string]*instanceHealth
+	instances   map[string]*pb.ServiceInstance
+	client      map[string]*grpc.ClientConn
+	current     map[string]int64 // smooth weighted round-robin state
+	leased      map[string]bool  // expired by their lease instead of removeOld
+	single      bool
+	sort        []string
+	logger      zLogger.ZLogger
 }
 
 func (se *serviceEntry) nextCallTimeout() time.Duration {
@@ -46,9 +64,14 @@ func (se *serviceEntry) nextCallTimeout() time.Duration {
 	return m
 }
 
-func (se *serviceEntry) removeOld(timeout time.Duration) {
+// removeOld removes all addresses not refreshed within timeout and returns them.
+// leased addresses are removed by their lease
+func (se *serviceEntry) removeOld(timeout time.Duration) []string {
 	olds := make([]string, 0, len(se.addresses))
 	for _, addr := range se.sort {
+		if se.leased[addr] {
+			continue
+		}
 		if svc, ok := se.addresses[addr]; ok {
 			if time.Since(svc) >= timeout {
 				olds = append(olds, addr)
@@ -56,68 +79,53 @@ func (se *serviceEntry) removeOld(timeout time.Duration) {
 		}
 	}
 	se.removeAddress(olds...)
+	return olds
 }
 
-func (se *serviceEntry) getUnavailable() []string {
-	unavailable := make([]string, 0, len(se.addresses))
-	for addr := range se.addresses {
-		cc, ok := se.client[addr]
-		if !ok {
-			se.logger.Debug().Msgf("ping %s::%s - client not found", se.service, addr)
-			continue
+// refreshAddress updates the instance of a known address. the refresh time never moves backwards,
+// a replicated registration keeps the refresh time of its origin
+func (se *serviceEntry) refreshAddress(instance *pb.ServiceInstance, refreshed time.Time) bool {
+	addr := instance.GetAddr()
+	if last, ok := se.addresses[addr]; ok {
+		if refreshed.After(last) {
+			se.addresses[addr] = refreshed
 		}
-		if err := cc.Invoke(context.Background(), "ping", nil, nil); err != nil {
-			stat := status.FromContextError(err)
-			se.logger.Debug().Msgf("ping %s::%s - [%d]", se.service, addr, stat.Code())
-			if stat.Code() == codes.Unavailable {
-				se.logger.Debug().Msgf("%s::%s not available", se.service, addr)
-				unavailable = append(unavailable, addr)
-			}
+		se.instances[addr] = instance
+		if se.provisional[addr] {
+			se.logger.Debug().Msgf("provisional address %s::%s confirmed", se.service, addr)
+			delete(se.provisional, addr)
 		}
-
-	}
-	return unavailable
-}
-
-func (se *serviceEntry) headToTail() {
-	if len(se.sort) <= 1 {
-		return
-	}
-	a := se.sort[0]
-	copy(se.sort, se.sort[1:])
-	se.sort[len(se.sort)-1] = a
-}
-func (se *serviceEntry) refreshAddress(addr string) bool {
-	if _, ok := se.addresses[addr]; ok {
-		se.addresses[addr] = time.Now()
 		return true
 	}
 	return false
 }
 
-func (se *serviceEntry) addAddress(addr string) {
+// addProvisionalAddress adds an address which is not confirmed by a registration
+func (se *serviceEntry) addProvisionalAddress(instance *pb.ServiceInstance, refreshed time.Time) {
+	se.addAddress(instance, refreshed)
+	se.provisional[instance.GetAddr()] = true
+}
+
+func (se *serviceEntry) addAddress(instance *pb.ServiceInstance, refreshed time.Time) {
+	addr := instance.GetAddr()
+	se.instances[addr] = instance
 	if _, ok := se.addresses[addr]; !ok {
 		se.sort = append(se.sort, "")
 		copy(se.sort[1:], se.sort)
 		se.sort[0] = addr
+		se.health[addr] = &instanceHealth{state: InstanceHealthy}
 	}
-	se.addresses[addr] = time.Now()
-	var err error
-	se.client[addr], err = grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		delete(se.client, addr)
-	}
-	if err := se.client[addr].Invoke(context.Background(), "ping", nil, nil); err != nil {
-		stat := status.FromContextError(err)
-		if stat.Code() == codes.Unavailable {
-			se.removeAddress(addr)
-		}
-	}
+	se.addresses[addr] = refreshed
 }
 
 func (se *serviceEntry) removeAddress(addrs ...string) {
 	for _, addr := range addrs {
 		delete(se.addresses, addr)
+		delete(se.provisional, addr)
+		delete(se.health, addr)
+		delete(se.instances, addr)
+		delete(se.current, addr)
+		delete(se.leased, addr)
 		if c, ok := se.client[addr]; ok {
 			c.Close()
 			delete(se.client, addr)
@@ -137,21 +145,85 @@ func (se *serviceEntry) Clear() {
 	}
 	se.client = make(map[string]*grpc.ClientConn)
 	se.addresses = make(map[string]time.Time)
+	se.provisional = make(map[string]bool)
+	se.health = make(map[string]*instanceHealth)
+	se.instances = make(map[string]*pb.ServiceInstance)
+	se.current = make(map[string]int64)
+	se.leased = make(map[string]bool)
 	se.sort = make([]string, 0, 1)
 }
 
-func (se *serviceEntry) getAddresses(timeout time.Duration) []string {
-	se.removeOld(timeout)
+// isAvailable checks whether the address may be handed out to clients
+func (se *serviceEntry) isAvailable(addr string) bool {
+	h, ok := se.health[addr]
+	return ok && h.state == InstanceHealthy
+}
+
+// getAddresses returns all addresses regardless of their state
+func (se *serviceEntry) getAddresses() []string {
 	return se.sort
 }
 
-func (se *serviceEntry) getAddress(timeout time.Duration) (string, time.Duration) {
-	se.removeOld(timeout)
-	if len(se.sort) == 0 {
+// getAvailableAddresses returns all addresses which may be handed out to clients
+func (se *serviceEntry) getAvailableAddresses() []string {
+	addrs := make([]string, 0, len(se.sort))
+	for _, addr := range se.sort {
+		if se.isAvailable(addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// getAvailableInstances returns copies of all instances which may be handed out to clients
+func (se *serviceEntry) getAvailableInstances() []*pb.ServiceInstance {
+	instances := make([]*pb.ServiceInstance, 0, len(se.sort))
+	for _, addr := range se.getAvailableAddresses() {
+		instances = append(instances, proto.Clone(se.instances[addr]).(*pb.ServiceInstance))
+	}
+	return instances
+}
+
+// weight returns the weight of the address, instances without weight count as 1
+func (se *serviceEntry) weight(addr string) int64 {
+	if w := se.instances[addr].GetWeight(); w > 0 {
+		return int64(w)
+	}
+	return 1
+}
+
+// getAddress selects an address by smooth weighted round-robin within the preferred
+// (lowest) priority tier of all available addresses matching the selectors
+func (se *serviceEntry) getAddress(selectors []*pb.LabelSelector) (string, time.Duration) {
+	var tier []string
+	var priority uint32
+	for _, addr := range se.sort {
+		if !se.isAvailable(addr) || !selector.Match(selectors, se.instances[addr]) {
+			continue
+		}
+		p := se.instances[addr].GetPriority()
+		if len(tier) == 0 || p < priority {
+			tier = tier[:0]
+			priority = p
+		}
+		if p == priority {
+			tier = append(tier, addr)
+		}
+	}
+	if len(tier) == 0 {
 		return "", 10 * time.Second
 	}
-	a := se.sort[0]
-	se.headToTail()
+	var a string
+	var total int64
+	for _, addr := range tier {
+		w := se.weight(addr)
+		total += w
+		se.current[addr] += w
+		if a == "" || se.current[addr] > se.current[a] {
+			a = addr
+		}
+	}
+	se.current[a] -= total
 	nct := -time.Until(se.addresses[a])
 	if nct < minNextCallTimeout {
 		nct = minNextCallTimeout
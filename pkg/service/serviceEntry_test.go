@@ -0,0 +1,101 @@
+package service
+
+import (
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"github.com/je4/miniresolver/v2/pkg/selector"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestServiceEntryGetAddress(t *testing.T) {
+	tests := []struct {
+		name      string
+		instances []*pb.ServiceInstance
+		unhealthy []string
+		selectors []string
+		picks     int
+		want      map[string]int
+		sequence  []string
+	}{
+		{
+			name:      "equal weights",
+			instances: []*pb.ServiceInstance{{Addr: "a:1"}, {Addr: "b:2"}, {Addr: "c:3"}},
+			picks:     6,
+			want:      map[string]int{"a:1": 2, "b:2": 2, "c:3": 2},
+		},
+		{
+			name:      "weights",
+			instances: []*pb.ServiceInstance{{Addr: "a:1", Weight: 5}, {Addr: "b:2", Weight: 1}, {Addr: "c:3", Weight: 1}},
+			picks:     14,
+			want:      map[string]int{"a:1": 10, "b:2": 2, "c:3": 2},
+		},
+		{
+			name:      "smooth",
+			instances: []*pb.ServiceInstance{{Addr: "a:1", Weight: 2}, {Addr: "b:2", Weight: 1}},
+			picks:     6,
+			want:      map[string]int{"a:1": 4, "b:2": 2},
+			sequence:  []string{"a:1", "b:2", "a:1", "a:1", "b:2", "a:1"},
+		},
+		{
+			name:      "preferred priority tier",
+			instances: []*pb.ServiceInstance{{Addr: "a:1", Priority: 1}, {Addr: "b:2", Priority: 0, Weight: 3}, {Addr: "c:3", Priority: 0}},
+			picks:     4,
+			want:      map[string]int{"b:2": 3, "c:3": 1},
+		},
+		{
+			name:      "fallback to lower tier",
+			instances: []*pb.ServiceInstance{{Addr: "a:1", Priority: 2}, {Addr: "b:2", Priority: 0}, {Addr: "c:3", Priority: 1}},
+			unhealthy: []string{"b:2"},
+			picks:     3,
+			want:      map[string]int{"c:3": 3},
+		},
+		{
+			name:      "tier of the selected instances",
+			instances: []*pb.ServiceInstance{{Addr: "a:1", Priority: 1, Zone: "bs1"}, {Addr: "b:2", Priority: 0, Zone: "bs2"}},
+			selectors: []string{"zone=bs1"},
+			picks:     2,
+			want:      map[string]int{"a:1": 2},
+		},
+		{
+			name:      "nothing available",
+			instances: []*pb.ServiceInstance{{Addr: "a:1"}},
+			unhealthy: []string{"a:1"},
+			picks:     1,
+			want:      map[string]int{"": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			se := NewServiceEntry("dom", "svc", testLogger())
+			for _, instance := range tt.instances {
+				se.addAddress(instance, time.Now())
+			}
+			for _, addr := range tt.unhealthy {
+				se.health[addr].state = InstanceUnhealthy
+			}
+			var selectors []*pb.LabelSelector
+			for _, expr := range tt.selectors {
+				sel, err := selector.Parse(expr)
+				if err != nil {
+					t.Fatalf("cannot parse '%s': %v", expr, err)
+				}
+				selectors = append(selectors, sel)
+			}
+			got := map[string]int{}
+			var sequence []string
+			for i := 0; i < tt.picks; i++ {
+				addr, _ := se.getAddress(selectors)
+				got[addr]++
+				sequence = append(sequence, addr)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("picks %v, want %v", got, tt.want)
+			}
+			if tt.sequence != nil && !slices.Equal(sequence, tt.sequence) {
+				t.Errorf("sequence %v, want %v", sequence, tt.sequence)
+			}
+		})
+	}
+}
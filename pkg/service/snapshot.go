@@ -0,0 +1,150 @@
+package service
+
+import (
+	"emperror.dev/errors"
+	"encoding/json"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"io/fs"
+	"os"
+	"time"
+)
+
+type snapshotAddress struct {
+	Addr      string            `json:"addr"`
+	Refreshed time.Time         `json:"refreshed"`
+	Version   string            `json:"version,omitempty"`
+	Zone      string            `json:"zone,omitempty"`
+	Tags      []string          `json:"tags,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Weight    uint32            `json:"weight,omitempty"`
+	Priority  uint32            `json:"priority,omitempty"`
+}
+
+type snapshotService struct {
+	Domain    string            `json:"domain,omitempty"`
+	Name      string            `json:"name"`
+	Single    bool              `json:"single,omitempty"`
+	Addresses []snapshotAddress `json:"addresses"`
+}
+
+type snapshot struct {
+	Created  time.Time                   `json:"created"`
+	Services map[string]*snapshotService `json:"services"`
+}
+
+// saveSnapshot writes all registered services to filename.
+// the file is replaced atomically, so a crash during write never leaves a broken snapshot
+func (c *cache) saveSnapshot(filename string) error {
+	c.snapshotLock.Lock()
+	defer c.snapshotLock.Unlock()
+
+	snap := &snapshot{
+		Created:  time.Now(),
+		Services: map[string]*snapshotService{},
+	}
+	c.Lock()
+	for name, svcs := range c.services {
+		s := &snapshotService{
+			Domain: svcs.domain,
+			Name:   svcs.name,
+			Single: svcs.single,
+		}
+		for _, addr := range svcs.getAddresses() {
+			instance := svcs.instances[addr]
+			s.Addresses = append(s.Addresses, snapshotAddress{
+				Addr:      addr,
+				Refreshed: svcs.addresses[addr],
+				Version:   instance.GetVersion(),
+				Zone:      instance.GetZone(),
+				Tags:      instance.GetTags(),
+				Metadata:  instance.GetMetadata(),
+				Weight:    instance.GetWeight(),
+				Priority:  instance.GetPriority(),
+			})
+		}
+		snap.Services[name] = s
+	}
+	c.Unlock()
+
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal snapshot")
+	}
+	tmpName := filename + ".tmp"
+	if err := os.WriteFile(tmpName, data, 0600); err != nil {
+		return errors.Wrapf(err, "cannot write snapshot to '%s'", tmpName)
+	}
+	if err := os.Rename(tmpName, filename); err != nil {
+		return errors.Wrapf(err, "cannot rename '%s' to '%s'", tmpName, filename)
+	}
+	c.logger.Debug().Msgf("snapshot with %d services written to '%s'", len(snap.Services), filename)
+	return nil
+}
+
+// loadSnapshot restores the services from filename.
+// all restored addresses are provisional until they register again and expire from their last refresh.
+// addresses, which have expired in the meantime, are skipped
+func (c *cache) loadSnapshot(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			c.logger.Info().Msgf("no snapshot found at '%s'", filename)
+			return nil
+		}
+		return errors.Wrapf(err, "cannot read snapshot '%s'", filename)
+	}
+	snap := &snapshot{}
+	if err := json.Unmarshal(data, snap); err != nil {
+		return errors.Wrapf(err, "cannot unmarshal snapshot '%s'", filename)
+	}
+	c.Lock()
+	defer c.Unlock()
+	for name, s := range snap.Services {
+		svcs, ok := c.services[name]
+		if !ok {
+			svcs = NewServiceEntry(s.Domain, s.Name, c.logger)
+			svcs.single = s.Single
+			c.services[name] = svcs
+		}
+		for _, addr := range s.Addresses {
+			if _, ok := svcs.addresses[addr.Addr]; ok {
+				continue
+			}
+			if time.Since(addr.Refreshed) >= c.timeout {
+				c.logger.Debug().Msgf("expired service address %s: %v (refreshed %v) not restored", name, addr.Addr, addr.Refreshed)
+				continue
+			}
+			svcs.addProvisionalAddress(&pb.ServiceInstance{
+				Addr:     addr.Addr,
+				Version:  addr.Version,
+				Zone:     addr.Zone,
+				Tags:     addr.Tags,
+				Metadata: addr.Metadata,
+				Weight:   addr.Weight,
+				Priority: addr.Priority,
+			}, addr.Refreshed)
+			c.event(pb.EventType_EVENT_REGISTERED, svcs, addr.Addr, "restored from snapshot", caller{})
+			c.logger.Debug().Msgf("provisional service address restored %s: %v (refreshed %v)", name, addr.Addr, addr.Refreshed)
+		}
+		if len(svcs.addresses) == 0 {
+			delete(c.services, name)
+		}
+	}
+	c.logger.Info().Msgf("snapshot from %v with %d services loaded from '%s'", snap.Created, len(snap.Services), filename)
+	return nil
+}
+
+func (c *cache) startSnapshots(filename string, interval time.Duration) {
+	go func() {
+		for {
+			select {
+			case <-time.After(interval):
+				if err := c.saveSnapshot(filename); err != nil {
+					c.logger.Error().Err(err).Msg("cannot write snapshot")
+				}
+			case <-c.done:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"encoding/json"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "snapshot.json")
+	refreshed := time.Now().Add(-10 * time.Second).Round(0)
+	instance := &pb.ServiceInstance{
+		Addr:     "a:1",
+		Version:  "2.1",
+		Zone:     "bs1",
+		Tags:     []string{"canary"},
+		Metadata: map[string]string{"owner": "ub"},
+		Weight:   3,
+		Priority: 1,
+	}
+	c := newCache(time.Minute, testLogger())
+	c.events, _ = newEventLog(10, "", testLogger())
+	c.addService("svc", instance, []string{"dom"}, true, refreshed, caller{})
+	c.addService("other", &pb.ServiceInstance{Addr: "b:2"}, nil, false, time.Now(), caller{})
+	if err := c.saveSnapshot(filename); err != nil {
+		t.Fatalf("cannot save snapshot: %v", err)
+	}
+	c.Close()
+
+	restored := newCache(time.Minute, testLogger())
+	defer restored.Close()
+	restored.events, _ = newEventLog(10, "", testLogger())
+	if err := restored.loadSnapshot(filename); err != nil {
+		t.Fatalf("cannot load snapshot: %v", err)
+	}
+	if got := slices.Sorted(maps.Keys(restored.services)); !slices.Equal(got, []string{"dom.svc", "other"}) {
+		t.Fatalf("restored services %v", got)
+	}
+	svcs := restored.services["dom.svc"]
+	if got := svcs.instances["a:1"]; got.String() != instance.String() {
+		t.Errorf("restored instance %v, want %v", got, instance)
+	}
+	if !svcs.single || !svcs.provisional["a:1"] {
+		t.Errorf("single %v, provisional %v", svcs.single, svcs.provisional["a:1"])
+	}
+	if got := svcs.addresses["a:1"]; !got.Equal(refreshed) {
+		t.Errorf("refreshed %v, want %v", got, refreshed)
+	}
+}
+
+func TestSnapshotSkipsExpired(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "snapshot.json")
+	refreshed := time.Now().Add(-30 * time.Second).Round(0)
+	snap := &snapshot{
+		Created: time.Now().Add(-time.Hour),
+		Services: map[string]*snapshotService{
+			"dom.svc": {Domain: "dom", Name: "svc", Addresses: []snapshotAddress{
+				{Addr: "a:1", Refreshed: time.Now().Add(-2 * time.Minute)},
+				{Addr: "b:2", Refreshed: refreshed},
+			}},
+			"dom.old": {Domain: "dom", Name: "old", Addresses: []snapshotAddress{
+				{Addr: "c:3", Refreshed: time.Now().Add(-time.Hour)},
+			}},
+		},
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatalf("cannot marshal snapshot: %v", err)
+	}
+	if err := os.WriteFile(filename, data, 0600); err != nil {
+		t.Fatalf("cannot write snapshot: %v", err)
+	}
+	c := newCache(time.Minute, testLogger())
+	defer c.Close()
+	c.events, _ = newEventLog(10, "", testLogger())
+	if err := c.loadSnapshot(filename); err != nil {
+		t.Fatalf("cannot load snapshot: %v", err)
+	}
+	if got := slices.Sorted(maps.Keys(c.services)); !slices.Equal(got, []string{"dom.svc"}) {
+		t.Fatalf("restored services %v, want [dom.svc]", got)
+	}
+	if got := c.services["dom.svc"].getAddresses(); !slices.Equal(got, []string{"b:2"}) {
+		t.Errorf("restored addresses %v, want [b:2]", got)
+	}
+	// expires with its last refresh before the restart
+	if got := c.services["dom.svc"].addresses["b:2"]; !got.Equal(refreshed) {
+		t.Errorf("refreshed %v, want %v", got, refreshed)
+	}
+}
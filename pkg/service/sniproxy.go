@@ -0,0 +1,238 @@
+package service
+
+import (
+	"bytes"
+	"crypto/tls"
+	"emperror.dev/errors"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// sniHelloTimeout is the time a client has to send its ClientHello
+const sniHelloTimeout = 10 * time.Second
+
+// newSNIProxy routes tls connections by the server name of the ClientHello <service>.<domain>.<zone>
+// to an instance and splices the raw stream, so the instances terminate tls themselves
+func newSNIProxy(addr, zone string, services *cache, limiter *proxyLimiter, m *metrics, logger zLogger.ZLogger) *sniProxy {
+	zone = strings.Trim(zone, ".")
+	return &sniProxy{
+		addr:     addr,
+		zone:     zone,
+		services: services,
+		limiter:  limiter,
+		metrics:  m,
+		logger:   logger,
+	}
+}
+
+type sniProxy struct {
+	addr     string
+	zone     string
+	services *cache
+	limiter  *proxyLimiter
+	metrics  *metrics
+	logger   zLogger.ZLogger
+	listener net.Listener
+}
+
+func (p *sniProxy) Start() error {
+	var err error
+	if p.listener, err = net.Listen("tcp", p.addr); err != nil {
+		return errors.Wrapf(err, "cannot listen on %s", p.addr)
+	}
+	p.logger.Info().Msgf("starting sni proxy on %s for zone '%s'", p.listener.Addr(), p.zone)
+	go func() {
+		for {
+			conn, err := p.listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					p.logger.Error().Err(err).Msgf("sni proxy on %s ended", p.addr)
+				}
+				return
+			}
+			go p.handle(conn)
+		}
+	}()
+	return nil
+}
+
+func (p *sniProxy) Close() {
+	if p.listener == nil {
+		return
+	}
+	if err := p.listener.Close(); err != nil {
+		p.logger.Debug().Msgf("cannot close sni proxy on %s: %v", p.addr, err)
+	}
+}
+
+func (p *sniProxy) handle(client net.Conn) {
+	defer client.Close()
+	if err := p.limiter.allow(clientIP(client.RemoteAddr().String())); err != nil {
+		// tls has no way to report the limit, the connection is closed
+		_, reason := refusal(err)
+		p.logger.Debug().Str("proxy", "sni").Msgf("connection from %s refused: %v", client.RemoteAddr(), err)
+		p.metrics.proxySessions.WithLabelValues(resultRejected).Inc()
+		p.metrics.proxyFailures.WithLabelValues(reason).Inc()
+		return
+	}
+	client.SetReadDeadline(time.Now().Add(sniHelloTimeout))
+	serverName, hello, err := peekServerName(client)
+	if err != nil {
+		p.logger.Debug().Str("proxy", "sni").Msgf("cannot read client hello from %s: %v", client.RemoteAddr(), err)
+		p.metrics.proxySessions.WithLabelValues(resultError).Inc()
+		p.metrics.proxyFailures.WithLabelValues("client_hello").Inc()
+		return
+	}
+	client.SetReadDeadline(time.Time{})
+	name, addr := p.lookup(serverName)
+	if addr == "" {
+		p.logger.Debug().Str("proxy", "sni").Msgf("service '%s' not found", serverName)
+		p.metrics.proxySessions.WithLabelValues(resultNotFound).Inc()
+		p.metrics.proxyFailures.WithLabelValues("service_not_found").Inc()
+		return
+	}
+	release, err := p.limiter.acquire(clientIP(client.RemoteAddr().String()), name)
+	if err != nil {
+		// tls has no way to report the limit, the connection is closed
+		_, reason := refusal(err)
+		p.logger.Debug().Str("proxy", "sni").Msgf("connection from %s to '%s' refused: %v", client.RemoteAddr(), name, err)
+		p.metrics.proxySessions.WithLabelValues(resultRejected).Inc()
+		p.metrics.proxyFailures.WithLabelValues(reason).Inc()
+		return
+	}
+	defer release()
+	remote, err := net.Dial("tcp", addr)
+	if err != nil {
+		p.logger.Debug().Str("proxy", "sni").Msgf("cannot connect to %s (%s): %v", addr, name, err)
+		p.metrics.proxySessions.WithLabelValues(resultError).Inc()
+		p.metrics.proxyFailures.WithLabelValues("dial").Inc()
+		return
+	}
+	if _, err := remote.Write(hello); err != nil {
+		p.logger.Debug().Str("proxy", "sni").Msgf("cannot forward client hello to %s: %v", addr, err)
+		p.metrics.proxySessions.WithLabelValues(resultError).Inc()
+		p.metrics.proxyFailures.WithLabelValues("copy_upstream").Inc()
+		remote.Close()
+		return
+	}
+	p.logger.Debug().Str("proxy", "sni").Msgf("proxy connect to %s (%s)", addr, name)
+	p.metrics.proxySessions.WithLabelValues(resultOK).Inc()
+	splice(client, remote, p.limiter.limits, p.metrics, p.logger)
+	p.logger.Debug().Str("proxy", "sni").Msgf("proxy connect to %s (%s) done", addr, name)
+}
+
+// lookup selects an instance for the server name. <service>.<domain>.<zone> is tried first,
+// then the name without zone as qualified service name
+func (p *sniProxy) lookup(serverName string) (name, addr string) {
+	name = strings.TrimSuffix(serverName, ".")
+	if p.zone != "" && len(name) > len(p.zone) && strings.EqualFold(name[len(name)-len(p.zone):], p.zone) && name[len(name)-len(p.zone)-1] == '.' {
+		name = name[:len(name)-len(p.zone)-1]
+	}
+	var candidates []string
+	if i := strings.LastIndex(name, "."); i > 0 {
+		candidates = append(candidates, name[i+1:]+"."+name[:i])
+	}
+	candidates = append(candidates, name)
+	for _, candidate := range candidates {
+		if addr := p.services.getServiceFold(candidate); addr != "" {
+			return candidate, addr
+		}
+	}
+	return name, ""
+}
+
+// peekServerName reads the ClientHello from conn and returns the server name and the bytes read,
+// which have to be sent to the instance
+func peekServerName(conn net.Conn) (string, []byte, error) {
+	var hello bytes.Buffer
+	var serverName string
+	var found bool
+	err := tls.Server(helloConn{Conn: conn, r: io.TeeReader(conn, &hello)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = info.ServerName
+			found = true
+			// abort the handshake, only the hello is needed
+			return nil, errors.New("client hello read")
+		},
+	}).Handshake()
+	if !found {
+		return "", nil, errors.Wrap(err, "no client hello")
+	}
+	if serverName == "" {
+		return "", nil, errors.New("no server name in client hello")
+	}
+	return serverName, hello.Bytes(), nil
+}
+
+// helloConn reads through r and never writes, so the aborted handshake sends nothing to the client
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c helloConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (c helloConn) Write(p []byte) (int, error) { return len(p), nil }
+
+// splice copies between client and remote until both directions have ended or a timeout of limits closes the tunnel
+func splice(client, remote net.Conn, limits ProxyLimits, m *metrics, logger zLogger.ZLogger) {
+	m.proxyActive.Inc()
+	defer m.proxyActive.Dec()
+
+	var clientReader, remoteReader io.Reader = client, remote
+	if limits.IdleTimeout > 0 {
+		activity := &atomic.Int64{}
+		activity.Store(time.Now().UnixNano())
+		clientReader = &idleConn{Conn: client, timeout: limits.IdleTimeout, activity: activity}
+		remoteReader = &idleConn{Conn: remote, timeout: limits.IdleTimeout, activity: activity}
+	}
+	if limits.MaxDuration > 0 {
+		timer := time.AfterFunc(limits.MaxDuration, func() {
+			logger.Debug().Msgf("closing tunnel to %s after %v", remote.RemoteAddr(), limits.MaxDuration)
+			m.proxyFailures.WithLabelValues("max_duration").Inc()
+			client.Close()
+			remote.Close()
+		})
+		defer timer.Stop()
+	}
+
+	done := make(chan bool)
+	downstream := &countingWriter{w: client, counter: m.proxyBytes.WithLabelValues(proxyDownstream)}
+	upstream := &countingWriter{w: remote, counter: m.proxyBytes.WithLabelValues(proxyUpstream)}
+
+	go func() {
+		if _, err := io.Copy(downstream, remoteReader); err != nil {
+			switch {
+			case errors.Is(err, os.ErrDeadlineExceeded):
+				m.proxyFailures.WithLabelValues("idle_timeout").Inc()
+			case !errors.Is(err, net.ErrClosed):
+				m.proxyFailures.WithLabelValues("copy_downstream").Inc()
+			}
+			logger.Debug().Msgf("error copying from remote to client: %v", err)
+		}
+		defer client.Close()
+		done <- true
+	}()
+
+	go func() {
+		if _, err := io.Copy(upstream, clientReader); err != nil {
+			switch {
+			case errors.Is(err, os.ErrDeadlineExceeded):
+				m.proxyFailures.WithLabelValues("idle_timeout").Inc()
+			case !errors.Is(err, net.ErrClosed):
+				m.proxyFailures.WithLabelValues("copy_upstream").Inc()
+			}
+			logger.Debug().Msgf("error copying from client to remote: %v", err)
+		}
+		defer remote.Close()
+		done <- true
+	}()
+
+	<-done
+	<-done
+}
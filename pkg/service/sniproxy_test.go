@@ -0,0 +1,141 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	pb "github.com/je4/miniresolver/v2/pkg/miniresolverproto"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPeekServerName(t *testing.T) {
+	tests := []struct {
+		name       string
+		send       func(conn net.Conn)
+		serverName string
+	}{
+		{
+			name: "client hello",
+			send: func(conn net.Conn) {
+				tls.Client(conn, &tls.Config{ServerName: "svc.dom.miniresolver", InsecureSkipVerify: true}).Handshake()
+			},
+			serverName: "svc.dom.miniresolver",
+		},
+		{
+			name: "client hello without server name",
+			send: func(conn net.Conn) {
+				tls.Client(conn, &tls.Config{InsecureSkipVerify: true}).Handshake()
+			},
+		},
+		{
+			name: "no tls",
+			send: func(conn net.Conn) {
+				io.WriteString(conn, "GET / HTTP/1.1\r\nHost: svc.dom.miniresolver\r\n\r\n")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			go tt.send(client)
+			server.SetReadDeadline(time.Now().Add(5 * time.Second))
+			serverName, hello, err := peekServerName(server)
+			server.Close()
+			client.Close()
+			if tt.serverName == "" {
+				if err == nil {
+					t.Fatalf("server name '%s' without valid client hello", serverName)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("cannot peek server name: %v", err)
+			}
+			if serverName != tt.serverName {
+				t.Errorf("server name '%s', want '%s'", serverName, tt.serverName)
+			}
+
+			// the peeked bytes contain the complete client hello for the instance
+			client, server = net.Pipe()
+			defer server.Close()
+			go func() {
+				client.Write(hello)
+				client.Close()
+			}()
+			if replayed, _, err := peekServerName(server); err != nil || replayed != tt.serverName {
+				t.Errorf("replayed client hello: '%s', %v", replayed, err)
+			}
+		})
+	}
+}
+
+func TestSNIProxyLookup(t *testing.T) {
+	c := newCache(time.Minute, testLogger())
+	defer c.Close()
+	c.addService("svc", &pb.ServiceInstance{Addr: "127.0.0.1:1001"}, []string{"dom"}, false, time.Now(), caller{})
+	c.addService("mediaserverproto.Action", &pb.ServiceInstance{Addr: "127.0.0.1:1002"}, []string{"ub"}, false, time.Now(), caller{})
+	c.addService("plain", &pb.ServiceInstance{Addr: "127.0.0.1:1003"}, nil, false, time.Now(), caller{})
+	p := newSNIProxy("", "miniresolver.", c, newProxyLimiter(ProxyLimits{}), newMetrics(c), testLogger())
+
+	tests := []struct {
+		serverName string
+		name       string
+		addr       string
+	}{
+		{"svc.dom.miniresolver", "dom.svc", "127.0.0.1:1001"},
+		{"SVC.Dom.MiniResolver.", "Dom.SVC", "127.0.0.1:1001"},
+		{"dom.svc", "dom.svc", "127.0.0.1:1001"},
+		{"mediaserverproto.Action.ub.miniresolver", "ub.mediaserverproto.Action", "127.0.0.1:1002"},
+		{"plain.miniresolver", "plain", "127.0.0.1:1003"},
+		{"other.dom.miniresolver", "other.dom", ""},
+		{"svc.dom.otherzone", "svc.dom.otherzone", ""},
+		{"miniresolver", "miniresolver", ""},
+	}
+	for _, tt := range tests {
+		name, addr := p.lookup(tt.serverName)
+		if name != tt.name || addr != tt.addr {
+			t.Errorf("lookup(%s) = %s, %s, want %s, %s", tt.serverName, name, addr, tt.name, tt.addr)
+		}
+	}
+}
+
+func TestSNIProxy(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "hello "+req.TLS.ServerName)
+	}))
+	defer backend.Close()
+
+	c := newCache(time.Minute, testLogger())
+	defer c.Close()
+	c.addService("svc", &pb.ServiceInstance{Addr: backend.Listener.Addr().String()}, []string{"dom"}, false, time.Now(), caller{})
+	p := newSNIProxy("127.0.0.1:0", "miniresolver", c, newProxyLimiter(ProxyLimits{}), newMetrics(c), testLogger())
+	if err := p.Start(); err != nil {
+		t.Fatalf("cannot start sni proxy: %v", err)
+	}
+	defer p.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, p.listener.Addr().String())
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	resp, err := client.Get("https://svc.dom.miniresolver/")
+	if err != nil {
+		t.Fatalf("cannot get through sni proxy: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello svc.dom.miniresolver" {
+		t.Errorf("body '%s'", body)
+	}
+
+	// the connection to an unknown service is closed
+	if _, err := client.Get("https://other.dom.miniresolver/"); err == nil {
+		t.Error("no error for unknown service")
+	}
+}